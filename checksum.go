@@ -0,0 +1,128 @@
+package mtque
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// CHECKSUM_SIZE is the size of the CRC32 at the end of every record,
+// and at the end of the space reserved for the buffer info.
+const CHECKSUM_SIZE = 4
+
+// CorruptionPolicy decides what to do with the torn or corrupt records
+// found at recovering the buffer.
+type CorruptionPolicy int
+
+const (
+	// CorruptionStrict fails the recovery at the first bad record.
+	CorruptionStrict CorruptionPolicy = iota
+	// CorruptionTruncateTail drops the first bad record and all the
+	// records after it.
+	CorruptionTruncateTail
+	// CorruptionSkipBad drops the bad records only, the records after
+	// a bad one whose length is corrupt are dropped too, because the
+	// next record can not be located.
+	CorruptionSkipBad
+)
+
+// DroppedRecord describes the records dropped at recovering.
+type DroppedRecord struct {
+	File   string
+	Offset int64 //position of the first dropped record in the storage
+	Size   int64 //span of the positions of the dropped records, it is the number of bytes in the file
+	Err    error //why the records are dropped
+}
+
+// RecoveryReport describes the result of recovering a buffer.
+type RecoveryReport struct {
+	Recovered int64
+	Dropped   []DroppedRecord
+}
+
+// drop records the dropped records in the report.
+func (r *RecoveryReport) drop(file string, offset, size int64, err error) {
+	r.Dropped = append(r.Dropped, DroppedRecord{
+		File:   file,
+		Offset: offset,
+		Size:   size,
+		Err:    err,
+	})
+}
+
+func SetBufferCorruptionPolicy(policy CorruptionPolicy) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.Corruption = policy
+	}
+}
+
+// SetQueueCorruptionPolicy set the policy applied to the corrupt records
+// at recovering the queue. The default policy is CorruptionStrict.
+func SetQueueCorruptionPolicy(policy CorruptionPolicy) func(*Queue) {
+	return func(queue *Queue) {
+		queue.Corruption = policy
+	}
+}
+
+// SetStackCorruptionPolicy set the policy applied to the corrupt records
+// at recovering the stack. The default policy is CorruptionStrict.
+func SetStackCorruptionPolicy(policy CorruptionPolicy) func(*Stack) {
+	return func(stack *Stack) {
+		stack.Corruption = policy
+	}
+}
+
+// SetPriorityQueueCorruptionPolicy set the policy applied to the corrupt
+// records at recovering the priority queue.
+func SetPriorityQueueCorruptionPolicy(policy CorruptionPolicy) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.Corruption = policy
+	}
+}
+
+// SetDelayQueueCorruptionPolicy set the policy applied to the corrupt
+// records at recovering the delay queue.
+func SetDelayQueueCorruptionPolicy(policy CorruptionPolicy) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.Corruption = policy
+	}
+}
+
+// SetDequeCorruptionPolicy set the policy applied to the corrupt
+// records at recovering the deque.
+func SetDequeCorruptionPolicy(policy CorruptionPolicy) func(*Deque) {
+	return func(deque *Deque) {
+		deque.Corruption = policy
+	}
+}
+
+// LastRecovery returns the report of the last recovery of buffer.
+func (b *Buffer) LastRecovery() RecoveryReport {
+	b.Mutex.RLock()
+	defer b.Mutex.RUnlock()
+
+	report := b.report
+	report.Dropped = append([]DroppedRecord(nil), b.report.Dropped...)
+
+	return report
+}
+
+// appendChecksum appends the CRC32 of data to dst.
+func appendChecksum(dst, data []byte) []byte {
+	return binary.BigEndian.AppendUint32(dst, crc32.ChecksumIEEE(data))
+}
+
+// verifyChecksum checks the CRC32 at the end of data, and returns the
+// data without it.
+func verifyChecksum(data []byte) ([]byte, error) {
+	if len(data) < CHECKSUM_SIZE {
+		return nil, fmt.Errorf("data is too short to have a checksum")
+	}
+
+	n := len(data) - CHECKSUM_SIZE
+	if crc32.ChecksumIEEE(data[:n]) != binary.BigEndian.Uint32(data[n:]) {
+		return nil, fmt.Errorf("checksum mismatch, data is corrupt")
+	}
+
+	return data[:n], nil
+}
@@ -0,0 +1,194 @@
+package mtque
+
+import (
+	"os"
+	"testing"
+)
+
+// corruptFile persists the values into the file, and flips a byte at
+// the offset from the beginning of the nth record.
+func corruptFile(t *testing.T, file string, values []int, nth int, offset int64) {
+	os.Remove(file)
+
+	buf := NewBuffer(
+		SetBufferFile(file),
+		SetBufferPersistenceControl(true),
+	)
+	for _, v := range values {
+		buf.AddDataAtTail(v)
+	}
+	if err := buf.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+
+	node := buf.Datas.Head
+	for i := 0; i < nth; i++ {
+		node = node.Next
+	}
+	seek := node.pos
+
+	f, err := os.OpenFile(file, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	f.ReadAt(b, seek+offset)
+	b[0] ^= 0xff
+	f.WriteAt(b, seek+offset)
+}
+
+func recoverFile(file string, policy CorruptionPolicy) (*Buffer, error) {
+	buf := NewBuffer(
+		SetBufferFile(file),
+		SetBufferRecoveryControl(true),
+		SetBufferCorruptionPolicy(policy),
+		SetBufferDecoder(func(decode func(interface{}) error) (interface{}, error) {
+			var value int
+			err := decode(&value)
+			return value, err
+		}),
+	)
+
+	return buf, buf.Recovery()
+}
+
+func linkValues(buf *Buffer) []interface{} {
+	var values []interface{}
+	for node := buf.Datas.Head; node != nil; node = node.Next {
+		values = append(values, node.Value)
+	}
+
+	return values
+}
+
+func TestCorruptRecord(t *testing.T) {
+	corruptFile(t, "./buffer_corrupt", []int{1, 2, 3, 4}, 1, DATA_HEAD_SIZE+2)
+
+	t.Run("Strict", func(t *testing.T) {
+		buf, err := recoverFile("./buffer_corrupt", CorruptionStrict)
+		if err == nil {
+			t.Fatal("The corrupt record should fail the recovery")
+		}
+		if buf.Len() != 0 || buf.Datas.Head != nil {
+			t.Fatal("The datas before the corrupt record should be dropped:", linkValues(buf))
+		}
+
+		stack, err := OpenStack(
+			SetStackFile("./buffer_corrupt"),
+			SetStackRecoveryControl(true),
+			SetStackDecoder(intDecoder),
+		)
+		if err == nil || stack != nil {
+			t.Fatal("The stack should not be bound to the corrupt file:", err)
+		}
+		lock, err := lockFile("./buffer_corrupt", 0)
+		if err != nil {
+			t.Fatal("The lock should be released:", err)
+		}
+		unlockFile(lock)
+		os.Remove("./buffer_corrupt.lock")
+	})
+
+	t.Run("SkipBad", func(t *testing.T) {
+		buf, err := recoverFile("./buffer_corrupt", CorruptionSkipBad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := linkValues(buf); len(v) != 3 || v[0] != 1 || v[1] != 3 || v[2] != 4 {
+			t.Fatal("Only the corrupt record should be dropped:", v)
+		}
+
+		report := buf.LastRecovery()
+		if report.Recovered != 3 || len(report.Dropped) != 1 {
+			t.Fatal("Wrong report:", report)
+		}
+		if d := report.Dropped[0]; d.Offset != buf.Datas.Head.end || d.Size != buf.Datas.Head.end-buf.Datas.Head.pos {
+			t.Fatal("Wrong dropped record:", d)
+		}
+	})
+
+	t.Run("TruncateTail", func(t *testing.T) {
+		buf, err := recoverFile("./buffer_corrupt", CorruptionTruncateTail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := linkValues(buf); len(v) != 1 || v[0] != 1 {
+			t.Fatal("The records after the corrupt one should be dropped:", v)
+		}
+		if report := buf.LastRecovery(); len(report.Dropped) != 1 || report.Dropped[0].Offset+report.Dropped[0].Size != buf.FileEndSeek {
+			t.Fatal("Wrong report:", report)
+		}
+
+		buf.PersistenceControl = true
+		if err := buf.Persistent(); err != nil {
+			t.Fatal(err)
+		}
+		if buf, err := recoverFile("./buffer_corrupt", CorruptionStrict); err != nil || buf.Len() != 1 {
+			t.Fatal("The corrupt records should be removed at the next persistence:", err)
+		}
+	})
+}
+
+func TestCorruptLength(t *testing.T) {
+	corruptFile(t, "./buffer_corrupt_len", []int{1, 2, 3}, 1, 1)
+
+	buf, err := recoverFile("./buffer_corrupt_len", CorruptionSkipBad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := linkValues(buf); len(v) != 1 || v[0] != 1 {
+		t.Fatal("The records after a corrupt length should be dropped:", v)
+	}
+}
+
+func TestCorruptBufferInfo(t *testing.T) {
+	corruptFile(t, "./buffer_corrupt_info", []int{1}, 0, -CHECKSUM_SIZE-1)
+
+	if _, err := recoverFile("./buffer_corrupt_info", CorruptionSkipBad); err == nil {
+		t.Fatal("The corrupt buffer info should fail the recovery")
+	}
+}
+
+func TestLegacyRecord(t *testing.T) {
+	defer os.Remove("./buffer_legacy")
+	writeLegacyFile(t, "./buffer_legacy", legacyInfoSize, 7)
+
+	buf, err := recoverFile("./buffer_legacy", CorruptionStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := buf.GetHeadValue(); v != 7 {
+		t.Fatal("Wrong value:", v)
+	}
+
+	buf.PersistenceControl = true
+	if err := buf.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := recoverFile("./buffer_legacy", CorruptionStrict); err != nil || !buf.Checksum || buf.Len() != 1 {
+		t.Fatal("The legacy file should be rewritten with checksums:", err)
+	}
+}
+
+func TestRecoverUnregistered(t *testing.T) {
+	file := "./queue_unregistered"
+	defer os.Remove(file)
+	defer os.Remove(file + ".lock")
+	persistQueue(t, file, 1, 2)
+
+	for _, policy := range []CorruptionPolicy{CorruptionStrict, CorruptionSkipBad, CorruptionTruncateTail} {
+		queue, err := NewManager().openQueue(
+			SetQueueFile(file),
+			SetQueueRecoveryControl(true),
+			SetQueueCorruptionPolicy(policy),
+		)
+		if err == nil {
+			t.Fatal("The recovery without a decoder should fail under every policy")
+		}
+		if queue.GetFile() != "" || queue.Len() != 0 || queue.Datas.Head != nil {
+			t.Fatal("The queue should be left as it was if failed to recover")
+		}
+	}
+}
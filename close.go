@@ -0,0 +1,198 @@
+package mtque
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrClosed is returned by the operations on a closed buffer.
+var ErrClosed = errors.New("buffer is closed")
+
+// close marks the buffer closed, stops the reaper and wakes up all the
+// waiting goroutines, which will return ErrClosed.
+// The Mutex should be held by the caller.
+func (b *Buffer) close() error {
+	if b.closed {
+		return ErrClosed
+	}
+
+	b.closed = true
+	b.flushed = make(chan struct{})
+	if b.lock != nil {
+		b.manager().setClosing(b.File, b)
+	}
+	b.closeWAL()
+	if b.reaper != nil {
+		b.reaper.Stop()
+		b.reaper = nil
+	}
+	b.broadcast()
+
+	return nil
+}
+
+// flush persists the datas which are not persisted yet if the persistence
+// is enabled, and then releases the lock of file, so the file can be bound
+// again by the buffers waiting for it in acquireLock. It returns the error of
+// ctx if the ctx is done before that, the flush goes on until it finishes,
+// which can be waited by waitFlush.
+// The buffer should be closed before it.
+func (b *Buffer) flush(ctx context.Context) error {
+	b.Mutex.RLock()
+	persist := b.PersistenceControl && b.File != ""
+	flushed := b.flushed
+	b.Mutex.RUnlock()
+
+	release := func() {
+		b.Mutex.Lock()
+		file := b.File
+		b.releaseLock()
+		b.Mutex.Unlock()
+		b.manager().unsetClosing(file, b)
+		close(flushed)
+	}
+
+	if !persist {
+		release()
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		b.Mutex.Lock()
+		err := b.incrementPersistent()
+		b.Mutex.Unlock()
+		release()
+		done <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
+
+// waitFlush waits for the flush at closing the buffer to finish,
+// it returns at once if the buffer is not closed.
+func (b *Buffer) waitFlush() {
+	b.Mutex.RLock()
+	flushed := b.flushed
+	b.Mutex.RUnlock()
+
+	if flushed != nil {
+		<-flushed
+	}
+}
+
+// Close stops the periodic persistence of queue, flushes the datas which
+// are not persisted yet, and removes the queue from the queue list.
+// The goroutines waiting on the queue are woken up with ErrClosed, and
+// all the later operations fail with ErrClosed.
+func (q *Queue) Close(ctx context.Context) error {
+	q.Mutex.Lock()
+	err := q.close()
+	if q.deadTimer != nil {
+		q.deadTimer.Stop()
+		q.deadTimer = nil
+	}
+	file := q.File
+	q.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	q.manager().scheduler.unschedule(q)
+
+	m := q.manager()
+	m.queueMutex.Lock()
+	if m.queues[file] == q {
+		delete(m.queues, file)
+	}
+	m.queueMutex.Unlock()
+
+	return q.flush(ctx)
+}
+
+// Close stops the periodic persistence of stack, flushes the datas which
+// are not persisted yet, and removes the stack from the stack list.
+// The goroutines waiting on the stack are woken up with ErrClosed, and
+// all the later operations fail with ErrClosed.
+func (s *Stack) Close(ctx context.Context) error {
+	s.Mutex.Lock()
+	err := s.close()
+	file := s.File
+	s.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.manager().scheduler.unschedule(s)
+
+	m := s.manager()
+	m.stackMutex.Lock()
+	if m.stacks[file] == s {
+		delete(m.stacks, file)
+	}
+	m.stackMutex.Unlock()
+
+	return s.flush(ctx)
+}
+
+// Close stops the periodic persistence of priority queue and flushes
+// the datas which are not persisted yet. All the later operations
+// fail with ErrClosed.
+func (q *PriorityQueue) Close(ctx context.Context) error {
+	q.Mutex.Lock()
+	err := q.close()
+	q.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	q.manager().scheduler.unschedule(q)
+	q.manager().untrack(q)
+
+	return q.flush(ctx)
+}
+
+// Close stops the periodic persistence of delay queue and flushes
+// the datas which are not persisted yet. All the later operations
+// fail with ErrClosed.
+func (q *DelayQueue) Close(ctx context.Context) error {
+	q.Mutex.Lock()
+	err := q.close()
+	q.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	q.manager().scheduler.unschedule(q)
+	q.manager().untrack(q)
+
+	return q.flush(ctx)
+}
+
+// Close stops the periodic persistence of deque and flushes the
+// datas which are not persisted yet. All the later operations
+// fail with ErrClosed.
+func (d *Deque) Close(ctx context.Context) error {
+	d.Mutex.Lock()
+	err := d.close()
+	d.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	d.manager().scheduler.unschedule(d)
+	d.manager().untrack(d)
+
+	return d.flush(ctx)
+}
+
+// Shutdown closes all the buffers bound to files in the default Manager,
+// and stops the scheduler, see Manager.Shutdown.
+func Shutdown(ctx context.Context) error {
+	return defaultManager.Shutdown(ctx)
+}
@@ -0,0 +1,167 @@
+package mtque
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQueueClose(t *testing.T) {
+	os.Remove("./queue_close")
+
+	queue := NewQueue(
+		SetQueueFile("./queue_close"),
+		SetQueuePersistenceControl(true),
+	)
+
+	done := make(chan error)
+	go func() {
+		_, err := queue.DeQueueWait(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	queue.EnQueue(1)
+	if err := <-done; err != nil {
+		t.Fatal("DeQueueWait error:", err)
+	}
+	go func() {
+		_, err := queue.DeQueueWait(context.Background())
+		done <- err
+	}()
+	queue.EnQueue(2)
+	time.Sleep(10 * time.Millisecond)
+
+	if err := queue.Close(context.Background()); err != nil {
+		t.Fatal("Close error:", err)
+	}
+
+	t.Run("Wakeup", func(t *testing.T) {
+		select {
+		case err := <-done:
+			if err != nil && err != ErrClosed {
+				t.Fatal("Wrong error:", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("The waiting consumer should be woken up")
+		}
+	})
+
+	t.Run("Operations", func(t *testing.T) {
+		if err := queue.EnQueue(3); err != ErrClosed {
+			t.Fatal("EnQueue should fail:", err)
+		}
+		if _, err := queue.DeQueue(); err != ErrClosed {
+			t.Fatal("DeQueue should fail:", err)
+		}
+		if _, _, err := queue.Reserve(time.Second); err != ErrClosed {
+			t.Fatal("Reserve should fail:", err)
+		}
+		if err := queue.Close(context.Background()); err != ErrClosed {
+			t.Fatal("Close twice should fail:", err)
+		}
+		if err := queue.Persistent(); err != ErrClosed {
+			t.Fatal("Persistent should fail:", err)
+		}
+		if err := queue.Compact(); err != ErrClosed {
+			t.Fatal("Compact should fail:", err)
+		}
+		if _, ok := defaultManager.queues["./queue_close"]; ok {
+			t.Fatal("The closed queue should be removed from the queue list")
+		}
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		buf := NewBuffer(
+			SetBufferFile("./queue_close"),
+			SetBufferRecoveryControl(true),
+			SetBufferDecoder(func(decode func(interface{}) error) (interface{}, error) {
+				var value int
+				err := decode(&value)
+				return value, err
+			}),
+		)
+		if err := buf.Recovery(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != queue.Len() {
+			t.Fatal("The queue should be flushed at closing:", buf.Len(), queue.Len())
+		}
+	})
+}
+
+func TestReopenClosing(t *testing.T) {
+	file := "./queue_reopen"
+	defer os.Remove(file)
+	defer os.Remove(file + ".lock")
+	m := NewManager()
+	defer m.Shutdown(context.Background())
+
+	queue, err := m.OpenQueue(SetQueueFile(file), SetQueuePersistenceControl(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the queue is closed and unregistered, but not flushed yet.
+	queue.Mutex.Lock()
+	queue.close()
+	queue.Mutex.Unlock()
+	m.queueMutex.Lock()
+	delete(m.queues, file)
+	m.queueMutex.Unlock()
+
+	opened := make(chan error)
+	go func() {
+		_, err := m.OpenQueue(SetQueueFile(file))
+		opened <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := queue.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-opened; err != nil {
+		t.Fatal("The file should be bound again after the closing queue releases it:", err)
+	}
+}
+
+func TestStackClose(t *testing.T) {
+	stack := NewStack()
+
+	done := make(chan error)
+	go func() {
+		_, err := stack.PopWait(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := stack.Close(context.Background()); err != nil {
+		t.Fatal("Close error:", err)
+	}
+	if err := <-done; err != ErrClosed {
+		t.Fatal("PopWait should fail:", err)
+	}
+	if err := stack.Push(1); err != ErrClosed {
+		t.Fatal("Push should fail:", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	os.Remove("./queue_shutdown")
+	os.Remove("./stack_shutdown")
+
+	queue := NewQueue(SetQueueFile("./queue_shutdown"))
+	stack := NewStack(SetStackFile("./stack_shutdown"))
+	defer os.Remove("./stack_shutdown")
+
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal("Shutdown error:", err)
+	}
+	if err := queue.EnQueue(1); err != ErrClosed {
+		t.Fatal("The queue should be closed:", err)
+	}
+	if err := stack.Push(1); err != ErrClosed {
+		t.Fatal("The stack should be closed:", err)
+	}
+}
@@ -0,0 +1,185 @@
+package mtque
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Codec encodes the values into the records of file, and decodes them
+// at recovering. The Name of codec is recorded in the file, so that the
+// file is always decoded with the codec it is encoded with.
+type Codec interface {
+	Name() string
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, ptr interface{}) error
+}
+
+var (
+	// GobCodec encodes the values with encoding/gob, it is the default
+	// codec and the one of the files written before the codecs.
+	GobCodec Codec = gobCodec{}
+	// JSONCodec encodes the values with encoding/json.
+	JSONCodec Codec = jsonCodec{}
+	// RawCodec stores the []byte values as they are.
+	RawCodec Codec = rawCodec{}
+)
+
+var (
+	codecs = map[string]Codec{
+		GobCodec.Name():  GobCodec,
+		JSONCodec.Name(): JSONCodec,
+		RawCodec.Name():  RawCodec,
+	}
+	codecsMutex sync.RWMutex
+)
+
+// RegisterCodec makes the codec known to the recovery by its name, so
+// that the files encoded with it can be recovered by the buffers which
+// are not set with it. The codec replaces the one with the same name.
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(value interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, ptr interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(ptr)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, ptr interface{}) error {
+	return json.Unmarshal(data, ptr)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Name() string {
+	return "raw"
+}
+
+func (rawCodec) Marshal(value interface{}) ([]byte, error) {
+	data, ok := value.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("raw codec can not encode %T, only []byte", value)
+	}
+
+	return data, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, ptr interface{}) error {
+	switch p := ptr.(type) {
+	case *[]byte:
+		*p = append([]byte{}, data...)
+	case *interface{}:
+		*p = append([]byte{}, data...)
+	default:
+		return fmt.Errorf("raw codec can not decode into %T, only *[]byte", ptr)
+	}
+
+	return nil
+}
+
+// codec returns the Codec of buffer, it is GobCodec if not set.
+func (b *Buffer) codec() Codec {
+	if b.Codec == nil {
+		return GobCodec
+	}
+
+	return b.Codec
+}
+
+// lookupCodec returns the codec with the name recorded in file. The
+// file without the name is encoded with GobCodec.
+func (b *Buffer) lookupCodec(name string) (Codec, error) {
+	if name == "" {
+		return GobCodec, nil
+	}
+	if b.codec().Name() == name {
+		return b.codec(), nil
+	}
+
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q of the file, it should be registered", name)
+	}
+
+	return codec, nil
+}
+
+func SetBufferCodec(codec Codec) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.Codec = codec
+	}
+}
+
+// SetQueueCodec set the codec to encode the values in file, the default
+// one is GobCodec. The codec of an existing file is kept at recovering.
+func SetQueueCodec(codec Codec) func(*Queue) {
+	return func(queue *Queue) {
+		queue.Codec = codec
+	}
+}
+
+// SetStackCodec set the codec to encode the values in file,
+// see SetQueueCodec.
+func SetStackCodec(codec Codec) func(*Stack) {
+	return func(stack *Stack) {
+		stack.Codec = codec
+	}
+}
+
+// SetPriorityQueueCodec set the codec to encode the values in file,
+// see SetQueueCodec.
+func SetPriorityQueueCodec(codec Codec) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.Codec = codec
+	}
+}
+
+// SetDelayQueueCodec set the codec to encode the values in file,
+// see SetQueueCodec.
+func SetDelayQueueCodec(codec Codec) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.Codec = codec
+	}
+}
+
+// SetDequeCodec set the codec to encode the values in file,
+// see SetQueueCodec.
+func SetDequeCodec(codec Codec) func(*Deque) {
+	return func(deque *Deque) {
+		deque.Codec = codec
+	}
+}
@@ -0,0 +1,139 @@
+package mtque
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X, Y int
+}
+
+type upperCodec struct{}
+
+func (upperCodec) Name() string {
+	return "upper"
+}
+
+func (upperCodec) Marshal(value interface{}) ([]byte, error) {
+	return []byte(strings.ToUpper(value.(string))), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, ptr interface{}) error {
+	*ptr.(*string) = string(data)
+	return nil
+}
+
+func TestCodec(t *testing.T) {
+	cases := []struct {
+		name     string
+		codec    Codec
+		value    interface{}
+		register interface{}
+		check    func(v interface{}) bool
+	}{
+		{"Gob", GobCodec, point{1, 2}, point{}, func(v interface{}) bool {
+			return v == point{1, 2}
+		}},
+		{"JSON", JSONCodec, point{3, 4}, point{}, func(v interface{}) bool {
+			return v == point{3, 4}
+		}},
+		{"Raw", RawCodec, []byte("raw"), []byte{}, func(v interface{}) bool {
+			return bytes.Equal(v.([]byte), []byte("raw"))
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			file := "./buffer_codec_" + c.name
+			os.Remove(file)
+			defer os.Remove(file)
+
+			buf := NewBuffer(
+				SetBufferFile(file),
+				SetBufferPersistenceControl(true),
+				SetBufferCodec(c.codec),
+			)
+			buf.AddDataAtTail(c.value)
+			if err := buf.Persistent(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the codec recorded in file is used instead of the default one
+			recovered := NewBuffer(
+				SetBufferFile(file),
+				SetBufferRecoveryControl(true),
+				SetBufferRegister(c.register),
+			)
+			if err := recovered.Recovery(); err != nil {
+				t.Fatal(err)
+			}
+			if recovered.codec() != c.codec || recovered.CodecName != c.codec.Name() {
+				t.Fatal("Wrong codec:", recovered.CodecName)
+			}
+			if v, _ := recovered.GetHeadValue(); !c.check(v) {
+				t.Fatal("Wrong value:", v)
+			}
+		})
+	}
+
+	t.Run("RawInvalid", func(t *testing.T) {
+		buf := NewBuffer(
+			SetBufferFile("./buffer_codec_invalid"),
+			SetBufferPersistenceControl(true),
+			SetBufferCodec(RawCodec),
+		)
+		defer os.Remove("./buffer_codec_invalid")
+
+		buf.AddDataAtTail("not bytes")
+		if err := buf.Persistent(); err == nil {
+			t.Fatal("Raw codec should only encode []byte")
+		}
+	})
+}
+
+func TestRegisterCodec(t *testing.T) {
+	os.Remove("./buffer_codec_custom")
+	defer os.Remove("./buffer_codec_custom")
+
+	buf := NewBuffer(
+		SetBufferFile("./buffer_codec_custom"),
+		SetBufferPersistenceControl(true),
+		SetBufferCodec(upperCodec{}),
+	)
+	buf.AddDataAtTail("value")
+	if err := buf.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+
+	recoverCustom := func() (*Buffer, error) {
+		buf := NewBuffer(
+			SetBufferFile("./buffer_codec_custom"),
+			SetBufferRecoveryControl(true),
+			SetBufferRegister(""),
+		)
+
+		return buf, buf.Recovery()
+	}
+
+	if _, err := recoverCustom(); err == nil {
+		t.Fatal("The file of unknown codec should fail the recovery")
+	}
+
+	RegisterCodec(upperCodec{})
+	defer func() {
+		codecsMutex.Lock()
+		delete(codecs, "upper")
+		codecsMutex.Unlock()
+	}()
+
+	recovered, err := recoverCustom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := recovered.GetHeadValue(); v != "VALUE" {
+		t.Fatal("Wrong value:", v)
+	}
+}
@@ -0,0 +1,228 @@
+package mtque
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetQueueMaxDeliveries set the max times a value can be reserved.
+// When a value is nacked or timed out after reserved for the max times,
+// it is moved into the dead-letter queue instead of being delivered again.
+// If the dead-letter queue refuses it, e.g. it is full, the value is left
+// in queue but never delivered by DeQueue or Reserve, and it is moved again
+// when another value is dead, or the dead-letter queue is set again.
+// 0 means unlimited, which is the default.
+func SetQueueMaxDeliveries(max int64) func(*Queue) {
+	return func(queue *Queue) {
+		queue.MaxDeliveries = max
+	}
+}
+
+// SetQueueDeadLetter set the queue to receive the values which are
+// delivered for the max times. The dead-letter queue can be persisted
+// to its own file by constructing it with SetQueueFile.
+// Without a dead-letter queue, such values are discarded.
+func SetQueueDeadLetter(deadLetter *Queue) func(*Queue) {
+	return func(queue *Queue) {
+		queue.deadLetter = deadLetter
+	}
+}
+
+// SetMaxDeliveries set the max times a value can be reserved.
+func (q *Queue) SetMaxDeliveries(max int64) {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	q.MaxDeliveries = max
+	q.recheckDead()
+}
+
+// GetMaxDeliveries returns the max times a value can be reserved.
+func (q *Queue) GetMaxDeliveries() int64 {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	return q.MaxDeliveries
+}
+
+// SetDeadLetter set the dead-letter queue of queue.
+func (q *Queue) SetDeadLetter(deadLetter *Queue) {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	q.deadLetter = deadLetter
+	q.recheckDead()
+}
+
+// DeadLetter returns the dead-letter queue of queue, it can be used to
+// inspect the dead values with GetHead, Len and Values.
+func (q *Queue) DeadLetter() *Queue {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	return q.deadLetter
+}
+
+// Values returns the values in queue from head to tail,
+// the expired and reserved values are skipped.
+func (q *Queue) Values() []interface{} {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	now := time.Now()
+	values := make([]interface{}, 0, q.Length)
+	for node := q.Datas.Head; node != nil; node = node.Next {
+		if !node.expired(now) && !node.reservedAt(now) {
+			values = append(values, node.Value)
+		}
+	}
+
+	return values
+}
+
+// Replay moves at most n values from the head of dead-letter queue back
+// to the tail of queue, they can be delivered again for MaxDeliveries times.
+// All the values are moved if n <= 0. It returns the number of moved values,
+// and stops at the first value which can not be enqueued, e.g. the queue is full.
+func (q *Queue) Replay(n int) (int, error) {
+	deadLetter := q.DeadLetter()
+	if deadLetter == nil {
+		return 0, fmt.Errorf("queue has no dead-letter queue")
+	}
+
+	moved := 0
+	for n <= 0 || moved < n {
+		value, receipt, err := deadLetter.Reserve(time.Minute)
+		if err != nil {
+			break
+		}
+
+		if err := q.TryEnQueue(value); err != nil {
+			deadLetter.Nack(receipt)
+			return moved, err
+		}
+		deadLetter.Ack(receipt)
+		moved++
+	}
+
+	return moved, nil
+}
+
+// dead returns whether the node is delivered for MaxDeliveries times and
+// not reserved any more, it is skipped by DeQueue and Reserve until moved
+// into the dead-letter queue.
+func (q *Queue) dead(node *DataNode, now time.Time) bool {
+	return q.MaxDeliveries > 0 && node.Deliveries >= q.MaxDeliveries && !node.reservedAt(now)
+}
+
+// nextDead returns the earliest time that a reserved node delivered for
+// MaxDeliveries times is timed out, it is zero if there is no such node.
+// The Mutex should be held by the caller.
+func (q *Queue) nextDead() time.Time {
+	var next time.Time
+	if q.MaxDeliveries <= 0 {
+		return next
+	}
+
+	now := time.Now()
+	for _, node := range q.reserved {
+		if node.Deliveries >= q.MaxDeliveries && node.reservedAt(now) &&
+			(next.IsZero() || node.InvisibleUntil.Before(next)) {
+			next = node.InvisibleUntil
+		}
+	}
+
+	return next
+}
+
+// scheduleDead makes routeDead run at the time, if it is not scheduled
+// to run before that.
+// The Mutex should be held by the caller.
+func (q *Queue) scheduleDead(at time.Time) {
+	if at.IsZero() || q.closed {
+		return
+	}
+	if q.deadTimer != nil && !at.Before(q.deadAt) {
+		return
+	}
+
+	if q.deadTimer != nil {
+		q.deadTimer.Stop()
+	}
+	q.deadAt = at
+	q.deadTimer = time.AfterFunc(time.Until(at), q.routeDead)
+}
+
+// recheckDead makes routeDead run at once if the values can be dead, it is
+// called when the datas, MaxDeliveries or the dead-letter queue is changed.
+// The Mutex should be held by the caller.
+func (q *Queue) recheckDead() {
+	if q.MaxDeliveries > 0 {
+		q.scheduleDead(time.Now())
+	}
+}
+
+// routeDead moves the dead nodes into the dead-letter queue, they are
+// discarded if there is no dead-letter queue. If the dead-letter queue
+// refuses a node, e.g. it is full, the node is left in queue and skipped,
+// and moved again at the next time routeDead runs. It also schedules
+// itself to run when the next reserved node delivered for MaxDeliveries
+// times is timed out.
+// The Mutex should not be held by the caller.
+func (q *Queue) routeDead() {
+	q.Mutex.Lock()
+	if q.closed {
+		q.Mutex.Unlock()
+		return
+	}
+
+	var nodes []*DataNode
+	now := time.Now()
+	for node := q.Datas.Head; node != nil; node = node.Next {
+		if !q.dead(node, now) {
+			continue
+		}
+		// the timed out reservation is dropped, so the node is
+		// not waited by ReserveWait any more.
+		if node.Receipt != "" {
+			delete(q.reserved, node.Receipt)
+			node.Receipt = ""
+			node.InvisibleUntil = time.Time{}
+			q.touchNode(node)
+		}
+		nodes = append(nodes, node)
+	}
+	if q.deadTimer != nil {
+		q.deadTimer.Stop()
+		q.deadTimer = nil
+	}
+	q.scheduleDead(q.nextDead())
+	deadLetter := q.deadLetter
+	q.Mutex.Unlock()
+
+	if nodes == nil {
+		return
+	}
+
+	moved := make(map[*DataNode]bool, len(nodes))
+	for _, node := range nodes {
+		if deadLetter != nil && deadLetter.TryEnQueue(node.Value) != nil {
+			continue
+		}
+		moved[node] = true
+	}
+
+	// the nodes removed from queue meanwhile are not in the datas.
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	for node := q.Datas.Head; node != nil; {
+		next := node.Next
+		if moved[node] {
+			q.deleteNode(node)
+			q.Length--
+		}
+		node = next
+	}
+	q.broadcast()
+}
@@ -0,0 +1,186 @@
+package mtque
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeadLetter(t *testing.T) {
+	os.Remove("./queue_dead")
+
+	dead := NewQueue(
+		SetQueueFile("./queue_dead"),
+		SetQueuePersistenceControl(true),
+	)
+	defer DestroyQueue("./queue_dead")
+
+	queue := NewQueue(
+		SetQueueMaxDeliveries(2),
+		SetQueueDeadLetter(dead),
+	)
+	queue.EnQueue(1)
+	queue.EnQueue(2)
+
+	for i := 0; i < 2; i++ {
+		v, receipt, err := queue.Reserve(time.Hour)
+		if err != nil || v != 1 {
+			t.Fatal("Reserve error:", v, err)
+		}
+		queue.Nack(receipt)
+	}
+
+	v, receipt, err := queue.Reserve(time.Hour)
+	if err != nil || v != 2 {
+		t.Fatal("The value delivered for max times should be skipped:", v, err)
+	}
+	queue.Ack(receipt)
+
+	if queue.Len() != 0 || dead.Len() != 1 {
+		t.Fatal("The value should be moved into the dead-letter queue:", queue.Len(), dead.Len())
+	}
+	if values := queue.DeadLetter().Values(); len(values) != 1 || values[0] != 1 {
+		t.Fatal("Wrong dead values:", values)
+	}
+
+	t.Run("Persistence", func(t *testing.T) {
+		if err := dead.Persistent(); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := NewBuffer(
+			SetBufferFile("./queue_dead"),
+			SetBufferRecoveryControl(true),
+			SetBufferDecoder(func(decode func(interface{}) error) (interface{}, error) {
+				var value int
+				err := decode(&value)
+				return value, err
+			}),
+		)
+		if err := buf.Recovery(); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := buf.GetHeadValue(); buf.Len() != 1 || v != 1 {
+			t.Fatal("Recovery error:", buf.Len(), v)
+		}
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		n, err := queue.Replay(0)
+		if err != nil || n != 1 {
+			t.Fatal("Replay error:", n, err)
+		}
+		if dead.Len() != 0 {
+			t.Fatal("The replayed value should be removed:", dead.Len())
+		}
+		if v, _, _ := queue.Reserve(time.Hour); v != 1 {
+			t.Fatal("The replayed value should be delivered again:", v)
+		}
+	})
+}
+
+func TestDeadLetterFull(t *testing.T) {
+	dead := NewQueue(
+		SetQueueCapacity(1),
+		SetQueueOverflowPolicy(OverflowFail),
+	)
+	dead.EnQueue(0)
+
+	queue := NewQueue(
+		SetQueueMaxDeliveries(1),
+		SetQueueDeadLetter(dead),
+	)
+	queue.EnQueue(1)
+	queue.EnQueue(2)
+
+	_, receipt, _ := queue.Reserve(time.Hour)
+	queue.Nack(receipt)
+
+	if queue.Len() != 2 || dead.Len() != 1 {
+		t.Fatal("The dead value should be left in the queue:", queue.Len(), dead.Len())
+	}
+	if values := queue.Values(); len(values) != 2 || values[0] != 1 {
+		t.Fatal("Wrong values:", values)
+	}
+	if v, err := queue.DeQueue(); err != nil || v != 2 {
+		t.Fatal("The dead value should be skipped by DeQueue:", v, err)
+	}
+	queue.EnQueue(2)
+	v, receipt, err := queue.Reserve(time.Hour)
+	if err != nil || v != 2 {
+		t.Fatal("The dead value should be skipped by Reserve:", v, err)
+	}
+
+	dead.DeQueue()
+	if err := queue.Nack(receipt); err != nil {
+		t.Fatal(err)
+	}
+	if queue.Len() != 1 {
+		t.Fatal("The dead value should be moved at the next nack:", queue.Len())
+	}
+	if values := dead.Values(); len(values) != 1 || values[0] != 1 {
+		t.Fatal("The dead value should be moved into the dead-letter queue:", values)
+	}
+	if _, err := queue.DeQueue(); err == nil {
+		t.Fatal("The value refused by the dead-letter queue should be skipped")
+	}
+}
+
+func TestDeadLetterTimeout(t *testing.T) {
+	dead := NewQueue()
+	queue := NewQueue(
+		SetQueueMaxDeliveries(1),
+		SetQueueDeadLetter(dead),
+	)
+	queue.EnQueue(1)
+
+	if _, _, err := queue.Reserve(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if queue.Len() != 0 || queue.InFlight() != 0 {
+		t.Fatal("The timed out value should be moved out of the queue:", queue.Len(), queue.InFlight())
+	}
+	if values := dead.Values(); len(values) != 1 || values[0] != 1 {
+		t.Fatal("The timed out value should be moved into the dead-letter queue:", values)
+	}
+}
+
+func TestDeliveriesRecovery(t *testing.T) {
+	os.Remove("./queue_deliveries")
+
+	queue := NewQueue(
+		SetQueueFile("./queue_deliveries"),
+		SetQueuePersistenceControl(true),
+	)
+	queue.EnQueue(1)
+	_, receipt, _ := queue.Reserve(time.Hour)
+	queue.Nack(receipt)
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+	DestroyQueue("./queue_deliveries")
+
+	recovered := NewQueue(
+		SetQueueFile("./queue_deliveries"),
+		SetQueueRecoveryControl(true),
+		SetQueueMaxDeliveries(1),
+		SetQueueDecoder(func(decode func(interface{}) error) (interface{}, error) {
+			var value int
+			err := decode(&value)
+			return value, err
+		}),
+	)
+	defer DestroyQueue("./queue_deliveries")
+	if err := recovered.Recovery(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _, err := recovered.Reserve(time.Hour); err == nil {
+		t.Fatal("The delivery count should be recovered:", v)
+	}
+	if recovered.Len() != 0 {
+		t.Fatal("The value should be discarded without a dead-letter queue:", recovered.Len())
+	}
+}
@@ -0,0 +1,288 @@
+package mtque
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"time"
+)
+
+// DelayQueue is a queue which a value is only visible to DeQueue after
+// its due time. The values are dequeued in the order of due time, and
+// the ones with the same due time are dequeued in FIFO order.
+// The due time is persisted with the value, so the pending schedules
+// are still honoured by a recovered queue.
+type DelayQueue struct {
+	Buffer
+
+	order nodeHeap
+}
+
+func newDelayQueue() *DelayQueue {
+	queue := new(DelayQueue)
+	queue.init()
+	queue.order.less = func(a, b *DataNode) bool {
+		return a.DueAt.Before(b.DueAt)
+	}
+
+	return queue
+}
+
+// SetDelayQueueFile set a file for delay queue persistence
+// This function should be called at constructing
+// the queue if you want to persitent queue at backend
+func SetDelayQueueFile(file string) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.File = file
+	}
+}
+
+// SetDelayQueuePersistenceControl set if persistent the delay queue
+func SetDelayQueuePersistenceControl(ctl bool) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.PersistenceControl = ctl
+	}
+}
+
+// SetDelayQueuePersistencePeriod set period to persistent delay queue
+func SetDelayQueuePersistencePeriod(period time.Duration) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.PersistencePeriod = period
+	}
+}
+
+// SetDelayQueueRecoveryControl set if reocovery the delay queue from file
+// If set to recovery from file, the constructor will
+// try to recovery queue from the file.
+func SetDelayQueueRecoveryControl(ctl bool) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.RecoveryControl = ctl
+	}
+}
+
+// SetDelayQueueDecoder set the function to rebuild the values at
+// recovering the delay queue from file.
+func SetDelayQueueDecoder(decoder DecodeFunc) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.Decoder = decoder
+	}
+}
+
+// NewDelayQueue is the constructor of DelayQueue.
+// When use NewDelayQueue to construct a queue, you can
+// use option functions to set the options of queue.
+// If the file is locked by another process, or failed to recover
+// from it, the queue is not bound to the file, use OpenDelayQueue to
+// get the error.
+func NewDelayQueue(opts ...func(*DelayQueue)) *DelayQueue {
+	return defaultManager.NewDelayQueue(opts...)
+}
+
+// OpenDelayQueue works like NewDelayQueue, but it returns an error wrapping
+// ErrLocked if the file is locked by another process, or the error
+// of recovering from the file with CorruptionStrict.
+func OpenDelayQueue(opts ...func(*DelayQueue)) (*DelayQueue, error) {
+	return defaultManager.OpenDelayQueue(opts...)
+}
+
+// SetPersistencePeriod set persistence period for delay queue.
+func (q *DelayQueue) SetPersistencePeriod(p time.Duration) {
+	q.Mutex.Lock()
+	q.PersistencePeriod = p
+	q.Mutex.Unlock()
+
+	q.manager().scheduler.reschedule(q)
+}
+
+// GetPersistencePeriod returns the persistence period of the delay queue
+func (q *DelayQueue) GetPersistencePeriod() time.Duration {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	return q.PersistencePeriod
+}
+
+// GetPersistenceControl retruns the Persistence control setting of delay queue
+func (q *DelayQueue) GetPersistenceControl() bool {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	return q.PersistenceControl
+}
+
+// GetFile returns the presistence file path of delay queue if setting
+func (q *DelayQueue) GetFile() string {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	return q.File
+}
+
+func (q *DelayQueue) Clear() {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	q.clear()
+	q.order.reset(q.Datas)
+}
+
+// GetHead returns the value which is due first without removing it
+// from the queue. If the value is not due yet, an error is returned.
+func (q *DelayQueue) GetHead() (interface{}, error) {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	node, err := q.due()
+	if err != nil {
+		return nil, err
+	}
+
+	return node.Value, nil
+}
+
+// NextDue returns the due time of the value which is due first.
+func (q *DelayQueue) NextDue() (time.Time, error) {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	if q.closed {
+		return time.Time{}, ErrClosed
+	}
+
+	node := q.order.top()
+	if node == nil {
+		return time.Time{}, fmt.Errorf("queue is empty")
+	}
+
+	return node.DueAt, nil
+}
+
+// EnQueue adds a value which is due immediately.
+func (q *DelayQueue) EnQueue(value interface{}) error {
+	return q.EnQueueAt(value, time.Now())
+}
+
+// EnQueueAfter adds a value which will be due after the duration.
+func (q *DelayQueue) EnQueueAfter(value interface{}, d time.Duration) error {
+	return q.EnQueueAt(value, time.Now().Add(d))
+}
+
+// EnQueueAt adds a value which will be due at the time.
+func (q *DelayQueue) EnQueueAt(value interface{}, due time.Time) error {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	node := NewDataNode(value)
+	node.DueAt = due
+	q.addNodeAtTail(node)
+	q.order.add(node)
+
+	q.Length++
+
+	if q.Length == 1 {
+		q.SetRegister(value)
+	}
+
+	q.broadcast()
+
+	return nil
+}
+
+// DeQueue removes the value which is due first and returns it.
+// If the value is not due yet, an error is returned.
+func (q *DelayQueue) DeQueue() (interface{}, error) {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	node, err := q.due()
+	if err != nil {
+		return nil, err
+	}
+
+	return q.deQueue(node), nil
+}
+
+// DeQueueWait works like DeQueue, but it will block the caller until
+// there is a value due, or the ctx is done.
+func (q *DelayQueue) DeQueueWait(ctx context.Context) (interface{}, error) {
+	for {
+		q.Mutex.Lock()
+		if q.closed {
+			q.Mutex.Unlock()
+			return nil, ErrClosed
+		}
+		node := q.order.top()
+		if node != nil && !node.DueAt.After(time.Now()) {
+			value := q.deQueue(node)
+			q.Mutex.Unlock()
+			return value, nil
+		}
+		wait := q.waitChan()
+		q.Mutex.Unlock()
+
+		var until time.Time
+		if node != nil {
+			until = node.DueAt
+		}
+
+		err := waitFor(ctx, wait, until)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// due returns the node which is due first.
+// The Mutex should be held by the caller.
+func (q *DelayQueue) due() (*DataNode, error) {
+	if q.closed {
+		return nil, ErrClosed
+	}
+
+	node := q.order.top()
+	if node == nil {
+		return nil, fmt.Errorf("queue is empty")
+	}
+	if node.DueAt.After(time.Now()) {
+		return nil, fmt.Errorf("no value is due until %s", node.DueAt)
+	}
+
+	return node, nil
+}
+
+// deQueue removes the node which is due first and returns its value.
+// The Mutex should be held by the caller.
+func (q *DelayQueue) deQueue(node *DataNode) interface{} {
+	heap.Pop(&q.order)
+	q.deleteNode(node)
+	q.Length--
+	q.broadcast()
+
+	return node.Value
+}
+
+func (q *DelayQueue) Persistent() error {
+	return q.Buffer.Persistent()
+}
+
+// Recovery sets up the delay queue from the file, and rebuilds
+// the order of due time of the recovered values.
+func (q *DelayQueue) Recovery() error {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	err := q.recovery()
+	q.order.reset(q.Datas)
+
+	return err
+}
+
+func (q *DelayQueue) PeriodicallyPersistent() {
+	if q.GetPersistenceControl() {
+		q.Persistent()
+	}
+}
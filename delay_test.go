@@ -0,0 +1,111 @@
+package mtque
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDelayQueueOrder(t *testing.T) {
+	queue := NewDelayQueue()
+	now := time.Now()
+
+	queue.EnQueueAt("second", now.Add(-time.Second))
+	queue.EnQueueAt("first", now.Add(-2*time.Second))
+	queue.EnQueueAt("third", now.Add(-time.Second))
+	queue.EnQueueAfter("later", time.Hour)
+
+	for _, expected := range []string{"first", "second", "third"} {
+		v, err := queue.DeQueue()
+		if err != nil {
+			t.Fatal("dequeue error:", err)
+		}
+		if v != expected {
+			t.Fatal("Wrong value:", v, "expected:", expected)
+		}
+	}
+
+	if v, err := queue.DeQueue(); err == nil {
+		t.Fatal("dequeue a value which is not due:", v)
+	}
+	if v, err := queue.GetHead(); err == nil {
+		t.Fatal("get a value which is not due:", v)
+	}
+	if queue.Len() != 1 {
+		t.Fatal("Wrong length:", queue.Len())
+	}
+}
+
+func TestDelayQueueWait(t *testing.T) {
+	queue := NewDelayQueue()
+
+	start := time.Now()
+	queue.EnQueueAfter(1, 100*time.Millisecond)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		queue.EnQueueAfter(2, 10*time.Millisecond)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	v, err := queue.DeQueueWait(ctx)
+	if err != nil || v != 2 {
+		t.Fatal("DeQueueWait error:", v, err)
+	}
+	v, err = queue.DeQueueWait(ctx)
+	if err != nil || v != 1 {
+		t.Fatal("DeQueueWait error:", v, err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatal("DeQueueWait returns a value before it is due")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := queue.DeQueueWait(ctx); err != context.DeadlineExceeded {
+		t.Fatal("DeQueueWait should be stopped by the deadline:", err)
+	}
+}
+
+func TestDelayQueueRecovery(t *testing.T) {
+	os.Remove("./delay_queue")
+
+	queue := NewDelayQueue(SetDelayQueueFile("./delay_queue"))
+
+	queue.EnQueueAfter(1, 50*time.Millisecond)
+	queue.EnQueue(2)
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+	queue.Close(context.Background())
+
+	recovered := NewDelayQueue(
+		SetDelayQueueFile("./delay_queue"),
+		SetDelayQueueRecoveryControl(true),
+		SetDelayQueueDecoder(func(decode func(interface{}) error) (interface{}, error) {
+			var value int
+			err := decode(&value)
+			return value, err
+		}),
+	)
+
+	if recovered.Len() != 2 {
+		t.Fatal("Recovery error:", recovered.Len())
+	}
+
+	if v, err := recovered.DeQueue(); err != nil || v != 2 {
+		t.Fatal("dequeue error:", v, err)
+	}
+	if v, err := recovered.DeQueue(); err == nil {
+		t.Fatal("dequeue a value which is not due:", v)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if v, err := recovered.DeQueueWait(ctx); err != nil || v != 1 {
+		t.Fatal("DeQueueWait error:", v, err)
+	}
+}
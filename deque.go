@@ -0,0 +1,255 @@
+package mtque
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Deque is a double-ended queue, the values can be added and removed
+// at both the front and the back. The front is the head of buffer.
+type Deque struct {
+	Buffer
+}
+
+func newDeque() *Deque {
+	deque := new(Deque)
+	deque.init()
+
+	return deque
+}
+
+// SetDequeFile set a file for deque persistence
+// This function should be called at constructing
+// the deque if you want to persitent deque at backend
+func SetDequeFile(file string) func(*Deque) {
+	return func(deque *Deque) {
+		deque.File = file
+	}
+}
+
+// SetDequePersistenceControl set if persistent the deque
+func SetDequePersistenceControl(ctl bool) func(*Deque) {
+	return func(deque *Deque) {
+		deque.PersistenceControl = ctl
+	}
+}
+
+// SetDequePersistencePeriod set period to persistent deque
+func SetDequePersistencePeriod(period time.Duration) func(*Deque) {
+	return func(deque *Deque) {
+		deque.PersistencePeriod = period
+	}
+}
+
+// SetDequeRecoveryControl set if reocovery the deque from file
+// If set to recovery from file, the constructor will
+// try to recovery deque from the file.
+func SetDequeRecoveryControl(ctl bool) func(*Deque) {
+	return func(deque *Deque) {
+		deque.RecoveryControl = ctl
+	}
+}
+
+// SetDequeDecoder set the function to rebuild the values at
+// recovering the deque from file.
+func SetDequeDecoder(decoder DecodeFunc) func(*Deque) {
+	return func(deque *Deque) {
+		deque.Decoder = decoder
+	}
+}
+
+// NewDeque is the constructor of Deque.
+// When use NewDeque to construct a deque, you can
+// use option functions to set the options of deque.
+// If the file is locked by another process, or failed to recover
+// from it, the deque is not bound to the file, use OpenDeque to
+// get the error.
+func NewDeque(opts ...func(*Deque)) *Deque {
+	return defaultManager.NewDeque(opts...)
+}
+
+// OpenDeque works like NewDeque, but it returns an error wrapping
+// ErrLocked if the file is locked by another process, or the error
+// of recovering from the file with CorruptionStrict.
+func OpenDeque(opts ...func(*Deque)) (*Deque, error) {
+	return defaultManager.OpenDeque(opts...)
+}
+
+// SetPersistencePeriod set persistence period for deque.
+func (d *Deque) SetPersistencePeriod(p time.Duration) {
+	d.Mutex.Lock()
+	d.PersistencePeriod = p
+	d.Mutex.Unlock()
+
+	d.manager().scheduler.reschedule(d)
+}
+
+// GetPersistencePeriod returns the persistence period of the deque
+func (d *Deque) GetPersistencePeriod() time.Duration {
+	d.Mutex.RLock()
+	defer d.Mutex.RUnlock()
+
+	return d.PersistencePeriod
+}
+
+// GetPersistenceControl retruns the Persistence control setting of deque
+func (d *Deque) GetPersistenceControl() bool {
+	d.Mutex.RLock()
+	defer d.Mutex.RUnlock()
+
+	return d.PersistenceControl
+}
+
+// GetFile returns the presistence file path of deque if setting
+func (d *Deque) GetFile() string {
+	d.Mutex.RLock()
+	defer d.Mutex.RUnlock()
+
+	return d.File
+}
+
+// PeekFront returns the value at the front of deque without removing it.
+func (d *Deque) PeekFront() (interface{}, error) {
+	d.Mutex.RLock()
+	defer d.Mutex.RUnlock()
+
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if d.Datas.Head == nil {
+		return nil, fmt.Errorf("deque is empty")
+	}
+
+	return d.Datas.Head.Value, nil
+}
+
+// PeekBack returns the value at the back of deque without removing it.
+func (d *Deque) PeekBack() (interface{}, error) {
+	d.Mutex.RLock()
+	defer d.Mutex.RUnlock()
+
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if d.Datas.Tail == nil {
+		return nil, fmt.Errorf("deque is empty")
+	}
+
+	return d.Datas.Tail.Value, nil
+}
+
+// PushFront adds a value at the front of deque.
+func (d *Deque) PushFront(value interface{}) error {
+	return d.push(value, true)
+}
+
+// PushBack adds a value at the back of deque.
+func (d *Deque) PushBack(value interface{}) error {
+	return d.push(value, false)
+}
+
+func (d *Deque) push(value interface{}, front bool) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+
+	node := NewDataNode(value)
+	if front {
+		d.addNodeAtHead(node)
+	} else {
+		d.addNodeAtTail(node)
+	}
+	d.Length++
+
+	if d.Length == 1 {
+		d.SetRegister(value)
+	}
+
+	d.broadcast()
+
+	return nil
+}
+
+// PopFront removes the value at the front of deque and returns it.
+func (d *Deque) PopFront() (interface{}, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	return d.pop(d.Datas.Head)
+}
+
+// PopBack removes the value at the back of deque and returns it.
+func (d *Deque) PopBack() (interface{}, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
+	return d.pop(d.Datas.Tail)
+}
+
+// PopFrontWait works like PopFront, but it will block the caller when
+// the deque is empty, until a value is pushed or the ctx is done.
+func (d *Deque) PopFrontWait(ctx context.Context) (interface{}, error) {
+	return d.popWait(ctx, true)
+}
+
+// PopBackWait works like PopBack, but it will block the caller when
+// the deque is empty, until a value is pushed or the ctx is done.
+func (d *Deque) PopBackWait(ctx context.Context) (interface{}, error) {
+	return d.popWait(ctx, false)
+}
+
+func (d *Deque) popWait(ctx context.Context, front bool) (interface{}, error) {
+	for {
+		d.Mutex.Lock()
+		if d.closed || d.Length > 0 {
+			node := d.Datas.Tail
+			if front {
+				node = d.Datas.Head
+			}
+			value, err := d.pop(node)
+			d.Mutex.Unlock()
+			return value, err
+		}
+		wait := d.waitChan()
+		d.Mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// pop removes the node at one end of deque and returns its value.
+// The Mutex should be held by the caller.
+func (d *Deque) pop(node *DataNode) (interface{}, error) {
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if node == nil {
+		return nil, fmt.Errorf("deque is empty")
+	}
+
+	d.deleteNode(node)
+	d.Length--
+	d.broadcast()
+
+	return node.Value, nil
+}
+
+func (d *Deque) Persistent() error {
+	return d.Buffer.Persistent()
+}
+
+// PeriodicallyPersistent persists the deque if the persistence control
+// is enabled, it is called by the scheduler every persistence period.
+func (d *Deque) PeriodicallyPersistent() {
+	if d.GetPersistenceControl() {
+		d.Persistent()
+	}
+}
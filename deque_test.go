@@ -0,0 +1,136 @@
+package mtque
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeque(t *testing.T) {
+	deque := NewDeque()
+
+	if _, err := deque.PopFront(); err == nil {
+		t.Fatal("PopFront from an empty deque should fail")
+	}
+	if _, err := deque.PeekBack(); err == nil {
+		t.Fatal("PeekBack of an empty deque should fail")
+	}
+
+	deque.PushBack(2)
+	deque.PushFront(1)
+	deque.PushBack(3)
+	deque.PushFront(0)
+
+	if v, err := deque.PeekFront(); err != nil || v != 0 {
+		t.Fatal("PeekFront error:", v, err)
+	}
+	if v, err := deque.PeekBack(); err != nil || v != 3 {
+		t.Fatal("PeekBack error:", v, err)
+	}
+	if deque.Len() != 4 {
+		t.Fatal("Wrong length:", deque.Len())
+	}
+
+	for _, pop := range []struct {
+		pop  func() (interface{}, error)
+		want int
+	}{{deque.PopBack, 3}, {deque.PopFront, 0}, {deque.PopFront, 1}, {deque.PopBack, 2}} {
+		if v, err := pop.pop(); err != nil || v != pop.want {
+			t.Fatal("Wrong value:", v, err, "expected:", pop.want)
+		}
+	}
+
+	if deque.Len() != 0 {
+		t.Fatal("Wrong length:", deque.Len())
+	}
+}
+
+func TestDequeWait(t *testing.T) {
+	deque := NewDeque()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		deque.PushFront(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	v, err := deque.PopBackWait(ctx)
+	if err != nil || v != 1 {
+		t.Fatal("PopBackWait error:", v, err)
+	}
+}
+
+func TestDequeRecovery(t *testing.T) {
+	for name, opts := range map[string][]func(*Deque){
+		"File":    nil,
+		"Segment": {SetDequeSegmentSize(64)},
+		"WAL":     {SetDequeWAL(SyncAlways)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			remove := func() {
+				NewSegmentStorage("./deque_recovery", 64).Remove()
+				os.Remove("./deque_recovery.wal")
+			}
+			remove()
+			defer remove()
+
+			deque := NewDeque(append([]func(*Deque){SetDequeFile("./deque_recovery")}, opts...)...)
+			defer deque.Close(context.Background())
+			check := func(want ...interface{}) {
+				if name != "WAL" {
+					before, _ := os.Stat("./deque_recovery")
+					if err := deque.Persistent(); err != nil {
+						t.Fatal(err)
+					}
+					after, _ := os.Stat("./deque_recovery")
+					if name == "File" && before != nil && !os.SameFile(before, after) {
+						t.Fatal("The values added at front should be persisted without rewriting the file")
+					}
+				}
+
+				recovered := newDeque()
+				for _, opt := range append([]func(*Deque){
+					SetDequeFile("./deque_recovery"),
+					SetDequeRecoveryControl(true),
+					SetDequeDecoder(func(decode func(interface{}) error) (interface{}, error) {
+						var value int
+						err := decode(&value)
+						return value, err
+					}),
+				}, opts...) {
+					opt(recovered)
+				}
+				if err := recovered.Recovery(); err != nil {
+					t.Fatal(err)
+				}
+				if v := linkValues(&recovered.Buffer); !reflect.DeepEqual(v, want) || recovered.Len() != int64(len(want)) {
+					t.Fatal("Wrong values:", v, recovered.Len(), "expected:", want)
+				}
+			}
+
+			deque.PushBack(2)
+			deque.PushBack(3)
+			check(2, 3)
+
+			// 1 and 0 are added before the persisted datas
+			deque.PushFront(1)
+			deque.PushBack(4)
+			deque.PushFront(0)
+			check(0, 1, 2, 3, 4)
+
+			deque.PopBack()
+			deque.PushBack(5)
+			check(0, 1, 2, 3, 5)
+
+			deque.PushFront(-1)
+			deque.PopFront()
+			deque.PopFront()
+			deque.PushFront(-2)
+			check(-2, 1, 2, 3, 5)
+		})
+	}
+}
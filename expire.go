@@ -0,0 +1,157 @@
+package mtque
+
+import (
+	"time"
+)
+
+// expired returns whether the node is expired at the time.
+func (d *DataNode) expired(now time.Time) bool {
+	return !d.ExpireAt.IsZero() && !now.Before(d.ExpireAt)
+}
+
+// newNode creates a node for the value which expires after the ttl,
+// or after the default TTL of buffer if ttl is 0. It also schedules
+// the reaper to evict the node after it expires.
+// The Mutex should be held by the caller.
+func (b *Buffer) newNode(value interface{}, ttl time.Duration) *DataNode {
+	node := NewDataNode(value)
+
+	if ttl == 0 {
+		ttl = b.TTL
+	}
+	if ttl > 0 {
+		node.ExpireAt = time.Now().Add(ttl)
+		b.scheduleReap(node.ExpireAt)
+	}
+
+	return node
+}
+
+// expireAtHead removes the expired nodes at the head of datas,
+// and returns their values.
+// The Mutex should be held by the caller.
+func (b *Buffer) expireAtHead() []interface{} {
+	var values []interface{}
+
+	now := time.Now()
+	for node := b.Datas.Head; node != nil && node.expired(now); node = b.Datas.Head {
+		b.deleteNode(node)
+		b.Length--
+		values = append(values, node.Value)
+	}
+
+	if values != nil {
+		b.broadcast()
+	}
+
+	return values
+}
+
+// expireAtTail removes the expired nodes at the tail of datas,
+// and returns their values.
+// The Mutex should be held by the caller.
+func (b *Buffer) expireAtTail() []interface{} {
+	var values []interface{}
+
+	now := time.Now()
+	for node := b.Datas.Tail; node != nil && node.expired(now); node = b.Datas.Tail {
+		b.deleteNode(node)
+		b.Length--
+		values = append(values, node.Value)
+	}
+
+	if values != nil {
+		b.broadcast()
+	}
+
+	return values
+}
+
+// expireAll removes all the expired nodes in the datas,
+// and returns their values.
+// The Mutex should be held by the caller.
+func (b *Buffer) expireAll() []interface{} {
+	var values []interface{}
+
+	now := time.Now()
+	for node := b.Datas.Head; node != nil; {
+		next := node.Next
+		if node.expired(now) {
+			b.deleteNode(node)
+			b.Length--
+			values = append(values, node.Value)
+		}
+		node = next
+	}
+
+	if values != nil {
+		b.broadcast()
+	}
+
+	return values
+}
+
+// nextExpiry returns the earliest expire time of the datas,
+// it is zero if there is no node will expire.
+// The Mutex should be held by the caller.
+func (b *Buffer) nextExpiry() time.Time {
+	var next time.Time
+	for node := b.Datas.Head; node != nil; node = node.Next {
+		if !node.ExpireAt.IsZero() && (next.IsZero() || node.ExpireAt.Before(next)) {
+			next = node.ExpireAt
+		}
+	}
+
+	return next
+}
+
+// routeExpired passes the expired values to the ExpiredHandler.
+// It should be called without holding the Mutex.
+func (b *Buffer) routeExpired(values []interface{}) {
+	if b.ExpiredHandler == nil {
+		return
+	}
+
+	for _, value := range values {
+		b.ExpiredHandler(value)
+	}
+}
+
+// scheduleReap makes the reaper run at the time, if it is
+// not scheduled to run before that.
+// The Mutex should be held by the caller.
+func (b *Buffer) scheduleReap(at time.Time) {
+	if at.IsZero() {
+		return
+	}
+	if b.reaper != nil && !at.Before(b.reapAt) {
+		return
+	}
+
+	if b.reaper != nil {
+		b.reaper.Stop()
+	}
+	b.reapAt = at
+	b.reaper = time.AfterFunc(time.Until(at), b.reap)
+}
+
+// reap evicts all the expired datas, and persistents the buffer so
+// that the evicted datas will not come back at recovering.
+func (b *Buffer) reap() {
+	b.Mutex.Lock()
+	if b.closed {
+		b.Mutex.Unlock()
+		return
+	}
+	values := b.expireAll()
+	b.reaper = nil
+	b.scheduleReap(b.nextExpiry())
+	persist := values != nil && b.PersistenceControl && b.File != ""
+	b.Mutex.Unlock()
+
+	if persist {
+		b.Persistent()
+	}
+
+	b.routeExpired(values)
+}
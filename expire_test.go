@@ -0,0 +1,116 @@
+package mtque
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueTTL(t *testing.T) {
+	expired := NewQueue()
+	queue := NewQueue(
+		SetQueueTTL(time.Hour),
+		SetQueueExpiredQueue(expired),
+	)
+
+	queue.EnQueueWithTTL(1, 10*time.Millisecond)
+	queue.EnQueue(2)
+	queue.EnQueueWithTTL(3, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	if v, err := queue.GetHead(); err != nil || v != 2 {
+		t.Fatal("GetHead should skip the expired value:", v, err)
+	}
+	if v, err := queue.DeQueue(); err != nil || v != 2 {
+		t.Fatal("DeQueue should skip the expired value:", v, err)
+	}
+	if v, err := queue.DeQueue(); err == nil {
+		t.Fatal("DeQueue an expired value:", v)
+	}
+
+	if expired.Len() != 2 {
+		t.Fatal("The expired values should be routed to the expired queue:", expired.Len())
+	}
+}
+
+func TestStackTTL(t *testing.T) {
+	var mutex sync.Mutex
+	var expired []interface{}
+	stack := NewStack(
+		SetStackExpiredHandler(func(value interface{}) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			expired = append(expired, value)
+		}),
+	)
+
+	stack.Push(1)
+	stack.PushWithTTL(2, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	if v, err := stack.GetTail(); err != nil || v != 1 {
+		t.Fatal("GetTail should skip the expired value:", v, err)
+	}
+	if v, err := stack.Pop(); err != nil || v != 1 {
+		t.Fatal("Pop should skip the expired value:", v, err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(expired) != 1 || expired[0] != 2 {
+		t.Fatal("The expired value should be passed to the handler:", expired)
+	}
+}
+
+func TestExpiredReaper(t *testing.T) {
+	os.Remove("./queue_reaper")
+
+	expired := make(chan interface{}, 3)
+	queue := NewQueue(
+		SetQueueFile("./queue_reaper"),
+		SetQueuePersistenceControl(true),
+		SetQueueExpiredHandler(func(value interface{}) {
+			expired <- value
+		}),
+	)
+	defer DestroyQueue("./queue_reaper")
+
+	queue.EnQueueWithTTL(1, 20*time.Millisecond)
+	queue.EnQueue(2)
+	queue.EnQueueWithTTL(3, 20*time.Millisecond)
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-expired:
+		case <-time.After(time.Second):
+			t.Fatal("The expired values are not evicted by the reaper")
+		}
+	}
+
+	if queue.Len() != 1 {
+		t.Fatal("Wrong length after reaping:", queue.Len())
+	}
+
+	buf := NewBuffer(
+		SetBufferFile("./queue_reaper"),
+		SetBufferRecoveryControl(true),
+		SetBufferDecoder(func(decode func(interface{}) error) (interface{}, error) {
+			var value int
+			err := decode(&value)
+			return value, err
+		}),
+	)
+	if err := buf.Recovery(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 1 {
+		t.Fatal("The evicted values come back at recovering:", buf.Len())
+	}
+	if v, _ := buf.GetHeadValue(); v != 2 {
+		t.Fatal("Wrong value:", v)
+	}
+}
@@ -0,0 +1,171 @@
+package mtque
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The buffer info is encoded at the beginning of file as the header
+// |magic|version|id|length|flags|period|start|end|segment|lsn|codec|,
+// padded with zero to BUFFER_INFO_SIZE-CHECKSUM_SIZE bytes and followed
+// by the CRC32 of them. The integers are big endian, and the strings are
+// prefixed with their uint16 length. The files without the magic are in
+// the legacy format, which encodes the buffer info with gob.
+//
+// The legacy header is not upgraded in place, the records after it have
+// no crc and no meta, so a new header in front of them would describe a
+// file which does not exist. The legacy file is read as it is,
+// and upgraded by rewriting all of it into a new file which replaces it:
+// lazily by the buffer at the next persistence after recovering, see
+// recoveryDataLink, and at once by SharedQueue.upgrade.
+const (
+	HEADER_MAGIC   = "MTQF"
+	HEADER_VERSION = 1
+)
+
+// The flags of the bool fields of BufferInfo in the header.
+const (
+	headerRecoveryControl = 1 << iota
+	headerPersistenceControl
+	headerChecksum
+	headerDeltas
+)
+
+// Bytes encodes the buffer info into the header of BUFFER_INFO_SIZE bytes
+// reserved at the beginning of file.
+func (b *BufferInfo) Bytes() ([]byte, error) {
+	var flags uint8
+	if b.RecoveryControl {
+		flags |= headerRecoveryControl
+	}
+	if b.PersistenceControl {
+		flags |= headerPersistenceControl
+	}
+	if b.Checksum {
+		flags |= headerChecksum
+	}
+	if b.Deltas {
+		flags |= headerDeltas
+	}
+
+	header := make([]byte, 0, BUFFER_INFO_SIZE)
+	header = append(header, HEADER_MAGIC...)
+	header = binary.BigEndian.AppendUint16(header, HEADER_VERSION)
+	header = appendString(header, b.Id)
+	header = binary.BigEndian.AppendUint64(header, uint64(b.Length))
+	header = append(header, flags)
+	for _, v := range []int64{int64(b.PersistencePeriod), b.FileStartSeek, b.FileEndSeek, b.SegmentSize, b.CheckpointLSN} {
+		header = binary.BigEndian.AppendUint64(header, uint64(v))
+	}
+	header = appendString(header, b.CodecName)
+
+	if len(header) > BUFFER_INFO_SIZE-CHECKSUM_SIZE {
+		return []byte{}, fmt.Errorf("buffer info size %d exceeds the reserved %d bytes", len(header), BUFFER_INFO_SIZE-CHECKSUM_SIZE)
+	}
+	header = header[:BUFFER_INFO_SIZE-CHECKSUM_SIZE]
+
+	return appendChecksum(header, header), nil
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...)
+}
+
+// headerReader reads the fields of header in order, and keeps the first
+// error of them.
+type headerReader struct {
+	data []byte
+	err  error
+}
+
+func (r *headerReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("header is truncated")
+		return make([]byte, n)
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *headerReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *headerReader) int64() int64 {
+	return int64(binary.BigEndian.Uint64(r.next(8)))
+}
+
+func (r *headerReader) string() string {
+	return string(r.next(int(r.uint16())))
+}
+
+// readBufferInfo reads and decodes the buffer info from the header
+// in the storage, see decodeBufferInfo.
+func readBufferInfo(store Storage) (BufferInfo, bool, error) {
+	data := make([]byte, BUFFER_INFO_SIZE)
+	n, err := store.ReadHeader(data)
+	if err != nil && err != io.EOF {
+		return BufferInfo{}, false, err
+	}
+
+	info, legacy, err := decodeBufferInfo(data[:n])
+	if err != nil {
+		return info, legacy, fmt.Errorf("buffer info is corrupt: %v", err)
+	}
+
+	return info, legacy, nil
+}
+
+// decodeBufferInfo decodes the buffer info from the header, or from the
+// gob encoding of the legacy format, which is reported by legacy.
+func decodeBufferInfo(data []byte) (info BufferInfo, legacy bool, err error) {
+	if !bytes.HasPrefix(data, []byte(HEADER_MAGIC)) {
+		return decodeLegacyBufferInfo(data)
+	}
+
+	if _, err := verifyChecksum(data); err != nil {
+		return info, false, err
+	}
+
+	r := &headerReader{data: data[len(HEADER_MAGIC):]}
+	if version := r.uint16(); version > HEADER_VERSION {
+		return info, false, fmt.Errorf("unsupported format version %d", version)
+	}
+
+	info.Id = r.string()
+	info.Length = r.int64()
+	flags := r.next(1)[0]
+	info.RecoveryControl = flags&headerRecoveryControl != 0
+	info.PersistenceControl = flags&headerPersistenceControl != 0
+	info.Checksum = flags&headerChecksum != 0
+	info.Deltas = flags&headerDeltas != 0
+	info.PersistencePeriod = time.Duration(r.int64())
+	info.FileStartSeek = r.int64()
+	info.FileEndSeek = r.int64()
+	info.SegmentSize = r.int64()
+	info.CheckpointLSN = r.int64()
+	info.CodecName = r.string()
+
+	return info, false, r.err
+}
+
+// decodeLegacyBufferInfo decodes the buffer info encoded with gob.
+func decodeLegacyBufferInfo(data []byte) (info BufferInfo, legacy bool, err error) {
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&info)
+	if err != nil {
+		return info, true, err
+	}
+	info.Checksum = false
+
+	return info, true, nil
+}
@@ -0,0 +1,137 @@
+package mtque
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHeader(t *testing.T) {
+	info := BufferInfo{
+		Id:                 "header",
+		Length:             3,
+		RecoveryControl:    true,
+		PersistenceControl: true,
+		PersistencePeriod:  time.Minute,
+		FileStartSeek:      BUFFER_INFO_SIZE + 10,
+		FileEndSeek:        BUFFER_INFO_SIZE + 100,
+		SegmentSize:        1024,
+		CheckpointLSN:      42,
+		CodecName:          "json",
+		Checksum:           true,
+	}
+
+	header, err := info.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) != BUFFER_INFO_SIZE || !bytes.HasPrefix(header, []byte(HEADER_MAGIC)) {
+		t.Fatal("Wrong header:", header[:8])
+	}
+
+	decoded, legacy, err := decodeBufferInfo(header)
+	if err != nil || legacy {
+		t.Fatal("Failed to decode the header:", err, legacy)
+	}
+	if decoded != info {
+		t.Fatal("Wrong buffer info:", decoded)
+	}
+
+	t.Run("Version", func(t *testing.T) {
+		future := append([]byte{}, header[:BUFFER_INFO_SIZE-CHECKSUM_SIZE]...)
+		binary.BigEndian.PutUint16(future[len(HEADER_MAGIC):], HEADER_VERSION+1)
+		if _, _, err := decodeBufferInfo(appendChecksum(future, future)); err == nil {
+			t.Fatal("The header of unsupported version should fail the decoding")
+		}
+	})
+}
+
+// legacyInfoSize is the space reserved for the buffer info at the
+// beginning of the file in the legacy format.
+const legacyInfoSize = 202
+
+// writeLegacyFile writes the values into the file in the legacy format,
+// the gob encoding of buffer info followed by the records from start,
+// every record is the gob encoding of value after its length.
+func writeLegacyFile(t *testing.T, name string, start int64, values ...interface{}) {
+	file := make([]byte, start)
+	for _, value := range values {
+		data := new(bytes.Buffer)
+		if err := gob.NewEncoder(data).Encode(value); err != nil {
+			t.Fatal(err)
+		}
+		head := new(bytes.Buffer)
+		gob.NewEncoder(head).Encode(int64(data.Len()))
+
+		record := make([]byte, DATA_HEAD_SIZE)
+		copy(record, head.Bytes())
+		file = append(file, append(record, data.Bytes()...)...)
+	}
+
+	info := new(bytes.Buffer)
+	gob.NewEncoder(info).Encode(struct {
+		Id                 string
+		Length             int64
+		RecoveryControl    bool
+		PersistenceControl bool
+		PersistencePeriod  time.Duration
+		FileStartSeek      int64
+		FileEndSeek        int64
+	}{
+		Id:                 "legacy",
+		Length:             int64(len(values)),
+		PersistenceControl: true,
+		PersistencePeriod:  time.Minute,
+		FileStartSeek:      start,
+		FileEndSeek:        int64(len(file)),
+	})
+	if int64(info.Len()) > start {
+		t.Fatal("The legacy buffer info exceeds the start of records")
+	}
+	copy(file, info.Bytes())
+
+	if err := os.WriteFile(name, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeLegacyHeader(t *testing.T) {
+	os.Remove("./buffer_legacy_header")
+	defer os.Remove("./buffer_legacy_header")
+
+	writeLegacyFile(t, "./buffer_legacy_header", legacyInfoSize, 1, 2)
+	legacy, _ := os.ReadFile("./buffer_legacy_header")
+
+	recovered, err := recoverFile("./buffer_legacy_header", CorruptionStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := linkValues(recovered); len(v) != 2 || v[0] != 1 || v[1] != 2 {
+		t.Fatal("Wrong values:", v)
+	}
+	if data, _ := os.ReadFile("./buffer_legacy_header"); !bytes.Equal(data, legacy) {
+		t.Fatal("The legacy file should not be written at recovering")
+	}
+
+	recovered.PersistenceControl = true
+	if err := recovered.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile("./buffer_legacy_header"); !bytes.HasPrefix(data, []byte(HEADER_MAGIC)) {
+		t.Fatal("The legacy file should be upgraded at persisting")
+	}
+
+	recovered, err = recoverFile("./buffer_legacy_header", CorruptionStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := linkValues(recovered); len(v) != 2 || v[0] != 1 || v[1] != 2 {
+		t.Fatal("Wrong values:", v)
+	}
+	if recovered.Id != "legacy" {
+		t.Fatal("Wrong id:", recovered.Id)
+	}
+}
@@ -0,0 +1,141 @@
+package mtque
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrLocked is returned when binding a buffer to a file which is locked
+// by another process, the returned errors wrap it with the file.
+var ErrLocked = errors.New("file is locked by another process")
+
+// ErrLockUnsupported is returned when binding a buffer to a file on the
+// platforms where the files can not be locked, because the file could be
+// bound by several processes at once there.
+var ErrLockUnsupported = errors.New("file locking is not supported")
+
+// LOCK_RETRY_INTERVAL is the interval to retry taking the lock of file
+// when waiting for it.
+const LOCK_RETRY_INTERVAL = 10 * time.Millisecond
+
+// lockFile takes the advisory lock of the file, which is held on the
+// sidecar file+".lock", because the file itself is replaced by renaming
+// at rewriting. It waits at most timeout if the lock is held by others.
+// The lock file is never removed, or the processes waiting on it could
+// end up holding the locks of different files.
+func lockFile(file string, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(file+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if locked {
+			return f, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%w: %s", ErrLocked, file)
+		}
+		time.Sleep(min(LOCK_RETRY_INTERVAL, time.Until(deadline)))
+	}
+}
+
+// unlockFile releases the lock taken by lockFile.
+func unlockFile(f *os.File) error {
+	if f == nil {
+		return nil
+	}
+
+	err := unlock(f)
+	if e := f.Close(); e != nil && err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// acquireLock takes the lock of file for the buffer. The file is not
+// locked if the buffer is persisted into its own Storage, where the file
+// is only a name, and the lock returned is nil. If the file is bound to a
+// buffer closing in the Manager, it waits for the buffer to release it.
+// The Mutex should not be held by the caller, and neither should the
+// mutexes of Manager, so nothing is blocked while waiting for the lock.
+func (b *Buffer) acquireLock(file string) (*os.File, error) {
+	b.Mutex.RLock()
+	own, timeout := b.Storage != nil, b.LockTimeout
+	b.Mutex.RUnlock()
+
+	if own {
+		return nil, nil
+	}
+	b.manager().waitClosing(file)
+
+	return lockFile(file, timeout)
+}
+
+// setLock replaces the lock held by buffer with the lock.
+// The Mutex should be held by the caller.
+func (b *Buffer) setLock(lock *os.File) {
+	unlockFile(b.lock)
+	b.lock = lock
+}
+
+// releaseLock releases the lock of file held by buffer.
+// The Mutex should be held by the caller.
+func (b *Buffer) releaseLock() error {
+	err := unlockFile(b.lock)
+	b.lock = nil
+
+	return err
+}
+
+// SetQueueLockTimeout set how long to wait for the lock of file held by
+// another process when binding the queue to it, 0 means failing with
+// ErrLocked at once, which is the default.
+func SetQueueLockTimeout(timeout time.Duration) func(*Queue) {
+	return func(queue *Queue) {
+		queue.LockTimeout = timeout
+	}
+}
+
+// SetStackLockTimeout set how long to wait for the lock of file when
+// binding the stack to it, see SetQueueLockTimeout.
+func SetStackLockTimeout(timeout time.Duration) func(*Stack) {
+	return func(stack *Stack) {
+		stack.LockTimeout = timeout
+	}
+}
+
+// SetPriorityQueueLockTimeout set how long to wait for the lock of file
+// when binding the priority queue to it, see SetQueueLockTimeout.
+func SetPriorityQueueLockTimeout(timeout time.Duration) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.LockTimeout = timeout
+	}
+}
+
+// SetDelayQueueLockTimeout set how long to wait for the lock of file
+// when binding the delay queue to it, see SetQueueLockTimeout.
+func SetDelayQueueLockTimeout(timeout time.Duration) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.LockTimeout = timeout
+	}
+}
+
+// SetDequeLockTimeout set how long to wait for the lock of file
+// when binding the deque to it, see SetQueueLockTimeout.
+func SetDequeLockTimeout(timeout time.Duration) func(*Deque) {
+	return func(deque *Deque) {
+		deque.LockTimeout = timeout
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd || windows)
+
+package mtque
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// tryLock fails with ErrLockUnsupported on the platforms without flock
+// or LockFileEx, where the files can not be bound safely.
+func tryLock(f *os.File) (bool, error) {
+	return false, fmt.Errorf("%w on %s", ErrLockUnsupported, runtime.GOOS)
+}
+
+func unlock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,109 @@
+package mtque
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	os.Remove("./queue_lock")
+	defer os.Remove("./queue_lock.lock")
+
+	// the flock conflicts between the open files even in one process,
+	// so the lock taken here acts as another process.
+	other, err := lockFile("./queue_lock", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Locked", func(t *testing.T) {
+		_, err := OpenQueue(SetQueueFile("./queue_lock"))
+		if !errors.Is(err, ErrLocked) {
+			t.Fatal("Binding the locked file should fail with ErrLocked:", err)
+		}
+
+		queue := NewQueue(SetQueueFile("./queue_lock"))
+		if queue.GetFile() != "" {
+			t.Fatal("The queue should not be bound to the locked file")
+		}
+		if err := queue.SetFile("./queue_lock"); !errors.Is(err, ErrLocked) {
+			t.Fatal("Setting the locked file should fail with ErrLocked:", err)
+		}
+		if _, err := OpenStack(SetStackFile("./queue_lock")); !errors.Is(err, ErrLocked) {
+			t.Fatal("Binding the locked file should fail with ErrLocked:", err)
+		}
+		if _, err := OpenPriorityQueue(SetPriorityQueueFile("./queue_lock")); !errors.Is(err, ErrLocked) {
+			t.Fatal("Binding the locked file should fail with ErrLocked:", err)
+		}
+		if _, err := OpenDelayQueue(SetDelayQueueFile("./queue_lock")); !errors.Is(err, ErrLocked) {
+			t.Fatal("Binding the locked file should fail with ErrLocked:", err)
+		}
+		if deque := NewDeque(SetDequeFile("./queue_lock")); deque.GetFile() != "" {
+			t.Fatal("The deque should not be bound to the locked file")
+		}
+	})
+
+	t.Run("Unblocked", func(t *testing.T) {
+		defer os.Remove("./queue_unlocked.lock")
+		defer os.Remove("./queue_unlocked")
+		m := NewManager()
+		defer m.Shutdown(context.Background())
+
+		waiting := make(chan struct{})
+		go func() {
+			defer close(waiting)
+			m.OpenQueue(SetQueueFile("./queue_lock"), SetQueueLockTimeout(200*time.Millisecond))
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		start := time.Now()
+		m.GetQueue("./queue_unlocked")
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Fatal("Waiting for a lock should not block the manager:", elapsed)
+		}
+		<-waiting
+	})
+
+	t.Run("Wait", func(t *testing.T) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			unlockFile(other)
+		}()
+
+		queue, err := OpenQueue(
+			SetQueueFile("./queue_lock"),
+			SetQueueLockTimeout(time.Second),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := lockFile("./queue_lock", 0); !errors.Is(err, ErrLocked) {
+			t.Fatal("The queue should hold the lock:", err)
+		}
+
+		queue.Close(context.Background())
+		lock, err := lockFile("./queue_lock", 0)
+		if err != nil {
+			t.Fatal("The lock should be released on close:", err)
+		}
+		unlockFile(lock)
+	})
+
+	t.Run("Destroy", func(t *testing.T) {
+		stack := NewStack(SetStackFile("./queue_lock"))
+		if stack.GetFile() != "./queue_lock" {
+			t.Fatal("The stack should be bound to the file")
+		}
+
+		DestroyStack("./queue_lock")
+		lock, err := lockFile("./queue_lock", 0)
+		if err != nil {
+			t.Fatal("The lock should be released on destroying:", err)
+		}
+		unlockFile(lock)
+	})
+}
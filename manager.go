@@ -0,0 +1,500 @@
+package mtque
+
+import (
+	"context"
+	"sync"
+)
+
+// Manager owns the queues and stacks bound to files, and the scheduler
+// persisting them periodically. The Managers are independent of each
+// other, so the same file name can be bound in several of them, as long as
+// the queues or stacks are persisted into their own Storage. The file on
+// disk is locked by the one bound to it until it is closed. The package
+// functions, e.g. NewQueue and GetQueue, work with the default Manager.
+type Manager struct {
+	queues     map[string]*Queue
+	queueMutex sync.RWMutex
+
+	stacks     map[string]*Stack
+	stackMutex sync.RWMutex
+
+	// persisters are the priority queues, delay queues and deques
+	// bound to files, which are not indexed by their files.
+	persisters     map[persister]struct{}
+	persisterMutex sync.Mutex
+
+	// closing are the buffers closed but still holding the locks of
+	// their files until flushed, indexed by the files.
+	closing      map[string]*Buffer
+	closingMutex sync.Mutex
+
+	scheduler *scheduler
+}
+
+// persister is a buffer persisted by the Manager, it is closed and
+// flushed at shutting down the Manager.
+type persister interface {
+	Close(ctx context.Context) error
+	waitFlush()
+}
+
+// NewManager is the constructor of Manager.
+func NewManager() *Manager {
+	return &Manager{
+		queues:     make(map[string]*Queue),
+		stacks:     make(map[string]*Stack),
+		persisters: make(map[persister]struct{}),
+		closing:    make(map[string]*Buffer),
+		scheduler:  newScheduler(),
+	}
+}
+
+var defaultManager = NewManager()
+
+// DefaultManager returns the Manager used by the package functions.
+func DefaultManager() *Manager {
+	return defaultManager
+}
+
+// manager returns the Manager owning the buffer, it is the default
+// Manager if the buffer is not constructed by a Manager.
+func (b *Buffer) manager() *Manager {
+	if b.owner == nil {
+		return defaultManager
+	}
+
+	return b.owner
+}
+
+// NewQueue constructs a queue owned by the Manager, see NewQueue.
+func (m *Manager) NewQueue(opts ...func(*Queue)) *Queue {
+	queue, _ := m.openQueue(opts...)
+	return queue
+}
+
+// OpenQueue constructs a queue owned by the Manager, see OpenQueue.
+func (m *Manager) OpenQueue(opts ...func(*Queue)) (*Queue, error) {
+	queue, err := m.openQueue(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+// openQueue constructs the queue, the queue is returned with the error
+// of locking or recovering the file, which is not bound to the file.
+func (m *Manager) openQueue(opts ...func(*Queue)) (*Queue, error) {
+	queue := newQueue()
+	queue.owner = m
+	for _, opt := range opts {
+		opt(queue)
+	}
+
+	if queue.File != "" {
+		if q, ok := m.lookupQueue(queue.File); ok {
+			return q, nil
+		}
+
+		// the lock is waited without holding the mutex, so the
+		// registry is checked again after it.
+		lock, err := queue.acquireLock(queue.File)
+
+		m.queueMutex.Lock()
+		defer m.queueMutex.Unlock()
+
+		if q, ok := m.queues[queue.File]; ok {
+			unlockFile(lock)
+			return q, nil
+		}
+		if err != nil {
+			queue.File = ""
+			return queue, err
+		}
+
+		queue.Mutex.Lock()
+		err = queue.bindFile(queue.File, lock)
+		queue.recheckDead()
+		queue.Mutex.Unlock()
+		if err != nil {
+			return queue, err
+		}
+		m.queues[queue.File] = queue
+		m.scheduler.schedule(queue)
+	}
+
+	return queue, nil
+}
+
+// lookupQueue returns the queue bound to the file in the Manager.
+func (m *Manager) lookupQueue(file string) (*Queue, bool) {
+	m.queueMutex.RLock()
+	defer m.queueMutex.RUnlock()
+
+	queue, ok := m.queues[file]
+	return queue, ok
+}
+
+// GetQueue returns the queue bound to the file in the Manager, see GetQueue.
+func (m *Manager) GetQueue(file string) *Queue {
+	if queue, ok := m.lookupQueue(file); ok {
+		return queue
+	}
+
+	// openQueue returns the one bound by others after the lookup
+	return m.NewQueue(
+		SetQueueFile(file),
+		SetQueuePersistenceControl(true),
+		SetQueueRecoveryControl(true),
+	)
+}
+
+// DestroyQueue removes the queue bound to the file from the Manager,
+// see DestroyQueue.
+func (m *Manager) DestroyQueue(file string) {
+	m.queueMutex.Lock()
+	defer m.queueMutex.Unlock()
+
+	if queue, ok := m.queues[file]; ok {
+		delete(m.queues, file)
+		m.scheduler.unschedule(queue)
+
+		queue.Mutex.Lock()
+		queue.releaseLock()
+		queue.Mutex.Unlock()
+	}
+}
+
+// NewStack constructs a stack owned by the Manager, see NewStack.
+func (m *Manager) NewStack(opts ...func(*Stack)) *Stack {
+	stack, _ := m.openStack(opts...)
+	return stack
+}
+
+// OpenStack constructs a stack owned by the Manager, see OpenStack.
+func (m *Manager) OpenStack(opts ...func(*Stack)) (*Stack, error) {
+	stack, err := m.openStack(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return stack, nil
+}
+
+// openStack constructs the stack, the stack is returned with the error
+// of locking or recovering the file, which is not bound to the file.
+func (m *Manager) openStack(opts ...func(*Stack)) (*Stack, error) {
+	stack := newStack()
+	stack.owner = m
+	for _, opt := range opts {
+		opt(stack)
+	}
+
+	if stack.File != "" {
+		if stk, ok := m.lookupStack(stack.File); ok {
+			return stk, nil
+		}
+
+		// the lock is waited without holding the mutex, so the
+		// registry is checked again after it.
+		lock, err := stack.acquireLock(stack.File)
+
+		m.stackMutex.Lock()
+		defer m.stackMutex.Unlock()
+
+		if stk, ok := m.stacks[stack.File]; ok {
+			unlockFile(lock)
+			return stk, nil
+		}
+		if err != nil {
+			stack.File = ""
+			return stack, err
+		}
+
+		stack.Mutex.Lock()
+		err = stack.bindFile(stack.File, lock)
+		stack.Mutex.Unlock()
+		if err != nil {
+			return stack, err
+		}
+		m.stacks[stack.File] = stack
+		m.scheduler.schedule(stack)
+	}
+
+	return stack, nil
+}
+
+// lookupStack returns the stack bound to the file in the Manager.
+func (m *Manager) lookupStack(file string) (*Stack, bool) {
+	m.stackMutex.RLock()
+	defer m.stackMutex.RUnlock()
+
+	stack, ok := m.stacks[file]
+	return stack, ok
+}
+
+// GetStack returns the stack bound to the file in the Manager, see GetStack.
+func (m *Manager) GetStack(file string) *Stack {
+	if stack, ok := m.lookupStack(file); ok {
+		return stack
+	}
+
+	// openStack returns the one bound by others after the lookup
+	return m.NewStack(
+		SetStackFile(file),
+		SetStackPersistenceControl(true),
+		SetStackRecoveryControl(true),
+	)
+}
+
+// DestroyStack removes the stack bound to the file from the Manager,
+// and deletes the persistence of it, see DestroyStack.
+func (m *Manager) DestroyStack(file string) {
+	m.stackMutex.Lock()
+	defer m.stackMutex.Unlock()
+
+	if stack, ok := m.stacks[file]; ok {
+		delete(m.stacks, file)
+		m.scheduler.unschedule(stack)
+
+		stack.Mutex.Lock()
+		stack.releaseLock()
+		stack.removePersistence()
+		stack.Mutex.Unlock()
+	}
+}
+
+// NewPriorityQueue constructs a priority queue whose periodic persistence
+// is scheduled by the Manager, see NewPriorityQueue.
+func (m *Manager) NewPriorityQueue(opts ...func(*PriorityQueue)) *PriorityQueue {
+	queue, _ := m.openPriorityQueue(opts...)
+	return queue
+}
+
+// OpenPriorityQueue constructs a priority queue whose periodic persistence
+// is scheduled by the Manager, see OpenPriorityQueue.
+func (m *Manager) OpenPriorityQueue(opts ...func(*PriorityQueue)) (*PriorityQueue, error) {
+	queue, err := m.openPriorityQueue(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+// openPriorityQueue constructs the priority queue, it is returned with the error
+// of locking or recovering the file, which is not bound to the file.
+func (m *Manager) openPriorityQueue(opts ...func(*PriorityQueue)) (*PriorityQueue, error) {
+	queue := newPriorityQueue()
+	queue.owner = m
+	for _, opt := range opts {
+		opt(queue)
+	}
+
+	if queue.File != "" {
+		lock, err := queue.acquireLock(queue.File)
+		if err != nil {
+			queue.File = ""
+			return queue, err
+		}
+
+		queue.Mutex.Lock()
+		err = queue.bindFile(queue.File, lock)
+		queue.order.reset(queue.Datas)
+		queue.Mutex.Unlock()
+		if err != nil {
+			return queue, err
+		}
+
+		m.track(queue)
+		m.scheduler.schedule(queue)
+	}
+
+	return queue, nil
+}
+
+// NewDelayQueue constructs a delay queue whose periodic persistence
+// is scheduled by the Manager, see NewDelayQueue.
+func (m *Manager) NewDelayQueue(opts ...func(*DelayQueue)) *DelayQueue {
+	queue, _ := m.openDelayQueue(opts...)
+	return queue
+}
+
+// OpenDelayQueue constructs a delay queue whose periodic persistence
+// is scheduled by the Manager, see OpenDelayQueue.
+func (m *Manager) OpenDelayQueue(opts ...func(*DelayQueue)) (*DelayQueue, error) {
+	queue, err := m.openDelayQueue(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+// openDelayQueue constructs the delay queue, it is returned with the error
+// of locking or recovering the file, which is not bound to the file.
+func (m *Manager) openDelayQueue(opts ...func(*DelayQueue)) (*DelayQueue, error) {
+	queue := newDelayQueue()
+	queue.owner = m
+	for _, opt := range opts {
+		opt(queue)
+	}
+
+	if queue.File != "" {
+		lock, err := queue.acquireLock(queue.File)
+		if err != nil {
+			queue.File = ""
+			return queue, err
+		}
+
+		queue.Mutex.Lock()
+		err = queue.bindFile(queue.File, lock)
+		queue.order.reset(queue.Datas)
+		queue.Mutex.Unlock()
+		if err != nil {
+			return queue, err
+		}
+
+		m.track(queue)
+		m.scheduler.schedule(queue)
+	}
+
+	return queue, nil
+}
+
+// NewDeque constructs a deque whose periodic persistence
+// is scheduled by the Manager, see NewDeque.
+func (m *Manager) NewDeque(opts ...func(*Deque)) *Deque {
+	deque, _ := m.openDeque(opts...)
+	return deque
+}
+
+// OpenDeque constructs a deque whose periodic persistence
+// is scheduled by the Manager, see OpenDeque.
+func (m *Manager) OpenDeque(opts ...func(*Deque)) (*Deque, error) {
+	deque, err := m.openDeque(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return deque, nil
+}
+
+// openDeque constructs the deque, it is returned with the error
+// of locking or recovering the file, which is not bound to the file.
+func (m *Manager) openDeque(opts ...func(*Deque)) (*Deque, error) {
+	deque := newDeque()
+	deque.owner = m
+	for _, opt := range opts {
+		opt(deque)
+	}
+
+	if deque.File != "" {
+		lock, err := deque.acquireLock(deque.File)
+		if err != nil {
+			deque.File = ""
+			return deque, err
+		}
+
+		deque.Mutex.Lock()
+		err = deque.bindFile(deque.File, lock)
+		deque.Mutex.Unlock()
+		if err != nil {
+			return deque, err
+		}
+
+		m.track(deque)
+		m.scheduler.schedule(deque)
+	}
+
+	return deque, nil
+}
+
+// StopScheduler stops the periodic persistence of all the buffers owned
+// by the Manager, see StopScheduler.
+func (m *Manager) StopScheduler() {
+	m.scheduler.stop()
+}
+
+// track adds the persister into the ones closed at shutting down.
+func (m *Manager) track(p persister) {
+	m.persisterMutex.Lock()
+	m.persisters[p] = struct{}{}
+	m.persisterMutex.Unlock()
+}
+
+// untrack removes the persister from the ones closed at shutting down.
+func (m *Manager) untrack(p persister) {
+	m.persisterMutex.Lock()
+	delete(m.persisters, p)
+	m.persisterMutex.Unlock()
+}
+
+// setClosing records the buffer closing with the lock of file.
+func (m *Manager) setClosing(file string, b *Buffer) {
+	m.closingMutex.Lock()
+	m.closing[file] = b
+	m.closingMutex.Unlock()
+}
+
+// unsetClosing removes the buffer after it releases the lock of file.
+func (m *Manager) unsetClosing(file string, b *Buffer) {
+	m.closingMutex.Lock()
+	if m.closing[file] == b {
+		delete(m.closing, file)
+	}
+	m.closingMutex.Unlock()
+}
+
+// waitClosing waits for the buffer closing with the lock of file to
+// release it, so the file can be bound again as soon as it is closed.
+func (m *Manager) waitClosing(file string) {
+	m.closingMutex.Lock()
+	b := m.closing[file]
+	m.closingMutex.Unlock()
+
+	if b != nil {
+		b.waitFlush()
+	}
+}
+
+// Shutdown closes all the queues, stacks, priority queues, delay queues
+// and deques bound to files in the Manager, and stops its scheduler. It
+// returns the first error of closing them. If the ctx is done before the
+// flushes finish, the error of ctx is returned after waiting for them, so
+// that nothing is persisted after Shutdown returns.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	var persisters []persister
+
+	m.queueMutex.RLock()
+	for _, queue := range m.queues {
+		persisters = append(persisters, queue)
+	}
+	m.queueMutex.RUnlock()
+
+	m.stackMutex.RLock()
+	for _, stack := range m.stacks {
+		persisters = append(persisters, stack)
+	}
+	m.stackMutex.RUnlock()
+
+	m.persisterMutex.Lock()
+	for p := range m.persisters {
+		persisters = append(persisters, p)
+	}
+	m.persisterMutex.Unlock()
+
+	var first error
+	for _, p := range persisters {
+		if err := p.Close(ctx); err != nil && err != ErrClosed && first == nil {
+			first = err
+		}
+	}
+	for _, p := range persisters {
+		p.waitFlush()
+	}
+
+	m.scheduler.stop()
+
+	return first
+}
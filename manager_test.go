@@ -0,0 +1,224 @@
+package mtque
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestManager(t *testing.T) {
+	os.Remove("./queue_manager_a")
+	os.Remove("./queue_manager_b")
+	defer os.Remove("./queue_manager_a")
+	defer os.Remove("./queue_manager_b")
+
+	m1 := NewManager()
+	m2 := NewManager()
+
+	q1 := m1.NewQueue(SetQueueFile("./queue_manager_a"))
+	q2 := m2.NewQueue(SetQueueFile("./queue_manager_b"))
+
+	if m1.queues["./queue_manager_a"] != q1 || m2.queues["./queue_manager_b"] != q2 {
+		t.Fatal("The queue should be registered in its manager")
+	}
+	if _, ok := m2.queues["./queue_manager_a"]; ok {
+		t.Fatal("The queue should only be registered in its manager")
+	}
+	if _, ok := defaultManager.queues["./queue_manager_a"]; ok {
+		t.Fatal("The queue should not be registered in the default manager")
+	}
+
+	t.Run("Locked", func(t *testing.T) {
+		if _, err := m2.OpenQueue(SetQueueFile("./queue_manager_a")); !errors.Is(err, ErrLocked) {
+			t.Fatal("The file bound in another manager should be locked:", err)
+		}
+	})
+
+	t.Run("SameName", func(t *testing.T) {
+		s1 := m1.NewStack(SetStackFile("memory_manager"), SetStackStorage(NewMemoryStorage()))
+		s2 := m2.NewStack(SetStackFile("memory_manager"), SetStackStorage(NewMemoryStorage()))
+		if s1 == s2 || m1.stacks["memory_manager"] != s1 || m2.stacks["memory_manager"] != s2 {
+			t.Fatal("The managers should bind the same name to their own stacks")
+		}
+
+		s1.Push(1)
+		if s2.Len() != 0 {
+			t.Fatal("The stacks should be independent")
+		}
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		if err := m1.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if len(m1.queues) != 0 {
+			t.Fatal("The queues should be closed:", m1.queues)
+		}
+
+		if err := q2.EnQueue(1); err != nil {
+			t.Fatal("The queue of another manager should not be closed:", err)
+		}
+
+		queue, err := m2.OpenQueue(SetQueueFile("./queue_manager_a"))
+		if err != nil {
+			t.Fatal("The file should be released by shutting down:", err)
+		}
+		m2.Shutdown(context.Background())
+		if _, err := queue.DeQueue(); err != ErrClosed {
+			t.Fatal("The queue should be closed:", err)
+		}
+	})
+}
+
+func TestManagerShutdown(t *testing.T) {
+	files := []string{"./priority_shutdown", "./delay_shutdown", "./deque_shutdown"}
+	for _, file := range files {
+		os.Remove(file)
+		defer os.Remove(file)
+	}
+
+	m := NewManager()
+	pq := m.NewPriorityQueue(SetPriorityQueueFile(files[0]))
+	dq := m.NewDelayQueue(SetDelayQueueFile(files[1]))
+	deque := m.NewDeque(SetDequeFile(files[2]))
+	pq.EnQueue(1, 0)
+	dq.EnQueue(2)
+	deque.PushBack(3)
+
+	// the flushes go on after the ctx is done, and Shutdown waits for them.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Shutdown(ctx)
+	if len(m.persisters) != 0 {
+		t.Fatal("The persisters should be closed:", m.persisters)
+	}
+
+	for i, file := range files {
+		recovered, err := recoverFile(file, CorruptionStrict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := linkValues(recovered); len(v) != 1 || v[0] != i+1 {
+			t.Fatal("The datas should be flushed at shutting down:", file, v)
+		}
+	}
+	if _, err := pq.DeQueue(); err != ErrClosed {
+		t.Fatal("The priority queue should be closed:", err)
+	}
+}
+
+func TestManagerRecovery(t *testing.T) {
+	os.Remove("./queue_manager_recovery")
+	defer os.Remove("./queue_manager_recovery")
+	defer os.Remove("./queue_manager_recovery.lock")
+
+	m := NewManager()
+	queue := m.NewQueue(SetQueueFile("./queue_manager_recovery"))
+	queue.EnQueue(1)
+	queue.EnQueue(2)
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	m = NewManager()
+	defer m.Shutdown(context.Background())
+	queue, err := m.OpenQueue(
+		SetQueueFile("./queue_manager_recovery"),
+		SetQueueRecoveryControl(true),
+		SetQueueDecoder(intDecoder),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := linkValues(&queue.Buffer); len(v) != 2 || v[0] != 1 || v[1] != 2 || queue.Len() != 2 {
+		t.Fatal("The queue should be recovered in a new manager:", v)
+	}
+}
+
+func TestManagerRace(t *testing.T) {
+	files := []string{"./queue_race_0", "./queue_race_1", "./queue_race_2"}
+	remove := func() {
+		for _, file := range files {
+			for _, name := range []string{file, file + "_stack"} {
+				os.Remove(name)
+				os.Remove(name + ".lock")
+			}
+		}
+	}
+	remove()
+	defer remove()
+
+	m := NewManager()
+	defer m.Shutdown(context.Background())
+
+	t.Run("GetQueue", func(t *testing.T) {
+		queues := make([]*Queue, 16)
+		var wg sync.WaitGroup
+		for i := range queues {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				queues[i] = m.GetQueue(files[0])
+			}(i)
+		}
+		wg.Wait()
+
+		for _, queue := range queues {
+			if queue != queues[0] {
+				t.Fatal("GetQueue should return one queue for the file")
+			}
+		}
+		m.DestroyQueue(files[0])
+	})
+
+	t.Run("Stress", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+
+				for i := 0; i < 50; i++ {
+					file := files[(g+i)%len(files)]
+					switch i % 5 {
+					case 0:
+						m.GetQueue(file).EnQueue(i)
+						m.GetStack(file + "_stack").Push(i)
+					case 1:
+						m.NewQueue().SetFile(file)
+						m.NewStack().SetFile(file + "_stack")
+					case 2:
+						m.NewQueue().ForceSetFile(file, RebindMerge)
+						m.NewStack().ForceSetFile(file+"_stack", RebindReplace)
+					case 3:
+						queue := m.NewQueue()
+						queue.SetFile(file)
+						queue.ForceSetFile(files[(g+i+1)%len(files)], RebindMigrate)
+					case 4:
+						m.DestroyQueue(file)
+						m.DestroyStack(file + "_stack")
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		m.queueMutex.RLock()
+		for file, queue := range m.queues {
+			if queue.GetFile() != file {
+				t.Fatal("The queue is registered with a wrong file:", file, queue.GetFile())
+			}
+		}
+		m.queueMutex.RUnlock()
+
+		m.stackMutex.RLock()
+		for file, stack := range m.stacks {
+			if stack.GetFile() != file {
+				t.Fatal("The stack is registered with a wrong file:", file, stack.GetFile())
+			}
+		}
+		m.stackMutex.RUnlock()
+	})
+}
@@ -0,0 +1,311 @@
+package mtque
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"time"
+)
+
+type heapItem struct {
+	node *DataNode
+	seq  uint64
+}
+
+// nodeHeap orders the nodes of a buffer with the less function, the
+// nodes which are equal in less are ordered by the seq they are pushed.
+// It implements the heap.Interface.
+type nodeHeap struct {
+	items []heapItem
+	less  func(a, b *DataNode) bool
+	seq   uint64
+}
+
+func (h *nodeHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *nodeHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if h.less(a.node, b.node) {
+		return true
+	}
+	if h.less(b.node, a.node) {
+		return false
+	}
+
+	return a.seq < b.seq
+}
+
+func (h *nodeHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *nodeHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(heapItem))
+}
+
+func (h *nodeHeap) Pop() interface{} {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+
+	return item
+}
+
+// add pushes a node into the heap.
+func (h *nodeHeap) add(node *DataNode) {
+	heap.Push(h, heapItem{node: node, seq: h.seq})
+	h.seq++
+}
+
+// top returns the first node in the heap, or nil if heap is empty.
+func (h *nodeHeap) top() *DataNode {
+	if len(h.items) == 0 {
+		return nil
+	}
+
+	return h.items[0].node
+}
+
+// reset rebuilds the heap with the nodes in the link.
+func (h *nodeHeap) reset(link *DataLink) {
+	h.items = nil
+	h.seq = 0
+	for node := link.Head; node != nil; node = node.Next {
+		h.items = append(h.items, heapItem{node: node, seq: h.seq})
+		h.seq++
+	}
+
+	heap.Init(h)
+}
+
+// PriorityQueue is a queue which dequeues the value with greater priority
+// first, and the values with equal priority are dequeued in FIFO order.
+// The values are kept in the buffer in the order they are enqueued,
+// so the priority order is rebuilt from the records at recovering.
+type PriorityQueue struct {
+	Buffer
+
+	order nodeHeap
+}
+
+func newPriorityQueue() *PriorityQueue {
+	queue := new(PriorityQueue)
+	queue.init()
+	queue.order.less = func(a, b *DataNode) bool {
+		return a.Priority > b.Priority
+	}
+
+	return queue
+}
+
+// SetPriorityQueueFile set a file for priority queue persistence
+// This function should be called at constructing
+// the queue if you want to persitent queue at backend
+func SetPriorityQueueFile(file string) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.File = file
+	}
+}
+
+// SetPriorityQueuePersistenceControl set if persistent the priority queue
+func SetPriorityQueuePersistenceControl(ctl bool) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.PersistenceControl = ctl
+	}
+}
+
+// SetPriorityQueuePersistencePeriod set period to persistent priority queue
+func SetPriorityQueuePersistencePeriod(period time.Duration) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.PersistencePeriod = period
+	}
+}
+
+// SetPriorityQueueRecoveryControl set if reocovery the priority queue from file
+// If set to recovery from file, the constructor will
+// try to recovery queue from the file.
+func SetPriorityQueueRecoveryControl(ctl bool) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.RecoveryControl = ctl
+	}
+}
+
+// SetPriorityQueueDecoder set the function to rebuild the values at
+// recovering the priority queue from file.
+func SetPriorityQueueDecoder(decoder DecodeFunc) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.Decoder = decoder
+	}
+}
+
+// NewPriorityQueue is the constructor of PriorityQueue.
+// When use NewPriorityQueue to construct a queue, you can
+// use option functions to set the options of queue.
+// If the file is locked by another process, or failed to recover
+// from it, the queue is not bound to the file, use OpenPriorityQueue to
+// get the error.
+func NewPriorityQueue(opts ...func(*PriorityQueue)) *PriorityQueue {
+	return defaultManager.NewPriorityQueue(opts...)
+}
+
+// OpenPriorityQueue works like NewPriorityQueue, but it returns an error wrapping
+// ErrLocked if the file is locked by another process, or the error
+// of recovering from the file with CorruptionStrict.
+func OpenPriorityQueue(opts ...func(*PriorityQueue)) (*PriorityQueue, error) {
+	return defaultManager.OpenPriorityQueue(opts...)
+}
+
+// SetPersistencePeriod set persistence period for priority queue.
+func (q *PriorityQueue) SetPersistencePeriod(p time.Duration) {
+	q.Mutex.Lock()
+	q.PersistencePeriod = p
+	q.Mutex.Unlock()
+
+	q.manager().scheduler.reschedule(q)
+}
+
+// GetPersistencePeriod returns the persistence period of the priority queue
+func (q *PriorityQueue) GetPersistencePeriod() time.Duration {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	return q.PersistencePeriod
+}
+
+// GetPersistenceControl retruns the Persistence control setting of priority queue
+func (q *PriorityQueue) GetPersistenceControl() bool {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	return q.PersistenceControl
+}
+
+// GetFile returns the presistence file path of priority queue if setting
+func (q *PriorityQueue) GetFile() string {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	return q.File
+}
+
+func (q *PriorityQueue) Clear() {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	q.clear()
+	q.order.reset(q.Datas)
+}
+
+// GetHead returns the value with the greatest priority
+// without removing it from the queue.
+func (q *PriorityQueue) GetHead() (interface{}, error) {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	if q.closed {
+		return nil, ErrClosed
+	}
+
+	node := q.order.top()
+	if node == nil {
+		return nil, fmt.Errorf("queue is empty")
+	}
+
+	return node.Value, nil
+}
+
+// EnQueue adds a value with the priority into the queue.
+func (q *PriorityQueue) EnQueue(value interface{}, priority int64) error {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	node := NewDataNode(value)
+	node.Priority = priority
+	q.addNodeAtTail(node)
+	q.order.add(node)
+
+	q.Length++
+
+	if q.Length == 1 {
+		q.SetRegister(value)
+	}
+
+	q.broadcast()
+
+	return nil
+}
+
+// DeQueue removes the value with the greatest priority from
+// the queue and returns it.
+func (q *PriorityQueue) DeQueue() (interface{}, error) {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	return q.deQueue()
+}
+
+// DeQueueWait works like DeQueue, but it will block the caller when
+// the queue is empty, until a value is enqueued or the ctx is done.
+func (q *PriorityQueue) DeQueueWait(ctx context.Context) (interface{}, error) {
+	for {
+		q.Mutex.Lock()
+		if q.closed || q.Length > 0 {
+			value, err := q.deQueue()
+			q.Mutex.Unlock()
+			return value, err
+		}
+		wait := q.waitChan()
+		q.Mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// deQueue removes the value with the greatest priority and returns it.
+// The Mutex should be held by the caller.
+func (q *PriorityQueue) deQueue() (interface{}, error) {
+	if q.closed {
+		return nil, ErrClosed
+	}
+	if q.order.Len() == 0 {
+		return nil, fmt.Errorf("queue is empty")
+	}
+
+	item := heap.Pop(&q.order).(heapItem)
+	q.deleteNode(item.node)
+	q.Length--
+	q.broadcast()
+
+	return item.node.Value, nil
+}
+
+func (q *PriorityQueue) Persistent() error {
+	return q.Buffer.Persistent()
+}
+
+// Recovery sets up the priority queue from the file, and rebuilds
+// the priority order of the recovered values.
+func (q *PriorityQueue) Recovery() error {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	err := q.recovery()
+	q.order.reset(q.Datas)
+
+	return err
+}
+
+func (q *PriorityQueue) PeriodicallyPersistent() {
+	if q.GetPersistenceControl() {
+		q.Persistent()
+	}
+}
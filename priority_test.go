@@ -0,0 +1,111 @@
+package mtque
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueueOrder(t *testing.T) {
+	queue := NewPriorityQueue()
+
+	queue.EnQueue("low-1", 1)
+	queue.EnQueue("high-1", 5)
+	queue.EnQueue("low-2", 1)
+	queue.EnQueue("high-2", 5)
+	queue.EnQueue("middle", 3)
+
+	head, err := queue.GetHead()
+	if err != nil || head != "high-1" {
+		t.Fatal("GetHead error:", head, err)
+	}
+
+	for _, expected := range []string{"high-1", "high-2", "middle", "low-1", "low-2"} {
+		v, err := queue.DeQueue()
+		if err != nil {
+			t.Fatal("dequeue error:", err)
+		}
+		if v != expected {
+			t.Fatal("Wrong value:", v, "expected:", expected)
+		}
+	}
+
+	if _, err := queue.DeQueue(); err == nil {
+		t.Fatal("dequeue from an empty queue should fail")
+	}
+}
+
+func TestPriorityQueueWait(t *testing.T) {
+	queue := NewPriorityQueue()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		queue.EnQueue(1, 1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	v, err := queue.DeQueueWait(ctx)
+	if err != nil || v != 1 {
+		t.Fatal("DeQueueWait error:", v, err)
+	}
+}
+
+func TestPriorityQueueRecovery(t *testing.T) {
+	os.Remove("./priority_queue")
+
+	queue := NewPriorityQueue(SetPriorityQueueFile("./priority_queue"))
+
+	queue.EnQueue(1, 1)
+	queue.EnQueue(2, 9)
+	queue.EnQueue(3, 5)
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 is in the middle of the persisted datas
+	before, _ := os.Stat("./priority_queue")
+	if v, _ := queue.DeQueue(); v != 2 {
+		t.Fatal("Wrong value:", v)
+	}
+	queue.EnQueue(4, 5)
+	queue.EnQueue(5, 7)
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat("./priority_queue"); !os.SameFile(before, after) {
+		t.Fatal("The deletion should be persisted without rewriting the file")
+	}
+
+	queue.EnQueue(6, 0)
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+	queue.Close(context.Background())
+
+	recovered := NewPriorityQueue(
+		SetPriorityQueueFile("./priority_queue"),
+		SetPriorityQueueRecoveryControl(true),
+		SetPriorityQueueDecoder(func(decode func(interface{}) error) (interface{}, error) {
+			var value int
+			err := decode(&value)
+			return value, err
+		}),
+	)
+
+	if recovered.Len() != 5 {
+		t.Fatal("Recovery error:", recovered.Len())
+	}
+
+	for _, expected := range []int{5, 3, 4, 1, 6} {
+		v, err := recovered.DeQueue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != expected {
+			t.Fatal("Wrong value:", v, "expected:", expected)
+		}
+	}
+}
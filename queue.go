@@ -1,38 +1,32 @@
 package mtque
 
 import (
+	"context"
 	"fmt"
-	"sync"
+	"os"
+	"reflect"
 	"time"
 )
 
-var (
-	queueList  map[string]*Queue
-	queueMutex sync.RWMutex
-)
-
-func init() {
-	queueList = make(map[string]*Queue)
-	queueMutex = sync.RWMutex{}
-
-	go func() {
-		for {
-			for _, queue := range queueList {
-				go queue.PeriodicallyPersistent()
-			}
-		}
-	}()
-}
-
 type Queue struct {
 	Buffer
+
+	//MaxDeliveries is the max times a value can be reserved,
+	//0 means unlimited.
+	MaxDeliveries int64
+	deadLetter    *Queue
+
+	// deadTimer moves the reserved nodes delivered for the max times
+	// into the dead-letter queue after they are timed out at deadAt.
+	deadTimer *time.Timer
+	deadAt    time.Time
 }
 
 func newQueue() *Queue {
-	buffer := NewBuffer()
-	queue := Queue{Buffer: *buffer}
+	queue := new(Queue)
+	queue.init()
 
-	return &queue
+	return queue
 }
 
 // SetQueueFile set a file for queue persistence
@@ -74,64 +68,210 @@ func SetQueueRecoveryControl(ctl bool) func(*Queue) {
 	}
 }
 
-// SetPersistencePeriod set persistence period for queue.
-func (q *Queue) SetPersistencePeriod(p time.Duration) {
+// SetQueueDecoder set the function to rebuild the values at
+// recovering the queue from file. Without a decoder, values
+// are rebuilt as the type of the first value added.
+func SetQueueDecoder(decoder DecodeFunc) func(*Queue) {
+	return func(queue *Queue) {
+		queue.Decoder = decoder
+	}
+}
+
+// SetQueueValueType set the type of the values in queue, the queue
+// bound to the file can only be handed over to by the queues of the
+// same value type, see ForceSetFile.
+func SetQueueValueType(typ reflect.Type) func(*Queue) {
+	return func(queue *Queue) {
+		queue.ValueType = typ
+	}
+}
+
+// SetQueueTTL set the default time to live of the values in queue.
+// The expired values are skipped by the queue and evicted in background.
+// 0 means the values never expire, which is the default.
+func SetQueueTTL(ttl time.Duration) func(*Queue) {
+	return func(queue *Queue) {
+		queue.TTL = ttl
+	}
+}
+
+// SetQueueExpiredHandler set the function which is called with
+// the values evicted from the queue for expiring.
+func SetQueueExpiredHandler(handler func(value interface{})) func(*Queue) {
+	return func(queue *Queue) {
+		queue.ExpiredHandler = handler
+	}
+}
+
+// SetQueueExpiredQueue set a queue to receive the values evicted
+// from the queue for expiring.
+func SetQueueExpiredQueue(target *Queue) func(*Queue) {
+	return SetQueueExpiredHandler(func(value interface{}) {
+		target.TryEnQueue(value)
+	})
+}
+
+// SetQueueCapacity set the max number of values in the queue.
+// 0 means the queue is unlimited, which is the default.
+func SetQueueCapacity(capacity int64) func(*Queue) {
+	return func(queue *Queue) {
+		queue.Capacity = capacity
+	}
+}
+
+// SetQueueOverflowPolicy set the policy applied when adding a value
+// into a full queue. The default policy is OverflowBlock.
+func SetQueueOverflowPolicy(policy OverflowPolicy) func(*Queue) {
+	return func(queue *Queue) {
+		queue.Overflow = policy
+	}
+}
+
+// SetCapacity set the max number of values in the queue.
+func (q *Queue) SetCapacity(capacity int64) {
 	q.Mutex.Lock()
 	defer q.Mutex.Unlock()
 
+	q.Capacity = capacity
+	q.broadcast()
+}
+
+// GetCapacity returns the max number of values in the queue.
+func (q *Queue) GetCapacity() int64 {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	return q.Capacity
+}
+
+// SetPersistencePeriod set persistence period for queue.
+func (q *Queue) SetPersistencePeriod(p time.Duration) {
+	q.Mutex.Lock()
 	q.PersistencePeriod = p
+	q.Mutex.Unlock()
+
+	q.manager().scheduler.reschedule(q)
 }
 
 // SetFile will set the persistence file for queue.
 func (q *Queue) SetFile(file string) error {
-	if q.File != "" && file == q.File {
+	m := q.manager()
+
+	q.Mutex.RLock()
+	current := q.File
+	q.Mutex.RUnlock()
+
+	if current != "" && file == current {
 		return nil
-	} else if q.File != "" && file != q.File {
-		return fmt.Errorf("the new file:[%s] != the exist one[%s], you should use the ForceSetFile method to reset it. And should notice that if the recovery mode is enabled, the stack will be recoverd from the new file", file, q.File)
+	} else if current != "" && file != current {
+		return fmt.Errorf("the new file:[%s] != the exist one[%s], you should use the ForceSetFile method to reset it. And should notice that if the recovery mode is enabled, the queue will be recoverd from the new file", file, current)
 	}
 
-	if _, ok := queueList[file]; ok {
-		return fmt.Errorf("there is already a stack with file [%s] in stacklist, use the ForceSetFile method to reset current one", file)
+	if _, ok := m.lookupQueue(file); ok {
+		return fmt.Errorf("there is already a queue with file [%s] in queuelist, use the ForceSetFile method to reset current one", file)
 	}
 
-	q.File = file
-	queueList[file] = q
+	// the lock is waited without holding the mutexes, so the
+	// registry is checked again after it.
+	lock, err := q.acquireLock(file)
+
+	m.queueMutex.Lock()
+	defer m.queueMutex.Unlock()
 
-	if q.RecoveryControl {
-		q.Recovery()
+	if _, ok := m.queues[file]; ok {
+		unlockFile(lock)
+		return fmt.Errorf("there is already a queue with file [%s] in queuelist, use the ForceSetFile method to reset current one", file)
+	}
+	if err != nil {
+		return err
 	}
 
-	q.PersistenceControl = true
-	if q.PersistencePeriod == 0 {
-		q.PersistencePeriod = DEFAULT_PERIOD_PERSISTENCE_TIME
+	q.Mutex.Lock()
+	if q.File != "" {
+		q.Mutex.Unlock()
+		unlockFile(lock)
+		return fmt.Errorf("the queue is bound to another file, use the ForceSetFile method to reset it")
+	}
+	err = q.bindFile(file, lock)
+	q.recheckDead()
+	q.Mutex.Unlock()
+	if err != nil {
+		return err
 	}
+	m.queues[file] = q
+	m.scheduler.schedule(q)
 
 	return nil
 }
 
-func (q *Queue) ForceSetFile(file string) error {
-	if queue, ok := queueList[file]; ok {
-		q = queue
-		return nil
+// ForceSetFile binds the queue to the file even if it is bound to another
+// one, and sets up the datas by the mode. If the file is bound to another
+// queue in the Manager, the datas are moved into that one by the mode, and
+// the queue is unbound and left empty. It returns the queue bound to the
+// file, which should be used from now on. The file bound before is left as
+// it was persisted last time. It fails with ErrValueType if the queue bound
+// to the file holds the values of another ValueType.
+func (q *Queue) ForceSetFile(file string, mode RebindMode) (*Queue, error) {
+	m := q.manager()
+
+	// the lock is taken whenever the file is not bound under the mutex,
+	// it is waited without holding the mutexes, so the registry is
+	// checked again after it.
+	var lock *os.File
+	var err error
+	m.queueMutex.Lock()
+	if _, ok := m.queues[file]; !ok {
+		m.queueMutex.Unlock()
+		lock, err = q.acquireLock(file)
+		m.queueMutex.Lock()
 	}
+	defer m.queueMutex.Unlock()
 
-	if q.File != "" {
-		delete(queueList, q.File)
+	if queue, ok := m.queues[file]; ok {
+		unlockFile(lock)
+		if queue == q {
+			return q, nil
+		}
+
+		q.Mutex.Lock()
+		queue.Mutex.Lock()
+		old := q.File
+		err = q.handOver(&queue.Buffer, mode)
+		queue.recheckDead()
+		queue.Mutex.Unlock()
+		q.Mutex.Unlock()
+		if err != nil {
+			return q, err
+		}
+
+		if old != "" && m.queues[old] == q {
+			delete(m.queues, old)
+		}
+		m.scheduler.unschedule(q)
+
+		return queue, nil
 	}
 
-	q.File = file
-	queueList[file] = q
+	if err != nil {
+		return q, err
+	}
 
-	if q.RecoveryControl {
-		q.Recovery()
+	q.Mutex.Lock()
+	old := q.File
+	err = q.rebind(file, mode, lock)
+	q.recheckDead()
+	q.Mutex.Unlock()
+	if err != nil {
+		return q, err
 	}
 
-	q.PersistenceControl = true
-	if q.PersistencePeriod == 0 {
-		q.PersistencePeriod = DEFAULT_PERIOD_PERSISTENCE_TIME
+	if old != "" && m.queues[old] == q {
+		delete(m.queues, old)
 	}
+	m.queues[file] = q
+	m.scheduler.schedule(q)
 
-	return nil
+	return q, nil
 }
 
 // SetPersistenceControl enable/disable the persistence control for queue.
@@ -185,47 +325,31 @@ func (q *Queue) GetFile() string {
 // NewQueue is the constructor of Queue.
 // When use NewQueue to construct a queue, you can
 // use option functions to set the options of queue.
+// If the file is locked by another process, or failed to recover
+// from it, the queue is not bound to the file, use OpenQueue to
+// get the error.
+// The queue is owned by the default Manager.
 func NewQueue(opts ...func(*Queue)) *Queue {
-	queue := newQueue()
-	for _, opt := range opts {
-		opt(queue)
-	}
-
-	if queue.File != "" {
-		queueMutex.Lock()
-		defer queueMutex.Unlock()
-
-		if q, ok := queueList[queue.File]; ok {
-			queue = q
-		} else {
-			queueList[queue.File] = queue
-		}
-	}
+	return defaultManager.NewQueue(opts...)
+}
 
-	return queue
+// OpenQueue works like NewQueue, but it returns an error wrapping
+// ErrLocked if the file is locked by another process, or the error
+// of recovering from the file with CorruptionStrict.
+func OpenQueue(opts ...func(*Queue)) (*Queue, error) {
+	return defaultManager.OpenQueue(opts...)
 }
 
+// GetQueue returns the queue bound to the file in the default Manager,
+// or constructs one by recovering from the file.
 func GetQueue(file string) *Queue {
-	queueMutex.RLock()
-	if queue, ok := queueList[file]; ok {
-		return queue
-	}
-	defer queueMutex.RUnlock()
-
-	return NewQueue(
-		SetQueueFile(file),
-		SetQueuePersistenceControl(true),
-		SetQueueRecoveryControl(true),
-	)
+	return defaultManager.GetQueue(file)
 }
 
+// DestroyQueue removes the queue bound to the file from the default
+// Manager, and stops persisting it.
 func DestroyQueue(file string) {
-	queueMutex.Lock()
-	defer queueMutex.Unlock()
-
-	if _, ok := queueList[file]; ok {
-		delete(queueList, file)
-	}
+	defaultManager.DestroyQueue(file)
 }
 
 func (q *Queue) Len() int64 {
@@ -240,52 +364,172 @@ func (q *Queue) Clear() {
 	q.Buffer.Clear()
 }
 
+// GetHead returns the value at the head of queue without removing it.
+// The expired and reserved values are skipped.
 func (q *Queue) GetHead() (interface{}, error) {
-	return q.Buffer.GetHeadValue()
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	if q.closed {
+		return nil, ErrClosed
+	}
+
+	node := q.available(time.Now())
+	if node == nil {
+		return nil, fmt.Errorf("queue is empty")
+	}
+
+	return node.Value, nil
+}
+
+// EnQueue will add a value at the tail of queue.
+// If the queue is full, the overflow policy of the queue is applied,
+// and with OverflowBlock it will block until there is free space.
+func (q *Queue) EnQueue(value interface{}) error {
+	return q.EnQueueWait(context.Background(), value)
 }
 
-func (q *Queue) EnQueue(value interface{}) {
+// EnQueueWithTTL works like EnQueue, but the value will expire
+// after the ttl instead of the default TTL of queue.
+func (q *Queue) EnQueueWithTTL(value interface{}, ttl time.Duration) error {
+	return q.enQueueWait(context.Background(), value, ttl)
+}
+
+// TryEnQueue works like EnQueue but never blocks. If the queue is
+// full and the overflow policy is OverflowBlock, ErrFull is returned.
+func (q *Queue) TryEnQueue(value interface{}) error {
 	q.Mutex.Lock()
 	defer q.Mutex.Unlock()
 
-	node := NewDataNode(value)
-	q.Datas.AddNodeAtTail(node)
+	return q.enQueue(value, 0)
+}
+
+// EnQueueWait works like EnQueue, but if the queue is full and the
+// overflow policy is OverflowBlock, it will only block until the ctx is done.
+func (q *Queue) EnQueueWait(ctx context.Context, value interface{}) error {
+	return q.enQueueWait(ctx, value, 0)
+}
+
+func (q *Queue) enQueueWait(ctx context.Context, value interface{}, ttl time.Duration) error {
+	for {
+		q.Mutex.Lock()
+		if q.closed || !q.full() || q.Overflow != OverflowBlock {
+			err := q.enQueue(value, ttl)
+			q.Mutex.Unlock()
+			return err
+		}
+		wait := q.waitChan()
+		q.Mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// enQueue adds a value at the tail of queue with the overflow policy,
+// the value expires after the ttl, or the default TTL if ttl is 0.
+// The Mutex should be held by the caller.
+func (q *Queue) enQueue(value interface{}, ttl time.Duration) error {
+	if q.closed {
+		return ErrClosed
+	}
+
+	add, err := q.makeRoom()
+	if !add {
+		return err
+	}
+
+	node := q.newNode(value, ttl)
+	q.addNodeAtTail(node)
 
 	q.Length++
 
 	if q.Length == 1 {
 		q.SetRegister(value)
 	}
+
+	q.broadcast()
+
+	return nil
 }
 
+// DeQueue removes the value at the head of queue and returns it.
+// The reserved values are skipped, and the expired values at the
+// head are evicted.
 func (q *Queue) DeQueue() (interface{}, error) {
 	q.Mutex.Lock()
-	defer q.Mutex.Unlock()
+	expired := q.expireAtHead()
+	value, err := q.deQueue()
+	q.Mutex.Unlock()
 
-	if q.Length == 0 {
-		return nil, fmt.Errorf("queue is empty")
+	q.routeExpired(expired)
+
+	return value, err
+}
+
+// DeQueueWait works like DeQueue, but it will block the caller when
+// the queue is empty, until a value is enqueued or the ctx is done.
+// If the ctx is done before getting a value, the error of ctx is returned.
+func (q *Queue) DeQueueWait(ctx context.Context) (interface{}, error) {
+	for {
+		q.Mutex.Lock()
+		expired := q.expireAtHead()
+		if q.closed || q.available(time.Now()) != nil {
+			value, err := q.deQueue()
+			q.Mutex.Unlock()
+			q.routeExpired(expired)
+			return value, err
+		}
+		wait, until := q.waitChan(), q.nextVisible()
+		q.Mutex.Unlock()
+		q.routeExpired(expired)
+
+		err := waitFor(ctx, wait, until)
+		if err != nil {
+			return nil, err
+		}
 	}
+}
 
-	value, err := q.Datas.GetHeadValue()
-	if err == nil {
-		q.Datas.DeleteNodeAtHead()
-		q.Length--
+// deQueue removes the first available value of queue and returns it.
+// The Mutex should be held by the caller.
+func (q *Queue) deQueue() (interface{}, error) {
+	if q.closed {
+		return nil, ErrClosed
 	}
 
-	return value, err
+	node := q.available(time.Now())
+	if node == nil {
+		return nil, fmt.Errorf("queue is empty")
+	}
+
+	q.deleteNode(node)
+	q.Length--
+	q.broadcast()
+
+	return node.Value, nil
 }
 
 func (q *Queue) Persistent() error {
 	return q.Buffer.Persistent()
 }
 
+// Recovery sets up the queue from the file, and moves the values which
+// are delivered for the max times into the dead-letter queue.
+func (q *Queue) Recovery() error {
+	err := q.Buffer.Recovery()
+	q.routeDead()
+
+	return err
+}
+
+// PeriodicallyPersistent persists the queue if the persistence control
+// is enabled, it is called by the scheduler every persistence period.
 func (q *Queue) PeriodicallyPersistent() {
-	if q.PersistenceControl && !q.persRunning {
-		q.persRunning = true
-		select {
-		case <-time.After(q.PersistencePeriod):
-			q.Persistent()
-		}
-		q.persRunning = false
+	if q.GetPersistenceControl() {
+		q.Persistent()
 	}
 }
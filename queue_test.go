@@ -1,17 +1,21 @@
 package mtque
 
 import (
+	"context"
+	"os"
+	"reflect"
 	"testing"
 	"time"
 )
 
 func TestNewEmptyQueue(t *testing.T) {
-	queue := NewQueue()
+	m := NewManager()
+	queue := m.NewQueue()
 	if queue == nil {
 		t.Fatal("Construct a new empty queue fail!")
 	}
 
-	if len(queueList) > 0 {
+	if len(m.queues) > 0 {
 		t.Fatal("Initailize the queue list wrong!")
 	}
 }
@@ -189,3 +193,184 @@ func TestQueueRecovery(t *testing.T) {
 		t.Fatal("Wrong value:", v)
 	}
 }
+
+func TestDeQueueWait(t *testing.T) {
+	queue := NewQueue()
+
+	t.Run("Wakeup", func(t *testing.T) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			queue.EnQueue(1)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		v, err := queue.DeQueueWait(ctx)
+		if err != nil {
+			t.Fatal("DeQueueWait error:", err)
+		}
+		if v != 1 {
+			t.Fatal("Wrong value:", v)
+		}
+	})
+	t.Run("Deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := queue.DeQueueWait(ctx)
+		if err != context.DeadlineExceeded {
+			t.Fatal("DeQueueWait should be stopped by the deadline:", err)
+		}
+	})
+	t.Run("Cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+
+		_, err := queue.DeQueueWait(ctx)
+		if err != context.Canceled {
+			t.Fatal("DeQueueWait should be stopped by cancel:", err)
+		}
+	})
+}
+
+func TestQueueCapacity(t *testing.T) {
+	t.Run("OverflowFail", func(t *testing.T) {
+		queue := NewQueue(SetQueueCapacity(2), SetQueueOverflowPolicy(OverflowFail))
+
+		queue.EnQueue(1)
+		queue.EnQueue(2)
+		if err := queue.EnQueue(3); err != ErrFull {
+			t.Fatal("EnQueue into a full queue should fail:", err)
+		}
+		if queue.Len() != 2 {
+			t.Fatal("Wrong length:", queue.Len())
+		}
+	})
+	t.Run("OverflowDropNewest", func(t *testing.T) {
+		queue := NewQueue(SetQueueCapacity(2), SetQueueOverflowPolicy(OverflowDropNewest))
+
+		queue.EnQueue(1)
+		queue.EnQueue(2)
+		if err := queue.EnQueue(3); err != nil {
+			t.Fatal("EnQueue error:", err)
+		}
+
+		v1, _ := queue.DeQueue()
+		v2, _ := queue.DeQueue()
+		if v1 != 1 || v2 != 2 || queue.Len() != 0 {
+			t.Fatal("The newest value should be dropped:", v1, v2)
+		}
+	})
+	t.Run("OverflowDropOldest", func(t *testing.T) {
+		queue := NewQueue(SetQueueCapacity(2), SetQueueOverflowPolicy(OverflowDropOldest))
+
+		queue.EnQueue(1)
+		queue.EnQueue(2)
+		if err := queue.EnQueue(3); err != nil {
+			t.Fatal("EnQueue error:", err)
+		}
+
+		v1, _ := queue.DeQueue()
+		v2, _ := queue.DeQueue()
+		if v1 != 2 || v2 != 3 || queue.Len() != 0 {
+			t.Fatal("The oldest value should be dropped:", v1, v2)
+		}
+
+		queue.EnQueue(1)
+		queue.EnQueue(2)
+		if _, _, err := queue.Reserve(time.Minute); err != nil {
+			t.Fatal("Reserve error:", err)
+		}
+		if err := queue.EnQueue(3); err != nil {
+			t.Fatal("EnQueue error:", err)
+		}
+		if v := linkValues(&queue.Buffer); !reflect.DeepEqual(v, []interface{}{1, 3}) || queue.InFlight() != 1 {
+			t.Fatal("The reserved value should not be dropped:", v)
+		}
+
+		queue.Reserve(time.Minute)
+		if err := queue.EnQueue(4); err != ErrFull || queue.Len() != 2 {
+			t.Fatal("EnQueue into a queue full of reserved values should fail:", err)
+		}
+	})
+	t.Run("OverflowBlock", func(t *testing.T) {
+		queue := NewQueue(SetQueueCapacity(1))
+
+		queue.EnQueue(1)
+		if err := queue.TryEnQueue(2); err != ErrFull {
+			t.Fatal("TryEnQueue into a full queue should fail:", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := queue.EnQueueWait(ctx, 2); err != context.DeadlineExceeded {
+			t.Fatal("EnQueueWait should be stopped by the deadline:", err)
+		}
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			queue.DeQueue()
+		}()
+
+		if err := queue.EnQueue(2); err != nil {
+			t.Fatal("EnQueue error:", err)
+		}
+		if v, _ := queue.GetHead(); v != 2 {
+			t.Fatal("Wrong value:", v)
+		}
+	})
+}
+
+func TestQueuePersistenceAfterDeQueue(t *testing.T) {
+	os.Remove("./queue_dequeue")
+
+	queue := NewQueue(
+		SetQueueFile("./queue_dequeue"),
+		SetQueuePersistenceControl(true),
+	)
+	defer DestroyQueue("./queue_dequeue")
+
+	queue.EnQueue(1)
+	queue.EnQueue(2)
+	queue.EnQueue(3)
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+
+	queue.DeQueue()
+	queue.EnQueue(4)
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+	queue.DeQueue()
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := NewBuffer(
+		SetBufferFile("./queue_dequeue"),
+		SetBufferRecoveryControl(true),
+		SetBufferDecoder(func(decode func(interface{}) error) (interface{}, error) {
+			var value int
+			err := decode(&value)
+			return value, err
+		}),
+	)
+	if err := buf.Recovery(); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != 2 {
+		t.Fatal("Recovery error:", buf.Len())
+	}
+	if v, _ := buf.GetHeadValue(); v != 3 {
+		t.Fatal("Wrong head value:", v)
+	}
+	if v, _ := buf.GetTailValue(); v != 4 {
+		t.Fatal("Wrong tail value:", v)
+	}
+}
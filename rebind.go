@@ -0,0 +1,289 @@
+package mtque
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrValueType is returned when the datas are handed over to the
+// instance bound to the file, whose ValueType is another one.
+var ErrValueType = errors.New("value type mismatch")
+
+// RebindMode decides the datas of a queue or stack after ForceSetFile
+// binds it to another file.
+type RebindMode int
+
+const (
+	// RebindReplace drops the datas in memory, and loads the ones in
+	// the file, or takes the ones of the instance bound to the file.
+	RebindReplace RebindMode = iota
+	// RebindMerge appends the datas in memory after the ones in the
+	// file, or after the ones of the instance bound to the file.
+	RebindMerge
+	// RebindMigrate moves the datas in memory into the file, the ones in
+	// the file, or the ones of the instance bound to the file, are dropped.
+	RebindMigrate
+)
+
+// bufferState is the state of buffer bound to a file, it is kept to
+// restore the buffer if failed to rebind it to another file.
+type bufferState struct {
+	info     BufferInfo
+	file     string
+	datas    *DataLink
+	reserved map[string]*DataNode
+	codec    Codec
+	rewrite  bool
+	updated  map[*DataNode]struct{}
+	deleted  []int64
+	live     int64
+	lsn      int64
+	report   RecoveryReport
+}
+
+// state returns the state of buffer bound to its file.
+// The Mutex should be held by the caller.
+func (b *Buffer) state() bufferState {
+	return bufferState{
+		info:     b.BufferInfo,
+		file:     b.File,
+		datas:    b.Datas,
+		reserved: b.reserved,
+		codec:    b.Codec,
+		rewrite:  b.rewrite,
+		updated:  b.updated,
+		deleted:  b.deleted,
+		live:     b.live,
+		lsn:      b.lsn,
+		report:   b.report,
+	}
+}
+
+// restore sets the buffer back to the state.
+// The Mutex should be held by the caller.
+func (b *Buffer) restore(state bufferState) {
+	b.BufferInfo = state.info
+	b.File = state.file
+	b.Datas = state.datas
+	b.reserved = state.reserved
+	b.Codec = state.codec
+	b.rewrite = state.rewrite
+	b.updated = state.updated
+	b.deleted = state.deleted
+	b.live = state.live
+	b.lsn = state.lsn
+	b.report = state.report
+}
+
+// rebind binds the buffer to the file with the lock of it taken by
+// acquireLock, and sets up the datas by the mode. The file bound before
+// is left as it was persisted last time. If failed, the lock is released
+// and the buffer is still bound to the file before.
+// The Mutex should be held by the caller.
+func (b *Buffer) rebind(file string, mode RebindMode, lock *os.File) error {
+	if b.closed {
+		unlockFile(lock)
+		return ErrClosed
+	}
+
+	var err error
+	state := b.state()
+	b.closeWAL()
+	b.File = file
+
+	switch mode {
+	case RebindMigrate:
+		err = b.migrate()
+	case RebindMerge:
+		err = b.load()
+		if err == nil {
+			err = b.appendDatas(state.datas)
+		}
+	default:
+		err = b.load()
+	}
+	if err != nil {
+		b.closeWAL()
+		b.restore(state)
+		unlockFile(lock)
+		return err
+	}
+
+	b.setLock(lock)
+
+	b.PersistenceControl = true
+	if b.PersistencePeriod == 0 {
+		b.PersistencePeriod = DEFAULT_PERIOD_PERSISTENCE_TIME
+	}
+	b.reindex()
+	b.scheduleReap(b.nextExpiry())
+	b.broadcast()
+
+	return nil
+}
+
+// load sets up the datas from the file, there is no data if the file
+// does not exist.
+// The Mutex should be held by the caller.
+func (b *Buffer) load() error {
+	b.report = RecoveryReport{}
+	err := b.recoveryFile()
+	if os.IsNotExist(err) {
+		b.Datas = NewDataLink()
+		b.reserved = nil
+		b.Length = 0
+		b.FileStartSeek = BUFFER_INFO_SIZE
+		b.FileEndSeek = BUFFER_INFO_SIZE
+		b.CheckpointLSN = 0
+		b.rewrite = false
+		err = nil
+	}
+	if err == nil && b.WAL {
+		err = b.replayWAL()
+	}
+	b.report.Recovered = b.Length
+
+	return err
+}
+
+// migrate persists the datas into the file, replacing the ones in it.
+// The datas are written by rewriting, so the ones in the file and its
+// write-ahead log are only replaced at the commit, and they are left as
+// they were if failed. The segment size of the file is kept like loading
+// it, and the LSN checkpointed is after the ones in the log, so that the
+// operations logged for the datas replaced are never replayed.
+// The Mutex should be held by the caller.
+func (b *Buffer) migrate() error {
+	store := b.storage()
+	info, _, err := readBufferInfo(store)
+	store.Close()
+	if os.IsNotExist(err) {
+		info = BufferInfo{
+			FileStartSeek: BUFFER_INFO_SIZE,
+			FileEndSeek:   BUFFER_INFO_SIZE,
+			SegmentSize:   b.SegmentSize,
+		}
+	} else if err != nil {
+		return err
+	}
+
+	lsn, err := b.loggedLSN()
+	if err != nil {
+		return err
+	}
+
+	b.SegmentSize = info.SegmentSize
+	b.FileStartSeek, b.FileEndSeek = info.FileStartSeek, info.FileEndSeek
+	b.lsn = max(info.CheckpointLSN, lsn)
+
+	err = b.rewritePersistent()
+	if err != nil || b.WAL {
+		return err
+	}
+
+	// rewritePersistent empties the log only if it is enabled.
+	err = os.Remove(b.walFile())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// overflows returns whether the datas can not be appended after the
+// nodes of kept, with the capacity and the overflow policy of buffer.
+// With OverflowDropNewest the nodes beyond the capacity are dropped, and
+// with OverflowDropOldest the oldest values which are not reserved are
+// dropped, so they only overflow if the reserved values exceed the
+// capacity.
+func (b *Buffer) overflows(kept, datas *DataLink) bool {
+	if b.Capacity <= 0 {
+		return false
+	}
+
+	switch b.Overflow {
+	case OverflowDropNewest:
+		return false
+	case OverflowDropOldest:
+		return reservedCount(kept)+reservedCount(datas) > b.Capacity
+	default:
+		return linkLen(kept)+linkLen(datas) > b.Capacity
+	}
+}
+
+// linkLen returns the number of nodes in datas.
+func linkLen(datas *DataLink) int64 {
+	var n int64
+	for node := datas.Head; node != nil; node = node.Next {
+		n++
+	}
+
+	return n
+}
+
+// appendDatas appends the nodes of datas after the ones of buffer with
+// the capacity and the overflow policy of buffer, see overflows. If they
+// overflow, ErrFull is returned and nothing is changed.
+// The Mutex should be held by the caller.
+func (b *Buffer) appendDatas(datas *DataLink) error {
+	if b.overflows(b.Datas, datas) {
+		return ErrFull
+	}
+
+	for node := datas.Head; node != nil; {
+		next := node.Next
+		if b.Overflow == OverflowDropNewest && b.full() {
+			break
+		}
+		node.Next, node.Previous = nil, nil
+		node.pos, node.end = 0, 0
+		b.addNodeAtTail(node)
+		b.Length++
+		node = next
+	}
+	if b.Capacity > 0 && b.Overflow == OverflowDropOldest {
+		b.dropOldest(b.Capacity)
+	}
+
+	return nil
+}
+
+// handOver moves the datas of buffer into the buffer dst bound to another
+// file by the mode, and unbinds the buffer from its file, which is left
+// as it was persisted last time. The buffer is empty after it.
+// The Mutex of both buffers should be held by the caller.
+func (b *Buffer) handOver(dst *Buffer, mode RebindMode) error {
+	if b.closed || dst.closed {
+		return ErrClosed
+	}
+	if b.ValueType != dst.ValueType {
+		return fmt.Errorf("%w: the file is bound to an instance of values of %v", ErrValueType, dst.ValueType)
+	}
+
+	switch mode {
+	case RebindMigrate:
+		if dst.overflows(NewDataLink(), b.Datas) {
+			return ErrFull
+		}
+		dst.clear()
+		fallthrough
+	case RebindMerge:
+		if err := dst.appendDatas(b.Datas); err != nil {
+			return err
+		}
+		dst.reindex()
+		dst.scheduleReap(dst.nextExpiry())
+		dst.broadcast()
+	}
+
+	b.closeWAL()
+	b.releaseLock()
+	b.File = ""
+	b.Datas = NewDataLink()
+	b.reserved = nil
+	b.Length = 0
+	b.broadcast()
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package mtque
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// persistQueue persists the values into the file.
+func persistQueue(t *testing.T, file string, values ...int) {
+	queue := NewManager().NewQueue(SetQueueFile(file), SetQueuePersistenceControl(true))
+	for _, v := range values {
+		queue.EnQueue(v)
+	}
+	if err := queue.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func intQueue(m *Manager, opts ...func(*Queue)) *Queue {
+	queue := m.NewQueue(opts...)
+	queue.SetRegister(0)
+	return queue
+}
+
+func TestForceSetFile(t *testing.T) {
+	remove := func() {
+		for _, file := range []string{"./queue_rebind_a", "./queue_rebind_b"} {
+			os.Remove(file)
+			os.Remove(file + ".lock")
+		}
+	}
+
+	modes := []struct {
+		name string
+		mode RebindMode
+		want []interface{}
+	}{
+		{"Replace", RebindReplace, []interface{}{1, 2}},
+		{"Merge", RebindMerge, []interface{}{1, 2, 3, 4}},
+		{"Migrate", RebindMigrate, []interface{}{3, 4}},
+	}
+
+	for _, c := range modes {
+		t.Run(c.name, func(t *testing.T) {
+			remove()
+			defer remove()
+			persistQueue(t, "./queue_rebind_b", 1, 2)
+
+			m := NewManager()
+			defer m.Shutdown(context.Background())
+
+			queue := intQueue(m, SetQueueFile("./queue_rebind_a"))
+			queue.EnQueue(3)
+			queue.EnQueue(4)
+
+			rebound, err := queue.ForceSetFile("./queue_rebind_b", c.mode)
+			if err != nil || rebound != queue {
+				t.Fatal("ForceSetFile should rebind the queue:", err)
+			}
+			if v := linkValues(&queue.Buffer); !reflect.DeepEqual(v, c.want) || queue.Len() != int64(len(c.want)) {
+				t.Fatal("Wrong values:", v, queue.Len())
+			}
+			if _, ok := m.queues["./queue_rebind_a"]; ok || m.queues["./queue_rebind_b"] != queue {
+				t.Fatal("The queue should be registered with the new file")
+			}
+
+			queue.Persistent()
+			buf := NewBuffer(SetBufferFile("./queue_rebind_b"), SetBufferRecoveryControl(true), SetBufferRegister(0))
+			if err := buf.Recovery(); err != nil || !reflect.DeepEqual(linkValues(buf), c.want) {
+				t.Fatal("Wrong values persisted:", linkValues(buf), err)
+			}
+		})
+	}
+
+	for _, c := range modes {
+		t.Run(c.name+"Registered", func(t *testing.T) {
+			remove()
+			defer remove()
+
+			m := NewManager()
+			defer m.Shutdown(context.Background())
+
+			bound := intQueue(m, SetQueueFile("./queue_rebind_b"))
+			bound.EnQueue(1)
+			bound.EnQueue(2)
+
+			queue := intQueue(m, SetQueueFile("./queue_rebind_a"))
+			queue.EnQueue(3)
+			queue.EnQueue(4)
+
+			rebound, err := queue.ForceSetFile("./queue_rebind_b", c.mode)
+			if err != nil || rebound != bound {
+				t.Fatal("ForceSetFile should return the queue bound to the file:", err)
+			}
+			if v := linkValues(&bound.Buffer); !reflect.DeepEqual(v, c.want) || bound.Len() != int64(len(c.want)) {
+				t.Fatal("Wrong values:", v, bound.Len())
+			}
+			if queue.Len() != 0 || queue.GetFile() != "" {
+				t.Fatal("The queue should be unbound and empty:", queue.Len(), queue.GetFile())
+			}
+			if _, ok := m.queues["./queue_rebind_a"]; ok {
+				t.Fatal("The queue should be removed from the manager")
+			}
+			if _, err := NewManager().OpenQueue(SetQueueFile("./queue_rebind_a")); err != nil {
+				t.Fatal("The file bound before should be released:", err)
+			}
+		})
+	}
+
+	t.Run("Capacity", func(t *testing.T) {
+		policies := []struct {
+			policy OverflowPolicy
+			want   []interface{}
+			err    error
+		}{
+			{OverflowFail, []interface{}{3, 4}, ErrFull},
+			{OverflowDropNewest, []interface{}{1, 2, 3}, nil},
+			{OverflowDropOldest, []interface{}{2, 3, 4}, nil},
+		}
+
+		for _, c := range policies {
+			remove()
+			persistQueue(t, "./queue_rebind_b", 1, 2)
+
+			m := NewManager()
+			queue := intQueue(m, SetQueueFile("./queue_rebind_a"), SetQueueCapacity(3), SetQueueOverflowPolicy(c.policy))
+			queue.EnQueue(3)
+			queue.EnQueue(4)
+
+			_, err := queue.ForceSetFile("./queue_rebind_b", RebindMerge)
+			if err != c.err {
+				t.Fatal("Wrong error of merging beyond the capacity:", c.policy, err)
+			}
+			if v := linkValues(&queue.Buffer); !reflect.DeepEqual(v, c.want) || queue.Len() != int64(len(c.want)) {
+				t.Fatal("Wrong values:", c.policy, v, queue.Len())
+			}
+
+			m.Shutdown(context.Background())
+		}
+		remove()
+	})
+
+	t.Run("MigrateFailed", func(t *testing.T) {
+		remove()
+		defer remove()
+		persistQueue(t, "./queue_rebind_b", 1, 2)
+
+		m := NewManager()
+		defer m.Shutdown(context.Background())
+		queue := intQueue(m, SetQueueFile("./queue_rebind_a"))
+		queue.EnQueue(make(chan int))
+
+		if _, err := queue.ForceSetFile("./queue_rebind_b", RebindMigrate); err == nil {
+			t.Fatal("Migrating the value which can not be encoded should fail")
+		}
+		recovered, err := recoverFile("./queue_rebind_b", CorruptionStrict)
+		if err != nil || !reflect.DeepEqual(linkValues(recovered), []interface{}{1, 2}) {
+			t.Fatal("The file should be left as it was:", linkValues(recovered), err)
+		}
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		remove()
+		defer remove()
+
+		other := NewManager()
+		defer other.Shutdown(context.Background())
+		other.NewQueue(SetQueueFile("./queue_rebind_b"))
+
+		m := NewManager()
+		defer m.Shutdown(context.Background())
+		queue := intQueue(m, SetQueueFile("./queue_rebind_a"))
+		queue.EnQueue(3)
+
+		rebound, err := queue.ForceSetFile("./queue_rebind_b", RebindMerge)
+		if !errors.Is(err, ErrLocked) || rebound != queue {
+			t.Fatal("Rebinding to a locked file should fail:", err)
+		}
+		if queue.GetFile() != "./queue_rebind_a" || m.queues["./queue_rebind_a"] != queue || queue.Len() != 1 {
+			t.Fatal("The queue should be still bound to its file")
+		}
+	})
+}
+
+func TestStackForceSetFile(t *testing.T) {
+	os.Remove("./stack_rebind")
+	defer os.Remove("./stack_rebind")
+	defer os.Remove("./stack_rebind.lock")
+
+	m := NewManager()
+	defer m.Shutdown(context.Background())
+
+	bound := m.NewStack(SetStackFile("./stack_rebind"))
+	bound.Push(1)
+
+	stack := m.NewStack()
+	stack.Push(2)
+
+	rebound, err := stack.ForceSetFile("./stack_rebind", RebindMerge)
+	if err != nil || rebound != bound {
+		t.Fatal("ForceSetFile should return the stack bound to the file:", err)
+	}
+	if v, err := rebound.Pop(); err != nil || v != 2 {
+		t.Fatal("The values merged should be on the top:", v, err)
+	}
+	if stack.Len() != 0 {
+		t.Fatal("The stack should be empty:", stack.Len())
+	}
+}
+
+func TestForceSetFileDestroyed(t *testing.T) {
+	remove := func() {
+		os.Remove("./queue_rebind_destroy")
+		os.Remove("./queue_rebind_destroy.lock")
+	}
+	remove()
+	defer remove()
+
+	m := NewManager()
+	defer m.Shutdown(context.Background())
+	bound := m.NewQueue(SetQueueFile("./queue_rebind_destroy"))
+	queue := intQueue(m)
+
+	// ForceSetFile is blocked on the registry until the queue bound to
+	// the file is destroyed, which DestroyQueue does under the mutex.
+	m.queueMutex.RLock()
+	rebound := make(chan *Queue)
+	go func() {
+		q, err := queue.ForceSetFile("./queue_rebind_destroy", RebindReplace)
+		if err != nil {
+			t.Error(err)
+		}
+		rebound <- q
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	delete(m.queues, "./queue_rebind_destroy")
+	m.scheduler.unschedule(bound)
+	bound.Mutex.Lock()
+	bound.releaseLock()
+	bound.Mutex.Unlock()
+	m.queueMutex.RUnlock()
+
+	if q := <-rebound; q != queue {
+		t.Fatal("The queue should be bound to the file destroyed")
+	}
+	queue.Mutex.RLock()
+	defer queue.Mutex.RUnlock()
+	if queue.lock == nil {
+		t.Fatal("The queue should hold the lock of the file it is bound to")
+	}
+}
@@ -0,0 +1,74 @@
+package mtque
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	typesByName = make(map[string]reflect.Type)
+	namesByType = make(map[reflect.Type]string)
+	typesMutex  sync.RWMutex
+)
+
+// RegisterType registers the concrete type of sample with the name. The
+// values of the registered types are persisted with the name, so they are
+// rebuilt as their own types at recovering, which makes a buffer holding
+// the values of several types recoverable. It takes precedence over the
+// Register and Decoder of buffer.
+// Like gob.RegisterName, it panics if the name or the type is registered
+// with another type or name.
+func RegisterType(name string, sample interface{}) {
+	if name == "" {
+		panic("mtque: registering the type with an empty name")
+	}
+	if sample == nil {
+		panic("mtque: registering a nil sample")
+	}
+
+	typ := reflect.TypeOf(sample)
+
+	typesMutex.Lock()
+	defer typesMutex.Unlock()
+
+	if t, ok := typesByName[name]; ok && t != typ {
+		panic(fmt.Sprintf("mtque: registering duplicate types for %q: %s != %s", name, t, typ))
+	}
+	if n, ok := namesByType[typ]; ok && n != name {
+		panic(fmt.Sprintf("mtque: registering duplicate names for %s: %q != %q", typ, n, name))
+	}
+
+	typesByName[name] = typ
+	namesByType[typ] = name
+}
+
+// registeredName returns the name of the registered type of value.
+func registeredName(value interface{}) (string, bool) {
+	if value == nil {
+		return "", false
+	}
+
+	typesMutex.RLock()
+	defer typesMutex.RUnlock()
+
+	name, ok := namesByType[reflect.TypeOf(value)]
+	return name, ok
+}
+
+// registeredType returns the registered type of the name.
+func registeredType(name string) (reflect.Type, bool) {
+	typesMutex.RLock()
+	defer typesMutex.RUnlock()
+
+	typ, ok := typesByName[name]
+	return typ, ok
+}
+
+// typesRegistered returns whether there is any registered type.
+func typesRegistered() bool {
+	typesMutex.RLock()
+	defer typesMutex.RUnlock()
+
+	return len(typesByName) > 0
+}
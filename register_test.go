@@ -0,0 +1,89 @@
+package mtque
+
+import (
+	"os"
+	"testing"
+)
+
+type job interface {
+	Run() string
+}
+
+type emailJob struct {
+	To string
+}
+
+func (j emailJob) Run() string {
+	return "email " + j.To
+}
+
+type smsJob struct {
+	Phone int
+}
+
+func (j *smsJob) Run() string {
+	return "sms"
+}
+
+func TestRegisterType(t *testing.T) {
+	RegisterType("emailJob", emailJob{})
+	RegisterType("smsJob", &smsJob{})
+	// registering the same type with the same name again is allowed
+	RegisterType("emailJob", emailJob{})
+
+	os.Remove("./queue_types")
+
+	queue := NewQueue(
+		SetQueueFile("./queue_types"),
+		SetQueuePersistenceControl(true),
+	)
+	defer DestroyQueue("./queue_types")
+
+	jobs := []job{emailJob{To: "a"}, &smsJob{Phone: 1}, emailJob{To: "b"}}
+	for _, j := range jobs {
+		queue.EnQueue(j)
+	}
+	queue.EnQueue("untagged")
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Recovery", func(t *testing.T) {
+		buf := NewBuffer(
+			SetBufferFile("./queue_types"),
+			SetBufferRecoveryControl(true),
+			SetBufferRegister(""),
+		)
+		if err := buf.Recovery(); err != nil {
+			t.Fatal(err)
+		}
+
+		values := linkValues(buf)
+		if len(values) != 4 {
+			t.Fatal("Wrong values:", values)
+		}
+		if v, ok := values[0].(emailJob); !ok || v.To != "a" {
+			t.Fatalf("Wrong value: %#v", values[0])
+		}
+		if v, ok := values[1].(*smsJob); !ok || v.Phone != 1 {
+			t.Fatalf("Wrong value: %#v", values[1])
+		}
+		if v, ok := values[2].(job); !ok || v.Run() != "email b" {
+			t.Fatalf("Wrong value: %#v", values[2])
+		}
+		// the value of unregistered type is rebuilt as the Register
+		if v, ok := values[3].(string); !ok || v != "untagged" {
+			t.Fatalf("Wrong value: %#v", values[3])
+		}
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Registering another type with the name should panic")
+			}
+		}()
+
+		RegisterType("emailJob", smsJob{})
+	})
+}
@@ -0,0 +1,182 @@
+package mtque
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// ErrUnknownReceipt is returned when acking or nacking with a receipt
+// which does not match any reserved value, e.g. the value is acked already.
+var ErrUnknownReceipt = errors.New("receipt is unknown")
+
+// reservedAt returns whether the node is reserved and invisible at the time.
+func (d *DataNode) reservedAt(now time.Time) bool {
+	return d.Receipt != "" && now.Before(d.InvisibleUntil)
+}
+
+// nextVisible returns the earliest time that a reserved node becomes
+// visible again, it is zero if there is no reserved node.
+// The Mutex should be held by the caller.
+func (b *Buffer) nextVisible() time.Time {
+	var next time.Time
+	for _, node := range b.reserved {
+		if next.IsZero() || node.InvisibleUntil.Before(next) {
+			next = node.InvisibleUntil
+		}
+	}
+
+	return next
+}
+
+// available returns the first node from the head of queue which
+// is neither expired, reserved nor dead.
+// The Mutex should be held by the caller.
+func (q *Queue) available(now time.Time) *DataNode {
+	for node := q.Datas.Head; node != nil; node = node.Next {
+		if !node.expired(now) && !node.reservedAt(now) && !q.dead(node, now) {
+			return node
+		}
+	}
+
+	return nil
+}
+
+// Reserve gets the first available value of queue without removing it.
+// The value is hidden from DeQueue and Reserve for the visibility timeout,
+// and it should be acked with the returned receipt after processed,
+// otherwise it will be visible again after the timeout.
+// The reservation is persisted with the value, so the unacked values
+// will be delivered again after recovering. The values delivered for
+// MaxDeliveries times are never reserved again, see SetQueueMaxDeliveries.
+func (q *Queue) Reserve(visibility time.Duration) (interface{}, string, error) {
+	q.Mutex.Lock()
+	expired := q.expireAtHead()
+	value, receipt, err := q.reserve(visibility)
+	q.Mutex.Unlock()
+
+	q.routeExpired(expired)
+
+	return value, receipt, err
+}
+
+// ReserveWait works like Reserve, but it will block the caller until
+// there is an available value, or the ctx is done.
+func (q *Queue) ReserveWait(ctx context.Context, visibility time.Duration) (interface{}, string, error) {
+	for {
+		q.Mutex.Lock()
+		expired := q.expireAtHead()
+		value, receipt, err := q.reserve(visibility)
+		if err == nil || q.closed {
+			q.Mutex.Unlock()
+			q.routeExpired(expired)
+			return value, receipt, err
+		}
+		wait, until := q.waitChan(), q.nextVisible()
+		q.Mutex.Unlock()
+		q.routeExpired(expired)
+
+		err = waitFor(ctx, wait, until)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+// reserve reserves the first available value of queue. If the value is
+// reserved for MaxDeliveries times, it is moved into the dead-letter queue
+// after the visibility timeout unless acked before.
+// The Mutex should be held by the caller.
+func (q *Queue) reserve(visibility time.Duration) (interface{}, string, error) {
+	if q.closed {
+		return nil, "", ErrClosed
+	}
+
+	now := time.Now()
+	node := q.available(now)
+	if node == nil {
+		return nil, "", fmt.Errorf("queue is empty")
+	}
+
+	if node.Receipt != "" {
+		delete(q.reserved, node.Receipt)
+	}
+	if q.reserved == nil {
+		q.reserved = make(map[string]*DataNode)
+	}
+
+	node.Receipt = uuid.Must(uuid.NewV4()).String()
+	node.InvisibleUntil = now.Add(visibility)
+	node.Deliveries++
+	q.reserved[node.Receipt] = node
+	q.touchNode(node)
+	if q.MaxDeliveries > 0 && node.Deliveries >= q.MaxDeliveries {
+		q.scheduleDead(node.InvisibleUntil)
+	}
+
+	return node.Value, node.Receipt, nil
+}
+
+// Ack removes the value reserved with the receipt from the queue.
+func (q *Queue) Ack(receipt string) error {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	node, ok := q.reserved[receipt]
+	if !ok {
+		return ErrUnknownReceipt
+	}
+
+	q.deleteNode(node)
+	q.Length--
+	q.broadcast()
+
+	return nil
+}
+
+// Nack cancels the reservation with the receipt, so that the value is
+// visible again immediately. The value delivered for MaxDeliveries times
+// is moved into the dead-letter queue instead.
+func (q *Queue) Nack(receipt string) error {
+	q.Mutex.Lock()
+	if q.closed {
+		q.Mutex.Unlock()
+		return ErrClosed
+	}
+
+	node, ok := q.reserved[receipt]
+	if !ok {
+		q.Mutex.Unlock()
+		return ErrUnknownReceipt
+	}
+
+	delete(q.reserved, receipt)
+	node.Receipt = ""
+	node.InvisibleUntil = time.Time{}
+	q.touchNode(node)
+	q.broadcast()
+	dead := q.dead(node, time.Now())
+	q.Mutex.Unlock()
+
+	if dead {
+		q.routeDead()
+	}
+
+	return nil
+}
+
+// InFlight returns the number of the reserved values in queue,
+// including the ones which are timed out but not reserved again.
+func (q *Queue) InFlight() int {
+	q.Mutex.RLock()
+	defer q.Mutex.RUnlock()
+
+	return len(q.reserved)
+}
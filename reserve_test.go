@@ -0,0 +1,129 @@
+package mtque
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	queue := NewQueue()
+	queue.EnQueue(1)
+	queue.EnQueue(2)
+
+	v, receipt, err := queue.Reserve(time.Hour)
+	if err != nil || v != 1 {
+		t.Fatal("Reserve error:", v, err)
+	}
+
+	t.Run("Invisible", func(t *testing.T) {
+		if v, _ := queue.GetHead(); v != 2 {
+			t.Fatal("GetHead should skip the reserved value:", v)
+		}
+		if queue.InFlight() != 1 || queue.Len() != 2 {
+			t.Fatal("Wrong state:", queue.InFlight(), queue.Len())
+		}
+	})
+
+	t.Run("Nack", func(t *testing.T) {
+		if err := queue.Nack(receipt); err != nil {
+			t.Fatal("Nack error:", err)
+		}
+		if err := queue.Nack(receipt); err != ErrUnknownReceipt {
+			t.Fatal("Nack twice should fail:", err)
+		}
+		if v, _ := queue.GetHead(); v != 1 {
+			t.Fatal("The nacked value should be visible:", v)
+		}
+	})
+
+	t.Run("Ack", func(t *testing.T) {
+		v, receipt, _ := queue.Reserve(time.Hour)
+		if v != 1 {
+			t.Fatal("Wrong value:", v)
+		}
+		if err := queue.Ack(receipt); err != nil {
+			t.Fatal("Ack error:", err)
+		}
+		if err := queue.Ack(receipt); err != ErrUnknownReceipt {
+			t.Fatal("Ack twice should fail:", err)
+		}
+		if queue.Len() != 1 || queue.InFlight() != 0 {
+			t.Fatal("Wrong state:", queue.Len(), queue.InFlight())
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		v, receipt, _ := queue.Reserve(20 * time.Millisecond)
+		if _, err := queue.DeQueue(); err == nil {
+			t.Fatal("DeQueue a reserved value")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		again, _, err := queue.ReserveWait(ctx, time.Hour)
+		if err != nil || again != v {
+			t.Fatal("The value should be delivered again after timeout:", again, err)
+		}
+		if err := queue.Ack(receipt); err != ErrUnknownReceipt {
+			t.Fatal("The old receipt should be invalid:", err)
+		}
+	})
+}
+
+func TestReserveRecovery(t *testing.T) {
+	os.Remove("./queue_reserve")
+
+	queue := NewQueue(
+		SetQueueFile("./queue_reserve"),
+		SetQueuePersistenceControl(true),
+	)
+	queue.EnQueue(1)
+	queue.EnQueue(2)
+	queue.EnQueue(3)
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := os.Stat("./queue_reserve")
+	_, receipt, _ := queue.Reserve(time.Hour)
+	queue.Ack(receipt)
+	queue.Reserve(50 * time.Millisecond)
+	_, receipt, _ = queue.Reserve(time.Hour)
+	queue.Nack(receipt)
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat("./queue_reserve"); !os.SameFile(before, after) {
+		t.Fatal("The reservations should be persisted without rewriting the file")
+	}
+	DestroyQueue("./queue_reserve")
+
+	recovered := NewQueue(
+		SetQueueFile("./queue_reserve"),
+		SetQueueRecoveryControl(true),
+		SetQueueDecoder(func(decode func(interface{}) error) (interface{}, error) {
+			var value int
+			err := decode(&value)
+			return value, err
+		}),
+	)
+	defer DestroyQueue("./queue_reserve")
+	if err := recovered.Recovery(); err != nil {
+		t.Fatal(err)
+	}
+
+	if recovered.Len() != 2 || recovered.InFlight() != 1 {
+		t.Fatal("Recovery error:", recovered.Len(), recovered.InFlight())
+	}
+	if v, _ := recovered.DeQueue(); v != 3 {
+		t.Fatal("The reserved value should stay invisible:", v)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if v, err := recovered.DeQueueWait(ctx); err != nil || v != 2 {
+		t.Fatal("The unacked value should be delivered again:", v, err)
+	}
+}
@@ -0,0 +1,112 @@
+package mtque
+
+import (
+	"sync"
+	"time"
+)
+
+// periodicPersister is the buffer persisted periodically by the scheduler.
+type periodicPersister interface {
+	GetPersistencePeriod() time.Duration
+	PeriodicallyPersistent()
+}
+
+// scheduler persists the buffers periodically, every buffer has its own
+// timer reset by the persistence period of the buffer. No goroutine is
+// running until a buffer is scheduled.
+type scheduler struct {
+	mutex   sync.Mutex
+	timers  map[periodicPersister]*time.Timer
+	running sync.WaitGroup
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		timers: make(map[periodicPersister]*time.Timer),
+	}
+}
+
+// StopScheduler stops the periodic persistence of all the queues and
+// stacks of the default Manager, it waits for the running persistence to
+// finish. The scheduler starts again when a buffer is scheduled, e.g. by
+// setting a file.
+func StopScheduler() {
+	defaultManager.StopScheduler()
+}
+
+// period returns the persistence period of buffer, or the default
+// period if it is not set.
+func period(p periodicPersister) time.Duration {
+	period := p.GetPersistencePeriod()
+	if period <= 0 {
+		period = DEFAULT_PERIOD_PERSISTENCE_TIME
+	}
+
+	return period
+}
+
+// schedule starts persisting the buffer periodically. If the buffer is
+// scheduled already, its timer is reset by the current period, so it
+// should be called again after changing the period.
+func (s *scheduler) schedule(p periodicPersister) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if timer, ok := s.timers[p]; ok {
+		timer.Reset(period(p))
+		return
+	}
+
+	s.timers[p] = time.AfterFunc(period(p), func() {
+		s.fire(p)
+	})
+}
+
+// reschedule resets the timer of buffer if it is scheduled.
+func (s *scheduler) reschedule(p periodicPersister) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if timer, ok := s.timers[p]; ok {
+		timer.Reset(period(p))
+	}
+}
+
+// unschedule stops persisting the buffer periodically.
+func (s *scheduler) unschedule(p periodicPersister) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if timer, ok := s.timers[p]; ok {
+		timer.Stop()
+		delete(s.timers, p)
+	}
+}
+
+// stop unschedules all the buffers and waits for the running persistence.
+func (s *scheduler) stop() {
+	s.mutex.Lock()
+	for p, timer := range s.timers {
+		timer.Stop()
+		delete(s.timers, p)
+	}
+	s.mutex.Unlock()
+
+	s.running.Wait()
+}
+
+// fire persists the buffer and resets its timer for the next period.
+func (s *scheduler) fire(p periodicPersister) {
+	s.mutex.Lock()
+	if _, ok := s.timers[p]; !ok {
+		s.mutex.Unlock()
+		return
+	}
+	s.running.Add(1)
+	s.mutex.Unlock()
+
+	p.PeriodicallyPersistent()
+	s.running.Done()
+
+	s.reschedule(p)
+}
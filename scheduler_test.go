@@ -0,0 +1,80 @@
+package mtque
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingPersister struct {
+	period atomic.Int64
+	count  atomic.Int64
+}
+
+func (c *countingPersister) GetPersistencePeriod() time.Duration {
+	return time.Duration(c.period.Load())
+}
+
+func (c *countingPersister) PeriodicallyPersistent() {
+	c.count.Add(1)
+}
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler()
+	p := &countingPersister{}
+	p.period.Store(int64(time.Hour))
+
+	s.schedule(p)
+	time.Sleep(20 * time.Millisecond)
+	if p.count.Load() != 0 {
+		t.Fatal("Persisted before the period:", p.count.Load())
+	}
+
+	t.Run("Reschedule", func(t *testing.T) {
+		p.period.Store(int64(5 * time.Millisecond))
+		s.reschedule(p)
+		time.Sleep(50 * time.Millisecond)
+		if p.count.Load() < 2 {
+			t.Fatal("Should persist every period:", p.count.Load())
+		}
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		s.stop()
+		count := p.count.Load()
+		time.Sleep(20 * time.Millisecond)
+		if p.count.Load() != count {
+			t.Fatal("Persisted after stopped:", count, p.count.Load())
+		}
+	})
+}
+
+func TestQueueScheduled(t *testing.T) {
+	os.Remove("./queue_scheduled")
+
+	queue := NewQueue(
+		SetQueueFile("./queue_scheduled"),
+		SetQueuePersistenceControl(true),
+	)
+	queue.SetPersistencePeriod(5 * time.Millisecond)
+	queue.EnQueue(1)
+	time.Sleep(30 * time.Millisecond)
+	DestroyQueue("./queue_scheduled")
+
+	buf := NewBuffer(
+		SetBufferFile("./queue_scheduled"),
+		SetBufferRecoveryControl(true),
+		SetBufferDecoder(func(decode func(interface{}) error) (interface{}, error) {
+			var value int
+			err := decode(&value)
+			return value, err
+		}),
+	)
+	if err := buf.Recovery(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 1 {
+		t.Fatal("The queue should be persisted by the scheduler:", buf.Len())
+	}
+}
@@ -0,0 +1,436 @@
+package mtque
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DEFAULT_COMPACTION_THRESHOLD is the default ratio of the dead space
+// in file to trigger the compaction.
+const DEFAULT_COMPACTION_THRESHOLD = 0.5
+
+// segmentStorage stores the header in the file, and the records in
+// the segment files in the directory named after it.
+type segmentStorage struct {
+	*fileStorage
+	segments *segments
+}
+
+// NewSegmentStorage returns a Storage which stores the header in the file,
+// and the records in the segment files of the size in the directory named
+// name + ".segments", the segments are deleted once all the records in
+// them are deleted.
+func NewSegmentStorage(name string, size int64) Storage {
+	return &segmentStorage{
+		fileStorage: &fileStorage{name: name},
+		segments:    newSegments(name, size),
+	}
+}
+
+func (s *segmentStorage) Append(record []byte, end int64) (int64, error) {
+	return appendRecord(s.segments, record, end)
+}
+
+func (s *segmentStorage) Read(pos, end int64) ([]byte, int64, error) {
+	return readRecord(s.segments, pos, end, true)
+}
+
+// Delete deletes the segment files which hold no record from start to end.
+func (s *segmentStorage) Delete(start, end int64) error {
+	return s.segments.remove(start, end)
+}
+
+// Garbage returns the ratio of the dead space in the segment holding
+// start, the segments before it are deleted already.
+func (s *segmentStorage) Garbage(start, end int64) float64 {
+	if start < BUFFER_INFO_SIZE {
+		return 0
+	}
+
+	return garbage(s.segments.start(s.segments.index(start)), start, end)
+}
+
+// Rewrite writes the records into the segments after the one holding end,
+// and a new file of header, which replaces the file at commit.
+func (s *segmentStorage) Rewrite(end int64) (Rewriter, error) {
+	w, err := s.fileStorage.Rewrite(end)
+	if err != nil {
+		return nil, err
+	}
+
+	start := int64(BUFFER_INFO_SIZE)
+	if end > BUFFER_INFO_SIZE {
+		start = s.segments.start(s.segments.index(end-1) + 1)
+	}
+
+	return &segmentRewriter{fileRewriter: w.(*fileRewriter), segments: s.segments, start: start}, nil
+}
+
+func (s *segmentStorage) Sync() error {
+	if err := s.segments.Sync(); err != nil {
+		return err
+	}
+
+	return s.fileStorage.Sync()
+}
+
+func (s *segmentStorage) Close() error {
+	err := s.segments.Close()
+	if e := s.fileStorage.Close(); e != nil && err == nil {
+		err = e
+	}
+
+	return err
+}
+
+func (s *segmentStorage) Remove() error {
+	if err := s.segments.remove(0, 0); err != nil {
+		return err
+	}
+
+	err := os.Remove(segmentDir(s.name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return s.fileStorage.Remove()
+}
+
+// segmentRewriter writes the records into the segments from start,
+// and the header into the new file.
+type segmentRewriter struct {
+	*fileRewriter
+	segments *segments
+	start    int64
+}
+
+func (w *segmentRewriter) Start() int64 {
+	return w.start
+}
+
+func (w *segmentRewriter) Append(record []byte, end int64) (int64, error) {
+	return appendRecord(w.segments, record, end)
+}
+
+// Commit syncs the segments before replacing the file of header.
+func (w *segmentRewriter) Commit() error {
+	if err := w.segments.Sync(); err != nil {
+		return err
+	}
+
+	return w.fileRewriter.Commit()
+}
+
+// segments stores the records of buffer in a series of segment files
+// in the directory of segments, the nth one is named n as 8 digits with
+// the suffix ".seg". The records are addressed by the offsets as if they were stored after
+// the buffer info in a single file, so that the segment n holds the
+// bytes from BUFFER_INFO_SIZE+n*size to BUFFER_INFO_SIZE+(n+1)*size.
+type segments struct {
+	file  string
+	size  int64
+	files map[int64]*os.File
+}
+
+func newSegments(file string, size int64) *segments {
+	return &segments{
+		file:  file,
+		size:  size,
+		files: make(map[int64]*os.File),
+	}
+}
+
+// segmentDir returns the directory of the segment files of the file.
+func segmentDir(file string) string {
+	return file + ".segments"
+}
+
+// segmentPattern returns the pattern matching all the segment files.
+func segmentPattern(file string) string {
+	return filepath.Join(segmentDir(file), "*.seg")
+}
+
+// name returns the path of the nth segment file.
+func (s *segments) name(n int64) string {
+	return filepath.Join(segmentDir(s.file), fmt.Sprintf("%08d.seg", n))
+}
+
+// index returns the index of the segment holding the offset.
+func (s *segments) index(off int64) int64 {
+	return (off - BUFFER_INFO_SIZE) / s.size
+}
+
+// start returns the offset of the beginning of the nth segment.
+func (s *segments) start(n int64) int64 {
+	return BUFFER_INFO_SIZE + n*s.size
+}
+
+// open returns the opened nth segment file, it is created if write is set.
+// The directories are synced after creating it, so that it is not lost
+// with the records synced into it at crashing.
+func (s *segments) open(n int64, write bool) (*os.File, error) {
+	if f, ok := s.files[n]; ok {
+		return f, nil
+	}
+
+	f, err := os.OpenFile(s.name(n), os.O_RDWR, 0644)
+	if os.IsNotExist(err) && write {
+		f, err = s.create(n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.files[n] = f
+
+	return f, nil
+}
+
+// create creates the nth segment file, and the directory of segments
+// if it does not exist.
+func (s *segments) create(n int64) (*os.File, error) {
+	dir := segmentDir(s.file)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(s.name(n), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syncDir(dir)
+	if err == nil {
+		err = syncDir(filepath.Dir(dir))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// each calls fn with the segment files and their parts for the bytes
+// from off to off+size.
+func (s *segments) each(off int64, size int, write bool, fn func(f *os.File, from, to int, at int64) (int, error)) (int, error) {
+	done := 0
+	for done < size {
+		n := s.index(off + int64(done))
+		at := off + int64(done) - s.start(n)
+		to := done + int(min(int64(size-done), s.size-at))
+
+		f, err := s.open(n, write)
+		if err != nil {
+			return done, err
+		}
+		m, err := fn(f, done, to, at)
+		done += m
+		if err != nil {
+			return done, err
+		}
+	}
+
+	return done, nil
+}
+
+func (s *segments) ReadAt(p []byte, off int64) (int, error) {
+	return s.each(off, len(p), false, func(f *os.File, from, to int, at int64) (int, error) {
+		return f.ReadAt(p[from:to], at)
+	})
+}
+
+func (s *segments) WriteAt(p []byte, off int64) (int, error) {
+	return s.each(off, len(p), true, func(f *os.File, from, to int, at int64) (int, error) {
+		return f.WriteAt(p[from:to], at)
+	})
+}
+
+func (s *segments) Sync() error {
+	for _, f := range s.files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *segments) Close() error {
+	var err error
+	for n, f := range s.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(s.files, n)
+	}
+
+	return err
+}
+
+// remove deletes the segment files which hold no byte from start to end.
+func (s *segments) remove(start, end int64) error {
+	names, err := filepath.Glob(segmentPattern(s.file))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		n, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if start < end && s.start(n) < end && s.start(n+1) > start {
+			continue
+		}
+
+		if f, ok := s.files[n]; ok {
+			f.Close()
+			delete(s.files, n)
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compactable returns whether the dead space in the storage, see the
+// Garbage of Storage, exceeds CompactionThreshold of the space used.
+// The Mutex should be held by the caller.
+func (b *Buffer) compactable(store Storage) bool {
+	if b.CompactionThreshold <= 0 {
+		return false
+	}
+
+	return store.Garbage(b.FileStartSeek, b.FileEndSeek) > b.CompactionThreshold
+}
+
+// fragmented returns whether the dead space between FileStartSeek and
+// FileEndSeek, which is held by the delta records and the records of the
+// nodes deleted by them, exceeds CompactionThreshold of the space.
+// The Mutex should be held by the caller.
+func (b *Buffer) fragmented() bool {
+	used := b.FileEndSeek - b.FileStartSeek
+	if b.CompactionThreshold <= 0 || used <= 0 {
+		return false
+	}
+
+	return float64(used-b.live)/float64(used) > b.CompactionThreshold
+}
+
+// Compact rewrites the datas into a new file or new segments, so that
+// the dead space in them is reclaimed. It is run automatically at the
+// persistence when the dead space exceeds the CompactionThreshold.
+func (b *Buffer) Compact() error {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	if b.File == "" {
+		return fmt.Errorf("the file to persistent datas is not specified")
+	}
+
+	return b.rewritePersistent()
+}
+
+func SetBufferSegmentSize(size int64) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.SegmentSize = size
+	}
+}
+
+func SetBufferCompactionThreshold(threshold float64) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.CompactionThreshold = threshold
+	}
+}
+
+// SetQueueSegmentSize makes the queue store the records in segment files
+// of the size, the segments are deleted once all the records in them
+// are consumed. 0 means a single file, which is the default.
+// The segment size of an existing file is kept at recovering.
+func SetQueueSegmentSize(size int64) func(*Queue) {
+	return func(queue *Queue) {
+		queue.SegmentSize = size
+	}
+}
+
+// SetQueueCompactionThreshold set the ratio of the dead space in file
+// to trigger the compaction at persistence, 0 disables the compaction.
+// The default threshold is DEFAULT_COMPACTION_THRESHOLD.
+func SetQueueCompactionThreshold(threshold float64) func(*Queue) {
+	return func(queue *Queue) {
+		queue.CompactionThreshold = threshold
+	}
+}
+
+// SetStackSegmentSize makes the stack store the records in segment
+// files of the size, see SetQueueSegmentSize.
+func SetStackSegmentSize(size int64) func(*Stack) {
+	return func(stack *Stack) {
+		stack.SegmentSize = size
+	}
+}
+
+// SetStackCompactionThreshold set the ratio of the dead space in file
+// to trigger the compaction, see SetQueueCompactionThreshold.
+func SetStackCompactionThreshold(threshold float64) func(*Stack) {
+	return func(stack *Stack) {
+		stack.CompactionThreshold = threshold
+	}
+}
+
+// SetPriorityQueueSegmentSize makes the priority queue store the records
+// in segment files of the size, see SetQueueSegmentSize.
+func SetPriorityQueueSegmentSize(size int64) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.SegmentSize = size
+	}
+}
+
+// SetPriorityQueueCompactionThreshold set the ratio of the dead space in
+// file to trigger the compaction, see SetQueueCompactionThreshold.
+func SetPriorityQueueCompactionThreshold(threshold float64) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.CompactionThreshold = threshold
+	}
+}
+
+// SetDelayQueueSegmentSize makes the delay queue store the records
+// in segment files of the size, see SetQueueSegmentSize.
+func SetDelayQueueSegmentSize(size int64) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.SegmentSize = size
+	}
+}
+
+// SetDelayQueueCompactionThreshold set the ratio of the dead space in
+// file to trigger the compaction, see SetQueueCompactionThreshold.
+func SetDelayQueueCompactionThreshold(threshold float64) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.CompactionThreshold = threshold
+	}
+}
+
+// SetDequeSegmentSize makes the deque store the records
+// in segment files of the size, see SetQueueSegmentSize.
+func SetDequeSegmentSize(size int64) func(*Deque) {
+	return func(deque *Deque) {
+		deque.SegmentSize = size
+	}
+}
+
+// SetDequeCompactionThreshold set the ratio of the dead space in
+// file to trigger the compaction, see SetQueueCompactionThreshold.
+func SetDequeCompactionThreshold(threshold float64) func(*Deque) {
+	return func(deque *Deque) {
+		deque.CompactionThreshold = threshold
+	}
+}
@@ -0,0 +1,166 @@
+package mtque
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSegments(t *testing.T) {
+	NewSegmentStorage("./queue_segments", 64).Remove()
+
+	queue := NewQueue(
+		SetQueueFile("./queue_segments"),
+		SetQueuePersistenceControl(true),
+		SetQueueSegmentSize(64),
+		SetQueueCompactionThreshold(0),
+	)
+	defer DestroyQueue("./queue_segments")
+
+	for i := 0; i < 20; i++ {
+		queue.EnQueue(i)
+	}
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, _ := filepath.Glob(segmentPattern("./queue_segments"))
+	total := len(names)
+	if total < 2 || filepath.Dir(names[0]) != filepath.Clean(segmentDir("./queue_segments")) {
+		t.Fatal("The records should be stored in segments in their directory:", names)
+	}
+	if info, _ := os.Stat("./queue_segments"); info.Size() != BUFFER_INFO_SIZE {
+		t.Fatal("The file should hold the buffer info only:", info.Size())
+	}
+
+	for i := 0; i < 15; i++ {
+		queue.DeQueue()
+	}
+	if err := queue.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ = filepath.Glob(segmentPattern("./queue_segments")); len(names) >= total {
+		t.Fatal("The consumed segments should be deleted:", names)
+	}
+
+	t.Run("Recovery", func(t *testing.T) {
+		buf := NewBuffer(
+			SetBufferFile("./queue_segments"),
+			SetBufferRecoveryControl(true),
+			SetBufferDecoder(func(decode func(interface{}) error) (interface{}, error) {
+				var value int
+				err := decode(&value)
+				return value, err
+			}),
+		)
+		if err := buf.Recovery(); err != nil {
+			t.Fatal(err)
+		}
+		if v := linkValues(buf); len(v) != 5 || v[0] != 15 || v[4] != 19 {
+			t.Fatal("Wrong values:", v)
+		}
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		start := queue.FileEndSeek
+		if err := queue.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if queue.FileStartSeek < start {
+			t.Fatal("The records should be rewritten into new segments:", queue.FileStartSeek, start)
+		}
+
+		queue.EnQueue(20)
+		if err := queue.Persistent(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 15; i <= 20; i++ {
+			if v, err := queue.DeQueue(); err != nil || v != i {
+				t.Fatal("Wrong value:", v, err)
+			}
+		}
+		if err := queue.Persistent(); err != nil {
+			t.Fatal(err)
+		}
+		if names, _ := filepath.Glob(segmentPattern("./queue_segments")); len(names) != 0 {
+			t.Fatal("All the segments should be deleted:", names)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		if err := NewSegmentStorage("./queue_segments", 64).Remove(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(segmentDir("./queue_segments")); !os.IsNotExist(err) {
+			t.Fatal("The directory of segments should be deleted:", err)
+		}
+	})
+}
+
+func TestCompaction(t *testing.T) {
+	os.Remove("./queue_compaction")
+
+	queue := NewQueue(
+		SetQueueFile("./queue_compaction"),
+		SetQueuePersistenceControl(true),
+	)
+	defer DestroyQueue("./queue_compaction")
+
+	for i := 0; i < 10; i++ {
+		queue.EnQueue(i)
+	}
+	queue.Persistent()
+
+	for i := 0; i < 4; i++ {
+		queue.DeQueue()
+	}
+	queue.Persistent()
+	if queue.FileStartSeek == BUFFER_INFO_SIZE {
+		t.Fatal("The file should not be compacted under the threshold")
+	}
+
+	for i := 0; i < 2; i++ {
+		queue.DeQueue()
+	}
+	queue.Persistent()
+	if queue.FileStartSeek != BUFFER_INFO_SIZE {
+		t.Fatal("The file should be compacted over the threshold:", queue.FileStartSeek)
+	}
+	if info, _ := os.Stat("./queue_compaction"); info.Size() != queue.FileEndSeek {
+		t.Fatal("The dead space should be reclaimed:", info.Size(), queue.FileEndSeek)
+	}
+}
+
+func TestCompactionDeltas(t *testing.T) {
+	os.Remove("./queue_compaction_deltas")
+
+	queue := NewQueue(
+		SetQueueFile("./queue_compaction_deltas"),
+		SetQueuePersistenceControl(true),
+	)
+	defer DestroyQueue("./queue_compaction_deltas")
+
+	for i := 0; i < 10; i++ {
+		queue.EnQueue(i)
+	}
+	queue.Persistent()
+
+	compacted := 0
+	for i := 0; i < 20; i++ {
+		_, receipt, _ := queue.Reserve(time.Hour)
+		queue.Nack(receipt)
+
+		before, _ := os.Stat("./queue_compaction_deltas")
+		if err := queue.Persistent(); err != nil {
+			t.Fatal(err)
+		}
+		if after, _ := os.Stat("./queue_compaction_deltas"); !os.SameFile(before, after) {
+			compacted++
+		}
+	}
+
+	if compacted == 0 || compacted == 20 {
+		t.Fatal("The file should be compacted only when the delta records exceed the threshold:", compacted)
+	}
+}
@@ -0,0 +1,328 @@
+package mtque
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DEFAULT_SHARED_LOCK_TIMEOUT is the default time to wait for the lock
+// of file held by other processes operating the shared queue.
+const DEFAULT_SHARED_LOCK_TIMEOUT = 10 * time.Second
+
+// SharedQueue is a queue persisted in a file which is shared by the
+// processes on one host. It keeps nothing in memory, every operation
+// takes the lock of file, reads the buffer info from the file, moves
+// FileStartSeek or FileEndSeek and writes the buffer info back before
+// releasing the lock, so a value is dequeued by exactly one process.
+// The file can not be shared with a Queue or Stack bound to it, which
+// holds the lock until it is closed.
+type SharedQueue struct {
+	// buf holds the options of queue, and the buffer info
+	// read from the file in the operation.
+	buf   Buffer
+	mutex sync.Mutex
+}
+
+// SetSharedQueueCodec set the codec to encode the values in a new file,
+// the codec of an existing file is always used.
+func SetSharedQueueCodec(codec Codec) func(*SharedQueue) {
+	return func(queue *SharedQueue) {
+		queue.buf.Codec = codec
+	}
+}
+
+// SetSharedQueueRegister set the type to rebuild the values dequeued,
+// the types registered by RegisterType take precedence over it.
+func SetSharedQueueRegister(datatype interface{}) func(*SharedQueue) {
+	return func(queue *SharedQueue) {
+		queue.buf.Register = datatype
+	}
+}
+
+// SetSharedQueueDecoder set the function to rebuild the values dequeued.
+func SetSharedQueueDecoder(decoder DecodeFunc) func(*SharedQueue) {
+	return func(queue *SharedQueue) {
+		queue.buf.Decoder = decoder
+	}
+}
+
+// SetSharedQueueLockTimeout set how long to wait for the lock of file held
+// by other processes, the default one is DEFAULT_SHARED_LOCK_TIMEOUT.
+func SetSharedQueueLockTimeout(timeout time.Duration) func(*SharedQueue) {
+	return func(queue *SharedQueue) {
+		queue.buf.LockTimeout = timeout
+	}
+}
+
+// SetSharedQueueSegmentSize makes a new file store the records in
+// segment files of the size, see SetQueueSegmentSize.
+func SetSharedQueueSegmentSize(size int64) func(*SharedQueue) {
+	return func(queue *SharedQueue) {
+		queue.buf.SegmentSize = size
+	}
+}
+
+// SetSharedQueueCompactionThreshold set the ratio of the dead space in
+// file to trigger the compaction, see SetQueueCompactionThreshold.
+func SetSharedQueueCompactionThreshold(threshold float64) func(*SharedQueue) {
+	return func(queue *SharedQueue) {
+		queue.buf.CompactionThreshold = threshold
+	}
+}
+
+// SetSharedQueueCorruptionPolicy set the policy applied to the corrupt
+// records found at dequeuing, see SetQueueCorruptionPolicy.
+func SetSharedQueueCorruptionPolicy(policy CorruptionPolicy) func(*SharedQueue) {
+	return func(queue *SharedQueue) {
+		queue.buf.Corruption = policy
+	}
+}
+
+// NewSharedQueue is the constructor of SharedQueue on the file, the
+// file is created at the first EnQueue if it does not exist.
+func NewSharedQueue(file string, opts ...func(*SharedQueue)) *SharedQueue {
+	queue := new(SharedQueue)
+	queue.buf.init()
+	queue.buf.File = file
+	queue.buf.LockTimeout = DEFAULT_SHARED_LOCK_TIMEOUT
+
+	for _, opt := range opts {
+		opt(queue)
+	}
+
+	return queue
+}
+
+// GetFile returns the file of shared queue.
+func (q *SharedQueue) GetFile() string {
+	return q.buf.File
+}
+
+// EnQueue appends the value at the end of file.
+func (q *SharedQueue) EnQueue(value interface{}) error {
+	return q.locked(func(store Storage) error {
+		record, err := NewDataNode(value).record(q.buf.codec())
+		if err != nil {
+			return err
+		}
+
+		q.buf.FileEndSeek, err = store.Append(record, q.buf.FileEndSeek)
+		if err != nil {
+			return err
+		}
+		q.buf.Length++
+
+		return q.writeInfo(store)
+	})
+}
+
+// DeQueue removes the value at the head of file and returns it.
+func (q *SharedQueue) DeQueue() (interface{}, error) {
+	var value interface{}
+
+	err := q.locked(func(store Storage) error {
+		node, err := q.next(store)
+		if err != nil {
+			return err
+		}
+		value = node.Value
+
+		if q.buf.FileStartSeek >= q.buf.FileEndSeek {
+			q.buf.FileStartSeek = BUFFER_INFO_SIZE
+			q.buf.FileEndSeek = BUFFER_INFO_SIZE
+		} else if q.buf.compactable(store) {
+			return q.compact(store)
+		}
+
+		err = q.writeInfo(store)
+		if err != nil {
+			return err
+		}
+
+		return store.Delete(q.buf.FileStartSeek, q.buf.FileEndSeek)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// Len returns the number of values in the shared queue.
+func (q *SharedQueue) Len() (int64, error) {
+	var length int64
+
+	err := q.locked(func(store Storage) error {
+		length = q.buf.Length
+		return nil
+	})
+
+	return length, err
+}
+
+// locked calls fn with the storage of file, under the lock of file and
+// with the buffer info read from it.
+func (q *SharedQueue) locked(fn func(store Storage) error) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	lock, err := lockFile(q.buf.File, q.buf.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	err = q.readInfo()
+	if err != nil {
+		return err
+	}
+
+	store := q.buf.storage()
+	defer store.Close()
+
+	return fn(store)
+}
+
+// readInfo reads the buffer info and the codec from the file, or sets
+// up the ones of a new file if it does not exist.
+func (q *SharedQueue) readInfo() error {
+	store := NewFileStorage(q.buf.File)
+	defer store.Close()
+
+	data := make([]byte, BUFFER_INFO_SIZE)
+	n, err := store.ReadHeader(data)
+	if os.IsNotExist(err) {
+		size := q.buf.SegmentSize
+		q.buf.BufferInfo = *NewBufferInfo()
+		q.buf.SegmentSize = size
+		q.buf.FileStartSeek = BUFFER_INFO_SIZE
+		q.buf.FileEndSeek = BUFFER_INFO_SIZE
+		return nil
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	info, legacy, err := decodeBufferInfo(data[:n])
+	if err != nil {
+		return fmt.Errorf("buffer info is corrupt: %v", err)
+	}
+	if legacy || info.Deltas {
+		return q.upgrade()
+	}
+	codec, err := q.buf.lookupCodec(info.CodecName)
+	if err != nil {
+		return err
+	}
+
+	q.buf.BufferInfo = info
+	q.buf.Codec = codec
+
+	return nil
+}
+
+// upgrade replaces the file of legacy format, or the file with the delta
+// records written by a Queue, with a new file of the records of nodes
+// only, the file is never written in place.
+func (q *SharedQueue) upgrade() error {
+	err := q.buf.recoveryFile()
+	if err == nil {
+		err = q.buf.rewritePersistent()
+	}
+	q.buf.Datas = NewDataLink()
+	q.buf.reserved = nil
+
+	return err
+}
+
+// writeInfo writes the buffer info into the file.
+func (q *SharedQueue) writeInfo(store Storage) error {
+	q.buf.CodecName = q.buf.codec().Name()
+	info, err := q.buf.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return store.WriteHeader(info)
+}
+
+// next reads the record at the head of file and moves FileStartSeek
+// after it. The corrupt records are dropped by the CorruptionPolicy.
+func (q *SharedQueue) next(store Storage) (*DataNode, error) {
+	for q.buf.FileStartSeek < q.buf.FileEndSeek {
+		node, seek, err := q.buf.recoveryData(store, q.buf.FileStartSeek)
+		if err == nil {
+			q.buf.FileStartSeek = seek
+			q.buf.Length--
+			return node, nil
+		}
+
+		switch {
+		case q.buf.Corruption == CorruptionSkipBad && seek > q.buf.FileStartSeek:
+			q.buf.FileStartSeek = seek
+			q.buf.Length--
+		case q.buf.Corruption != CorruptionStrict:
+			q.buf.FileStartSeek = q.buf.FileEndSeek
+			q.buf.Length = 0
+		default:
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("queue is empty")
+}
+
+// compact copies the records in use to the beginning of a new file or
+// new segments, and writes the buffer info with them. The corrupt records
+// are dropped by the CorruptionPolicy like the ones dequeued.
+func (q *SharedQueue) compact(store Storage) error {
+	rewriter, err := store.Rewrite(q.buf.FileEndSeek)
+	if err != nil {
+		return err
+	}
+	defer rewriter.Abort()
+
+	var length int64
+	start := rewriter.Start()
+	end := start
+	for pos := q.buf.FileStartSeek; pos < q.buf.FileEndSeek; {
+		record, next, err := store.Read(pos, q.buf.FileEndSeek)
+		switch {
+		case err == nil:
+			end, err = rewriter.Append(record, end)
+			if err != nil {
+				return err
+			}
+			length++
+		case q.buf.Corruption == CorruptionSkipBad && next > pos:
+		case q.buf.Corruption != CorruptionStrict:
+			next = q.buf.FileEndSeek
+		default:
+			return err
+		}
+		pos = next
+	}
+	q.buf.FileStartSeek, q.buf.FileEndSeek = start, end
+	q.buf.Length = length
+
+	q.buf.CodecName = q.buf.codec().Name()
+	info, err := q.buf.Bytes()
+	if err != nil {
+		return err
+	}
+
+	err = rewriter.WriteHeader(info)
+	if err != nil {
+		return err
+	}
+
+	err = rewriter.Commit()
+	if err != nil {
+		return err
+	}
+
+	return store.Delete(q.buf.FileStartSeek, q.buf.FileEndSeek)
+}
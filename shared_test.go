@@ -0,0 +1,196 @@
+package mtque
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func intSharedQueue(file string, opts ...func(*SharedQueue)) *SharedQueue {
+	return NewSharedQueue(file, append([]func(*SharedQueue){SetSharedQueueRegister(0)}, opts...)...)
+}
+
+func removeSharedQueue(file string) {
+	os.Remove(file)
+	os.Remove(file + ".lock")
+}
+
+func TestSharedQueue(t *testing.T) {
+	removeSharedQueue("./queue_shared")
+	defer removeSharedQueue("./queue_shared")
+
+	producer := intSharedQueue("./queue_shared")
+	consumer := intSharedQueue("./queue_shared")
+
+	if _, err := consumer.DeQueue(); err == nil {
+		t.Fatal("Dequeue from an empty shared queue should fail")
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := producer.EnQueue(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := consumer.Len(); err != nil || n != 10 {
+		t.Fatal("Wrong length:", n, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		q := []*SharedQueue{producer, consumer}[i%2]
+		if v, err := q.DeQueue(); err != nil || v != i {
+			t.Fatal("Wrong value:", v, err)
+		}
+	}
+
+	if info, _ := os.Stat("./queue_shared"); info.Size() != BUFFER_INFO_SIZE {
+		t.Fatal("The file should be truncated after consuming all:", info.Size())
+	}
+
+	t.Run("Compaction", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			producer.EnQueue(i)
+		}
+		for i := 0; i < 6; i++ {
+			consumer.DeQueue()
+		}
+		if consumer.buf.FileStartSeek != BUFFER_INFO_SIZE {
+			t.Fatal("The file should be compacted:", consumer.buf.FileStartSeek)
+		}
+		for i := 6; i < 10; i++ {
+			if v, err := producer.DeQueue(); err != nil || v != i {
+				t.Fatal("Wrong value after compacting:", v, err)
+			}
+		}
+	})
+
+	t.Run("Legacy", func(t *testing.T) {
+		writeLegacyFile(t, "./queue_shared", legacyInfoSize, 1, 2)
+
+		if v, err := consumer.DeQueue(); err != nil || v != 1 {
+			t.Fatal("Wrong value of the legacy file:", v, err)
+		}
+		if data, _ := os.ReadFile("./queue_shared"); !bytes.HasPrefix(data, []byte(HEADER_MAGIC)) {
+			t.Fatal("The legacy file should be upgraded")
+		}
+		if v, err := producer.DeQueue(); err != nil || v != 2 {
+			t.Fatal("Wrong value after upgrading:", v, err)
+		}
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		queue := NewQueue(SetQueueFile("./queue_shared"))
+		defer DestroyQueue("./queue_shared")
+
+		_, err := intSharedQueue("./queue_shared", SetSharedQueueLockTimeout(0)).Len()
+		if !errors.Is(err, ErrLocked) {
+			t.Fatal("The file bound to a Queue should not be shared:", err, queue.GetFile())
+		}
+	})
+}
+
+func TestSharedQueueConsumers(t *testing.T) {
+	removeSharedQueue("./queue_shared_consumers")
+	defer removeSharedQueue("./queue_shared_consumers")
+
+	const total = 200
+	producer := intSharedQueue("./queue_shared_consumers")
+	for i := 0; i < total; i++ {
+		producer.EnQueue(i)
+	}
+
+	var mutex sync.Mutex
+	seen := make(map[int]int)
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			consumer := intSharedQueue("./queue_shared_consumers")
+			for {
+				v, err := consumer.DeQueue()
+				if err != nil {
+					return
+				}
+				mutex.Lock()
+				seen[v.(int)]++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < total; i++ {
+		if seen[i] != 1 {
+			t.Fatalf("Value %d is delivered %d times", i, seen[i])
+		}
+	}
+}
+
+// TestSharedQueueProcess is run by TestSharedQueueProcesses in the worker
+// processes, it prints the values dequeued.
+func TestSharedQueueProcess(t *testing.T) {
+	file := os.Getenv("MTQUE_SHARED_QUEUE")
+	if file == "" {
+		t.Skip("run by TestSharedQueueProcesses")
+	}
+
+	consumer := intSharedQueue(file)
+	for {
+		v, err := consumer.DeQueue()
+		if err != nil {
+			return
+		}
+		fmt.Println("value", v)
+	}
+}
+
+func TestSharedQueueProcesses(t *testing.T) {
+	removeSharedQueue("./queue_shared_processes")
+	defer removeSharedQueue("./queue_shared_processes")
+
+	const total = 300
+	producer := intSharedQueue("./queue_shared_processes")
+	for i := 0; i < total; i++ {
+		producer.EnQueue(i)
+	}
+
+	var cmds []*exec.Cmd
+	var outputs []*strings.Builder
+	for i := 0; i < 3; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSharedQueueProcess$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "MTQUE_SHARED_QUEUE=./queue_shared_processes")
+		output := new(strings.Builder)
+		cmd.Stdout = output
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, cmd)
+		outputs = append(outputs, output)
+	}
+
+	seen := make(map[int]int)
+	for i, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatal(err, outputs[i].String())
+		}
+		for _, line := range strings.Split(outputs[i].String(), "\n") {
+			if v, ok := strings.CutPrefix(line, "value "); ok {
+				n, _ := strconv.Atoi(v)
+				seen[n]++
+			}
+		}
+	}
+
+	for i := 0; i < total; i++ {
+		if seen[i] != 1 {
+			t.Fatalf("Value %d is delivered %d times", i, seen[i])
+		}
+	}
+}
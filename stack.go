@@ -1,9 +1,10 @@
 package mtque
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"sync"
+	"reflect"
 	"time"
 )
 
@@ -11,29 +12,11 @@ type Stack struct {
 	Buffer
 }
 
-var (
-	stackList  map[string]*Stack
-	stackMutex sync.RWMutex
-)
-
-func init() {
-	stackList = make(map[string]*Stack)
-	stackMutex = sync.RWMutex{}
-
-	go func() {
-		for {
-			for _, stack := range stackList {
-				go stack.PeriodicallyPersistent()
-			}
-		}
-	}()
-}
-
 func newStack() *Stack {
-	buffer := NewBuffer()
-	stack := Stack{Buffer: *buffer}
+	stack := new(Stack)
+	stack.init()
 
-	return &stack
+	return stack
 }
 
 // SetStackFile set a file for stack persistence
@@ -78,35 +61,19 @@ func SetStackRecoveryControl(ctl bool) func(*Stack) {
 // NewStack is the constructor of Stack.
 // When use NewStack to construct a stack, you can
 // use option functions to set the options of stack.
+// If the file is locked by another process, or failed to recover
+// from it, the stack is not bound to the file, use OpenStack to
+// get the error.
+// The stack is owned by the default Manager.
 func NewStack(opts ...func(*Stack)) *Stack {
-	stack := newStack()
-	for _, opt := range opts {
-		opt(stack)
-	}
-
-	if stack.File != "" {
-		stackMutex.Lock()
-		defer stackMutex.Unlock()
-
-		if stk, ok := stackList[stack.File]; ok {
-			stack = stk
-		} else {
-			stackList[stack.File] = stack
-		}
-
-		if !stack.PersistenceControl {
-			stack.PersistenceControl = true
-		}
-		if stack.PersistencePeriod == 0 {
-			stack.PersistencePeriod = DEFAULT_PERIOD_PERSISTENCE_TIME
-		}
-
-		if stack.RecoveryControl {
-			stack.Recovery()
-		}
-	}
+	return defaultManager.NewStack(opts...)
+}
 
-	return stack
+// OpenStack works like NewStack, but it returns an error wrapping
+// ErrLocked if the file is locked by another process, or the error
+// of recovering from the file with CorruptionStrict.
+func OpenStack(opts ...func(*Stack)) (*Stack, error) {
+	return defaultManager.OpenStack(opts...)
 }
 
 // GetStack will try to findout an already existed stack through the file.
@@ -114,90 +81,216 @@ func NewStack(opts ...func(*Stack)) *Stack {
 // one from the file. If recovery failed, it will construct a new one,
 // and set persistence and recovery control as true.
 func GetStack(file string) *Stack {
-	stackMutex.RLock()
-	if stack, ok := stackList[file]; ok {
-		return stack
-	}
-	defer stackMutex.RUnlock()
-
-	return NewStack(
-		SetStackFile(file),
-		SetStackPersistenceControl(true),
-		SetStackRecoveryControl(true),
-	)
+	return defaultManager.GetStack(file)
 }
 
 // DestroyStack will destroy the stack in the stack list
 // And then delete the persistence file for the stack.
 func DestroyStack(file string) {
-	stackMutex.Lock()
-	defer stackMutex.Unlock()
+	defaultManager.DestroyStack(file)
+}
 
-	if _, ok := stackList[file]; ok {
-		delete(stackList, file)
-		os.Remove(file)
+// SetStackDecoder set the function to rebuild the values at
+// recovering the stack from file. Without a decoder, values
+// are rebuilt as the type of the first value added.
+func SetStackDecoder(decoder DecodeFunc) func(*Stack) {
+	return func(stack *Stack) {
+		stack.Decoder = decoder
 	}
+}
 
+// SetStackValueType set the type of the values in stack, the stack
+// bound to the file can only be handed over to by the stacks of the
+// same value type, see ForceSetFile.
+func SetStackValueType(typ reflect.Type) func(*Stack) {
+	return func(stack *Stack) {
+		stack.ValueType = typ
+	}
 }
 
-// SetPersistencePeriod set persistence period for stack.
-func (s *Stack) SetPersistencePeriod(p time.Duration) {
+// SetStackTTL set the default time to live of the values in stack.
+// The expired values are skipped by the stack and evicted in background.
+// 0 means the values never expire, which is the default.
+func SetStackTTL(ttl time.Duration) func(*Stack) {
+	return func(stack *Stack) {
+		stack.TTL = ttl
+	}
+}
+
+// SetStackExpiredHandler set the function which is called with
+// the values evicted from the stack for expiring.
+func SetStackExpiredHandler(handler func(value interface{})) func(*Stack) {
+	return func(stack *Stack) {
+		stack.ExpiredHandler = handler
+	}
+}
+
+// SetStackExpiredQueue set a queue to receive the values evicted
+// from the stack for expiring.
+func SetStackExpiredQueue(target *Queue) func(*Stack) {
+	return SetStackExpiredHandler(func(value interface{}) {
+		target.TryEnQueue(value)
+	})
+}
+
+// SetStackCapacity set the max number of values in the stack.
+// 0 means the stack is unlimited, which is the default.
+func SetStackCapacity(capacity int64) func(*Stack) {
+	return func(stack *Stack) {
+		stack.Capacity = capacity
+	}
+}
+
+// SetStackOverflowPolicy set the policy applied when adding a value
+// into a full stack. The default policy is OverflowBlock.
+func SetStackOverflowPolicy(policy OverflowPolicy) func(*Stack) {
+	return func(stack *Stack) {
+		stack.Overflow = policy
+	}
+}
+
+// SetCapacity set the max number of values in the stack.
+func (s *Stack) SetCapacity(capacity int64) {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
 
+	s.Capacity = capacity
+	s.broadcast()
+}
+
+// GetCapacity returns the max number of values in the stack.
+func (s *Stack) GetCapacity() int64 {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	return s.Capacity
+}
+
+// SetPersistencePeriod set persistence period for stack.
+func (s *Stack) SetPersistencePeriod(p time.Duration) {
+	s.Mutex.Lock()
 	s.PersistencePeriod = p
+	s.Mutex.Unlock()
+
+	s.manager().scheduler.reschedule(s)
 }
 
 // SetFile will set the persistence file for stack.
 func (s *Stack) SetFile(file string) error {
-	if s.File != "" && file == s.File {
+	m := s.manager()
+
+	s.Mutex.RLock()
+	current := s.File
+	s.Mutex.RUnlock()
+
+	if current != "" && file == current {
 		return nil
-	} else if s.File != "" && file != s.File {
-		return fmt.Errorf("the new file:[%s] != the exist one[%s], you should use the ForceSetFile method to reset it. And should notice that if the recovery mode is enabled, the stack will be recoverd from the new file", file, s.File)
+	} else if current != "" && file != current {
+		return fmt.Errorf("the new file:[%s] != the exist one[%s], you should use the ForceSetFile method to reset it. And should notice that if the recovery mode is enabled, the stack will be recoverd from the new file", file, current)
 	}
 
-	if _, ok := stackList[file]; ok {
+	if _, ok := m.lookupStack(file); ok {
 		return fmt.Errorf("there is already a stack with file [%s] in stacklist, use the ForceSetFile method to reset current one", file)
 	}
 
-	s.File = file
-	stackList[file] = s
+	// the lock is waited without holding the mutexes, so the
+	// registry is checked again after it.
+	lock, err := s.acquireLock(file)
 
-	if s.RecoveryControl {
-		s.Recovery()
+	m.stackMutex.Lock()
+	defer m.stackMutex.Unlock()
+
+	if _, ok := m.stacks[file]; ok {
+		unlockFile(lock)
+		return fmt.Errorf("there is already a stack with file [%s] in stacklist, use the ForceSetFile method to reset current one", file)
+	}
+	if err != nil {
+		return err
 	}
 
-	s.PersistenceControl = true
-	if s.PersistencePeriod == 0 {
-		s.PersistencePeriod = DEFAULT_PERIOD_PERSISTENCE_TIME
+	s.Mutex.Lock()
+	if s.File != "" {
+		s.Mutex.Unlock()
+		unlockFile(lock)
+		return fmt.Errorf("the stack is bound to another file, use the ForceSetFile method to reset it")
+	}
+	err = s.bindFile(file, lock)
+	s.Mutex.Unlock()
+	if err != nil {
+		return err
 	}
+	m.stacks[file] = s
+	m.scheduler.schedule(s)
 
 	return nil
 }
 
-func (s *Stack) ForceSetFile(file string) error {
-	if stack, ok := stackList[file]; ok {
-		s = stack
-		return nil
+// ForceSetFile binds the stack to the file even if it is bound to another
+// one, and sets up the datas by the mode. If the file is bound to another
+// stack in the Manager, the datas are moved into that one by the mode, and
+// the stack is unbound and left empty. It returns the stack bound to the
+// file, which should be used from now on. The file bound before is left as
+// it was persisted last time. It fails with ErrValueType if the stack bound
+// to the file holds the values of another ValueType.
+func (s *Stack) ForceSetFile(file string, mode RebindMode) (*Stack, error) {
+	m := s.manager()
+
+	// the lock is taken whenever the file is not bound under the mutex,
+	// it is waited without holding the mutexes, so the registry is
+	// checked again after it.
+	var lock *os.File
+	var err error
+	m.stackMutex.Lock()
+	if _, ok := m.stacks[file]; !ok {
+		m.stackMutex.Unlock()
+		lock, err = s.acquireLock(file)
+		m.stackMutex.Lock()
 	}
+	defer m.stackMutex.Unlock()
 
-	if s.File != "" {
-		delete(stackList, s.File)
+	if stack, ok := m.stacks[file]; ok {
+		unlockFile(lock)
+		if stack == s {
+			return s, nil
+		}
+
+		s.Mutex.Lock()
+		stack.Mutex.Lock()
+		old := s.File
+		err = s.handOver(&stack.Buffer, mode)
+		stack.Mutex.Unlock()
+		s.Mutex.Unlock()
+		if err != nil {
+			return s, err
+		}
+
+		if old != "" && m.stacks[old] == s {
+			delete(m.stacks, old)
+		}
+		m.scheduler.unschedule(s)
+
+		return stack, nil
 	}
 
-	s.File = file
-	stackList[file] = s
+	if err != nil {
+		return s, err
+	}
 
-	if s.RecoveryControl {
-		s.Recovery()
+	s.Mutex.Lock()
+	old := s.File
+	err = s.rebind(file, mode, lock)
+	s.Mutex.Unlock()
+	if err != nil {
+		return s, err
 	}
 
-	s.PersistenceControl = true
-	if s.PersistencePeriod == 0 {
-		s.PersistencePeriod = DEFAULT_PERIOD_PERSISTENCE_TIME
+	if old != "" && m.stacks[old] == s {
+		delete(m.stacks, old)
 	}
+	m.stacks[file] = s
+	m.scheduler.schedule(s)
 
-	return nil
+	return s, nil
 }
 
 // SetPersistenceControl enable/disable the persistence control for stack.
@@ -249,63 +342,164 @@ func (s *Stack) GetFile() string {
 }
 
 // GetTail will return the value at stack tail without
-// delete the value from stack.
+// delete the value from stack. The expired values are skipped.
 // If the stack is empty, it will return an error.
 func (s *Stack) GetTail() (interface{}, error) {
 	s.Mutex.RLock()
 	defer s.Mutex.RUnlock()
 
-	if s.Length == 0 {
-		return nil, fmt.Errorf("stack is empty")
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	now := time.Now()
+	for node := s.Datas.Tail; node != nil; node = node.Previous {
+		if !node.expired(now) {
+			return node.Value, nil
+		}
 	}
 
-	return s.Datas.GetTailValue()
+	return nil, fmt.Errorf("stack is empty")
 }
 
 // Push will push a value at tail of stack
-func (s *Stack) Push(value interface{}) {
+// If the stack is full, the overflow policy of the stack is applied,
+// and with OverflowBlock it will block until there is free space.
+func (s *Stack) Push(value interface{}) error {
+	return s.PushWait(context.Background(), value)
+}
+
+// PushWithTTL works like Push, but the value will expire
+// after the ttl instead of the default TTL of stack.
+func (s *Stack) PushWithTTL(value interface{}, ttl time.Duration) error {
+	return s.pushWait(context.Background(), value, ttl)
+}
+
+// TryPush works like Push but never blocks. If the stack is full
+// and the overflow policy is OverflowBlock, ErrFull is returned.
+func (s *Stack) TryPush(value interface{}) error {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
 
-	node := NewDataNode(value)
-	s.Datas.AddNodeAtTail(node)
+	return s.push(value, 0)
+}
+
+// PushWait works like Push, but if the stack is full and the overflow
+// policy is OverflowBlock, it will only block until the ctx is done.
+func (s *Stack) PushWait(ctx context.Context, value interface{}) error {
+	return s.pushWait(ctx, value, 0)
+}
+
+func (s *Stack) pushWait(ctx context.Context, value interface{}, ttl time.Duration) error {
+	for {
+		s.Mutex.Lock()
+		if s.closed || !s.full() || s.Overflow != OverflowBlock {
+			err := s.push(value, ttl)
+			s.Mutex.Unlock()
+			return err
+		}
+		wait := s.waitChan()
+		s.Mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// push adds a value at the tail of stack with the overflow policy,
+// the value expires after the ttl, or the default TTL if ttl is 0.
+// The Mutex should be held by the caller.
+func (s *Stack) push(value interface{}, ttl time.Duration) error {
+	if s.closed {
+		return ErrClosed
+	}
+
+	add, err := s.makeRoom()
+	if !add {
+		return err
+	}
+
+	node := s.newNode(value, ttl)
+	s.addNodeAtTail(node)
 	s.Length++
 
 	if s.Length == 1 {
 		s.SetRegister(value)
 	}
+
+	s.broadcast()
+
+	return nil
 }
 
 // Pop will pop the value at the tail of stack out.
 // It will also delete it from the stack.
+// The expired values at the tail are evicted.
 func (s *Stack) Pop() (interface{}, error) {
 	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
+	expired := s.expireAtTail()
+	value, err := s.pop()
+	s.Mutex.Unlock()
 
-	if s.Length == 0 {
-		return nil, fmt.Errorf("stack is empty")
+	s.routeExpired(expired)
+
+	return value, err
+}
+
+// PopWait works like Pop, but it will block the caller when the
+// stack is empty, until a value is pushed or the ctx is done.
+// If the ctx is done before getting a value, the error of ctx is returned.
+func (s *Stack) PopWait(ctx context.Context) (interface{}, error) {
+	for {
+		s.Mutex.Lock()
+		expired := s.expireAtTail()
+		if s.closed || s.Length > 0 {
+			value, err := s.pop()
+			s.Mutex.Unlock()
+			s.routeExpired(expired)
+			return value, err
+		}
+		wait := s.waitChan()
+		s.Mutex.Unlock()
+		s.routeExpired(expired)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wait:
+		}
 	}
+}
 
-	value, err := s.Datas.GetTailValue()
-	if err == nil {
-		s.Datas.DeleteNodeAtTail()
-		s.Length--
+// pop removes the value at the tail of stack and returns it.
+// The Mutex should be held by the caller.
+func (s *Stack) pop() (interface{}, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	node := s.Datas.Tail
+	if node == nil {
+		return nil, fmt.Errorf("stack is empty")
 	}
 
-	return value, err
+	s.deleteNode(node)
+	s.Length--
+	s.broadcast()
+
+	return node.Value, nil
 }
 
 func (s *Stack) Persistent() error {
 	return s.Buffer.Persistent()
 }
 
+// PeriodicallyPersistent persists the stack if the persistence control
+// is enabled, it is called by the scheduler every persistence period.
 func (s *Stack) PeriodicallyPersistent() {
-	if s.PersistenceControl && !s.persRunning {
-		s.persRunning = true
-		select {
-		case <-time.After(s.PersistencePeriod):
-			s.Persistent()
-		}
-		s.persRunning = false
+	if s.GetPersistenceControl() {
+		s.Persistent()
 	}
 }
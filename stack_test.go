@@ -1,17 +1,19 @@
 package mtque
 
 import (
+	"context"
 	"testing"
 	"time"
 )
 
 func TestNewEmptyStack(t *testing.T) {
-	stack := NewStack()
+	m := NewManager()
+	stack := m.NewStack()
 	if stack == nil {
 		t.Fatal("Construct a new empty stack fail!")
 	}
 
-	if len(stackList) > 0 {
+	if len(m.stacks) > 0 {
 		t.Fatal("Initailize the stack list wrong!")
 	}
 }
@@ -188,3 +190,117 @@ func TestRecovery(t *testing.T) {
 		t.Fatal("Wrong value:", v)
 	}
 }
+
+func TestPopWait(t *testing.T) {
+	stack := NewStack()
+
+	t.Run("Wakeup", func(t *testing.T) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			stack.Push(1)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		v, err := stack.PopWait(ctx)
+		if err != nil {
+			t.Fatal("PopWait error:", err)
+		}
+		if v != 1 {
+			t.Fatal("Wrong value:", v)
+		}
+	})
+	t.Run("Deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := stack.PopWait(ctx)
+		if err != context.DeadlineExceeded {
+			t.Fatal("PopWait should be stopped by the deadline:", err)
+		}
+	})
+	t.Run("Cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+
+		_, err := stack.PopWait(ctx)
+		if err != context.Canceled {
+			t.Fatal("PopWait should be stopped by cancel:", err)
+		}
+	})
+}
+
+func TestStackCapacity(t *testing.T) {
+	t.Run("OverflowFail", func(t *testing.T) {
+		stack := NewStack(SetStackCapacity(2), SetStackOverflowPolicy(OverflowFail))
+
+		stack.Push(1)
+		stack.Push(2)
+		if err := stack.Push(3); err != ErrFull {
+			t.Fatal("Push into a full stack should fail:", err)
+		}
+		if stack.Len() != 2 {
+			t.Fatal("Wrong length:", stack.Len())
+		}
+	})
+	t.Run("OverflowDropNewest", func(t *testing.T) {
+		stack := NewStack(SetStackCapacity(2), SetStackOverflowPolicy(OverflowDropNewest))
+
+		stack.Push(1)
+		stack.Push(2)
+		if err := stack.Push(3); err != nil {
+			t.Fatal("Push error:", err)
+		}
+
+		v1, _ := stack.Pop()
+		v2, _ := stack.Pop()
+		if v1 != 2 || v2 != 1 || stack.Len() != 0 {
+			t.Fatal("The newest value should be dropped:", v1, v2)
+		}
+	})
+	t.Run("OverflowDropOldest", func(t *testing.T) {
+		stack := NewStack(SetStackCapacity(2), SetStackOverflowPolicy(OverflowDropOldest))
+
+		stack.Push(1)
+		stack.Push(2)
+		if err := stack.Push(3); err != nil {
+			t.Fatal("Push error:", err)
+		}
+
+		v1, _ := stack.Pop()
+		v2, _ := stack.Pop()
+		if v1 != 3 || v2 != 2 || stack.Len() != 0 {
+			t.Fatal("The oldest value should be dropped:", v1, v2)
+		}
+	})
+	t.Run("OverflowBlock", func(t *testing.T) {
+		stack := NewStack(SetStackCapacity(1))
+
+		stack.Push(1)
+		if err := stack.TryPush(2); err != ErrFull {
+			t.Fatal("TryPush into a full stack should fail:", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := stack.PushWait(ctx, 2); err != context.DeadlineExceeded {
+			t.Fatal("PushWait should be stopped by the deadline:", err)
+		}
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			stack.Pop()
+		}()
+
+		if err := stack.Push(2); err != nil {
+			t.Fatal("Push error:", err)
+		}
+		if v, _ := stack.GetTail(); v != 2 {
+			t.Fatal("Wrong value:", v)
+		}
+	})
+}
@@ -0,0 +1,512 @@
+package mtque
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage stores the header and the records of a buffer. The records are
+// kept in the order they are appended, and addressed by their positions,
+// which are assigned by the storage, the buffer only keeps them to pass
+// back. The position of the first record appended into an empty storage
+// is BUFFER_INFO_SIZE. The positions of records in use, from the start to
+// the end, are checkpointed in the header.
+// The File of buffer is still the name of it, which the write-ahead log
+// is named after and kept in the file system with any Storage.
+type Storage interface {
+	// ReadHeader reads the header into p, an error satisfying
+	// os.IsNotExist is returned if there is nothing stored.
+	ReadHeader(p []byte) (int, error)
+	// WriteHeader replaces the header with p.
+	WriteHeader(p []byte) error
+
+	// Append stores the record at end, which is the end of the records,
+	// and returns the position after it, which is the new end.
+	Append(record []byte, end int64) (int64, error)
+	// Read returns the record at pos of the records ending at end, and
+	// the position of the next record. If the record is corrupt, the error
+	// is returned with the position of the next record, or pos if it can
+	// not be located.
+	Read(pos, end int64) ([]byte, int64, error)
+	// Delete discards the records out of the range from start to end.
+	Delete(start, end int64) error
+	// Garbage returns the ratio of the space held by the records before
+	// start, which is only reclaimed by rewriting, to the space held by
+	// the records before end.
+	Garbage(start, end int64) float64
+	// Rewrite starts writing all the records again, which replace the
+	// records before end at the commit of the returned Rewriter.
+	Rewrite(end int64) (Rewriter, error)
+
+	// Sync commits the written header and records to the stable storage.
+	Sync() error
+	// Close releases the resources held by the storage, the storage
+	// can still be used after it.
+	Close() error
+	// Remove deletes the header and all the records.
+	Remove() error
+}
+
+// Rewriter appends the records from Start and writes the header without
+// touching the ones stored, and replaces them atomically at Commit.
+type Rewriter interface {
+	Start() int64
+	Append(record []byte, end int64) (int64, error)
+	WriteHeader(p []byte) error
+	// Commit syncs the rewritten header and records to the stable
+	// storage, and then replaces the stored ones with them.
+	Commit() error
+	// Abort discards the rewritten header and records, it does nothing
+	// after Commit.
+	Abort() error
+}
+
+// storage returns the Storage of buffer, it is a file storage or a segment
+// storage named by the File if not set. The returned storage should be
+// closed after using it.
+// The Mutex should be held by the caller.
+func (b *Buffer) storage() Storage {
+	if b.Storage != nil {
+		return b.Storage
+	}
+	if b.SegmentSize > 0 {
+		return NewSegmentStorage(b.File, b.SegmentSize)
+	}
+
+	// the records of legacy format in the file have no crc.
+	return &fileStorage{name: b.File, legacy: !b.Checksum}
+}
+
+// removePersistence deletes the header and records of buffer
+// from the storage, and the write-ahead log.
+// The Mutex should be held by the caller.
+func (b *Buffer) removePersistence() error {
+	store := b.storage()
+	defer store.Close()
+
+	err := os.Remove(b.walFile())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return store.Remove()
+}
+
+// fileStorage stores the header at the beginning of the file, and
+// the records after it. The position of a record is its offset in the
+// file, where it is stored as |len|data|crc|.
+type fileStorage struct {
+	name string
+	file *os.File
+	// legacy is set if the records in the file have no crc.
+	legacy bool
+}
+
+// NewFileStorage returns a Storage which stores the header and the
+// records in the file, it is the default Storage of buffer.
+func NewFileStorage(name string) Storage {
+	return &fileStorage{name: name}
+}
+
+// open returns the opened file, it is created if create is set.
+func (s *fileStorage) open(create bool) (*os.File, error) {
+	if s.file != nil {
+		return s.file, nil
+	}
+
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(s.name, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+
+	return f, nil
+}
+
+func (s *fileStorage) ReadHeader(p []byte) (int, error) {
+	f, err := s.open(false)
+	if err != nil {
+		return 0, err
+	}
+
+	return f.ReadAt(p, 0)
+}
+
+func (s *fileStorage) WriteHeader(p []byte) error {
+	f, err := s.open(true)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(p, 0)
+	return err
+}
+
+func (s *fileStorage) Append(record []byte, end int64) (int64, error) {
+	f, err := s.open(true)
+	if err != nil {
+		return end, err
+	}
+
+	return appendRecord(f, record, end)
+}
+
+func (s *fileStorage) Read(pos, end int64) ([]byte, int64, error) {
+	f, err := s.open(false)
+	if err != nil {
+		return nil, pos, err
+	}
+
+	return readRecord(f, pos, end, !s.legacy)
+}
+
+// Delete cuts the file at end, the dead space before start is only
+// reclaimed by rewriting.
+func (s *fileStorage) Delete(start, end int64) error {
+	f, err := s.open(true)
+	if err != nil {
+		return err
+	}
+
+	if start >= end {
+		end = BUFFER_INFO_SIZE
+	}
+
+	return f.Truncate(max(end, BUFFER_INFO_SIZE))
+}
+
+func (s *fileStorage) Garbage(start, end int64) float64 {
+	return garbage(BUFFER_INFO_SIZE, start, end)
+}
+
+// Rewrite writes a new file, which replaces the file at commit.
+func (s *fileStorage) Rewrite(end int64) (Rewriter, error) {
+	tmp := s.name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileRewriter{storage: s, tmp: tmp, file: f}, nil
+}
+
+func (s *fileStorage) Sync() error {
+	if s.file == nil {
+		return nil
+	}
+
+	return s.file.Sync()
+}
+
+func (s *fileStorage) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+func (s *fileStorage) Remove() error {
+	s.Close()
+
+	err := os.Remove(s.name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// appendRecord writes the record at the offset end as |len|data|crc|,
+// and returns the offset after it.
+func appendRecord(w io.WriterAt, record []byte, end int64) (int64, error) {
+	content, err := encodeRecord(record)
+	if err != nil {
+		return end, err
+	}
+
+	_, err = w.WriteAt(content, end)
+	if err != nil {
+		return end, err
+	}
+
+	return end + int64(len(content)), nil
+}
+
+// garbage returns the ratio of the dead bytes from base to start, to the
+// bytes from base to end.
+func garbage(base, start, end int64) float64 {
+	if start <= base || end <= base {
+		return 0
+	}
+
+	return float64(start-base) / float64(end-base)
+}
+
+// fileRewriter writes the header and the records into a temporary file,
+// and renames it to replace the file of storage at commit.
+type fileRewriter struct {
+	storage *fileStorage
+	tmp     string
+	file    *os.File
+}
+
+func (w *fileRewriter) Start() int64 {
+	return BUFFER_INFO_SIZE
+}
+
+func (w *fileRewriter) Append(record []byte, end int64) (int64, error) {
+	return appendRecord(w.file, record, end)
+}
+
+func (w *fileRewriter) WriteHeader(p []byte) error {
+	_, err := w.file.WriteAt(p, 0)
+	return err
+}
+
+// Commit syncs the new file before renaming it, and syncs the directory
+// after it, so that the file is replaced by a complete one at crashing.
+func (w *fileRewriter) Commit() error {
+	err := w.file.Sync()
+	if e := w.file.Close(); e != nil && err == nil {
+		err = e
+	}
+	w.file = nil
+	if err != nil {
+		os.Remove(w.tmp)
+		return err
+	}
+
+	w.storage.Close()
+	w.storage.legacy = false
+
+	err = os.Rename(w.tmp, w.storage.name)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(w.storage.name))
+}
+
+func (w *fileRewriter) Abort() error {
+	if w.file == nil {
+		return nil
+	}
+
+	w.file.Close()
+	w.file = nil
+
+	return os.Remove(w.tmp)
+}
+
+// syncDir syncs the directory, so that the files created, renamed or
+// deleted in it are persisted.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// memoryStorage keeps the header and the records in memory, the records
+// from base are kept in records. The position of a record is its index
+// in the records after base.
+type memoryStorage struct {
+	mutex   sync.Mutex
+	header  []byte
+	base    int64
+	records [][]byte
+}
+
+// NewMemoryStorage returns a Storage which keeps the header and the records
+// in memory. A buffer can be recovered from it by another buffer sharing it.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{base: BUFFER_INFO_SIZE}
+}
+
+func (s *memoryStorage) ReadHeader(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.header == nil {
+		return 0, os.ErrNotExist
+	}
+
+	n := copy(p, s.header)
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (s *memoryStorage) WriteHeader(p []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.header = append([]byte{}, p...)
+
+	return nil
+}
+
+func (s *memoryStorage) Append(record []byte, end int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the records from end are replaced, like the ones in file.
+	if end < s.base || end > s.base+int64(len(s.records)) {
+		s.base, s.records = end, nil
+	}
+	s.records = append(s.records[:end-s.base], append([]byte{}, record...))
+
+	return end + 1, nil
+}
+
+func (s *memoryStorage) Read(pos, end int64) ([]byte, int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if pos < s.base || pos >= end || pos >= s.base+int64(len(s.records)) {
+		return nil, pos, fmt.Errorf("record at position %d is not found", pos)
+	}
+
+	return append([]byte{}, s.records[pos-s.base]...), pos + 1, nil
+}
+
+func (s *memoryStorage) Delete(start, end int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if start >= end || start >= s.base+int64(len(s.records)) {
+		s.base, s.records = BUFFER_INFO_SIZE, nil
+		return nil
+	}
+
+	if end-s.base < int64(len(s.records)) {
+		s.records = s.records[:end-s.base]
+	}
+	if start > s.base {
+		s.records = append([][]byte{}, s.records[start-s.base:]...)
+		s.base = start
+	}
+
+	return nil
+}
+
+// Garbage returns 0, the records deleted are released at once.
+func (s *memoryStorage) Garbage(start, end int64) float64 {
+	return 0
+}
+
+func (s *memoryStorage) Rewrite(end int64) (Rewriter, error) {
+	return &memoryRewriter{storage: s, next: &memoryStorage{base: BUFFER_INFO_SIZE}}, nil
+}
+
+func (s *memoryStorage) Sync() error {
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+func (s *memoryStorage) Remove() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.header, s.base, s.records = nil, BUFFER_INFO_SIZE, nil
+
+	return nil
+}
+
+// memoryRewriter writes the header and the records into the next storage,
+// which replaces the content of storage at commit.
+type memoryRewriter struct {
+	storage *memoryStorage
+	next    *memoryStorage
+}
+
+func (w *memoryRewriter) Start() int64 {
+	return BUFFER_INFO_SIZE
+}
+
+func (w *memoryRewriter) Append(record []byte, end int64) (int64, error) {
+	return w.next.Append(record, end)
+}
+
+func (w *memoryRewriter) WriteHeader(p []byte) error {
+	return w.next.WriteHeader(p)
+}
+
+func (w *memoryRewriter) Commit() error {
+	w.storage.mutex.Lock()
+	defer w.storage.mutex.Unlock()
+
+	w.storage.header, w.storage.base, w.storage.records = w.next.header, w.next.base, w.next.records
+
+	return nil
+}
+
+func (w *memoryRewriter) Abort() error {
+	return nil
+}
+
+func SetBufferStorage(storage Storage) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.Storage = storage
+	}
+}
+
+// SetQueueStorage set the Storage to persist the queue, the default one
+// stores it in the file, or in the segment files if the segment size is
+// set. The file should still be set as the name of queue.
+func SetQueueStorage(storage Storage) func(*Queue) {
+	return func(queue *Queue) {
+		queue.Storage = storage
+	}
+}
+
+// SetStackStorage set the Storage to persist the stack,
+// see SetQueueStorage.
+func SetStackStorage(storage Storage) func(*Stack) {
+	return func(stack *Stack) {
+		stack.Storage = storage
+	}
+}
+
+// SetPriorityQueueStorage set the Storage to persist the priority queue,
+// see SetQueueStorage.
+func SetPriorityQueueStorage(storage Storage) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.Storage = storage
+	}
+}
+
+// SetDelayQueueStorage set the Storage to persist the delay queue,
+// see SetQueueStorage.
+func SetDelayQueueStorage(storage Storage) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.Storage = storage
+	}
+}
+
+// SetDequeStorage set the Storage to persist the deque,
+// see SetQueueStorage.
+func SetDequeStorage(storage Storage) func(*Deque) {
+	return func(deque *Deque) {
+		deque.Storage = storage
+	}
+}
@@ -0,0 +1,132 @@
+package mtque
+
+import (
+	"os"
+	"testing"
+)
+
+func TestStorage(t *testing.T) {
+	storages := map[string]func() Storage{
+		"File": func() Storage {
+			return NewFileStorage("./storage_file")
+		},
+		"Segment": func() Storage {
+			return NewSegmentStorage("./storage_segment", 16)
+		},
+		"Memory": func() func() Storage {
+			s := NewMemoryStorage()
+			return func() Storage { return s }
+		}(),
+	}
+
+	for name, open := range storages {
+		t.Run(name, func(t *testing.T) {
+			store := open()
+			store.Remove()
+			defer store.Remove()
+
+			if _, err := store.ReadHeader(make([]byte, 4)); !os.IsNotExist(err) {
+				t.Fatal("Empty storage should have no header:", err)
+			}
+
+			records := []string{"0123456789", "abcdefghij", "klmnopqrst", "uvwxyz"}
+			positions := []int64{BUFFER_INFO_SIZE}
+			for _, record := range records {
+				end, err := store.Append([]byte(record), positions[len(positions)-1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				positions = append(positions, end)
+			}
+			store.WriteHeader([]byte("head"))
+			store.Close()
+
+			store = open()
+			header := make([]byte, 4)
+			if _, err := store.ReadHeader(header); err != nil || string(header) != "head" {
+				t.Fatal("Wrong header:", string(header), err)
+			}
+
+			end := positions[len(positions)-1]
+			record, next, err := store.Read(positions[1], end)
+			if err != nil || string(record) != "abcdefghij" || next != positions[2] {
+				t.Fatal("Wrong record:", string(record), next, err)
+			}
+
+			if err := store.Delete(positions[2], positions[3]); err != nil {
+				t.Fatal(err)
+			}
+			end = positions[3]
+			if record, _, err := store.Read(positions[2], end); err != nil || string(record) != "klmnopqrst" {
+				t.Fatal("Wrong record after deleting:", string(record), err)
+			}
+			if _, _, err := store.Read(positions[3], end); err == nil {
+				t.Fatal("The record out of the records should not be read")
+			}
+
+			rewriter, err := store.Rewrite(end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := rewriter.Start()
+			end, err = rewriter.Append([]byte("rewritten"), start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rewriter.WriteHeader([]byte("next"))
+			if err := rewriter.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			rewriter.Abort()
+
+			if _, err := store.ReadHeader(header); err != nil || string(header) != "next" {
+				t.Fatal("Wrong header after rewriting:", string(header), err)
+			}
+			if record, next, err := store.Read(start, end); err != nil || string(record) != "rewritten" || next != end {
+				t.Fatal("Wrong record after rewriting:", string(record), err)
+			}
+			store.Close()
+		})
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	store := NewMemoryStorage()
+
+	queue := NewQueue(
+		SetQueueFile("memory_queue"),
+		SetQueueStorage(store),
+		SetQueuePersistenceControl(true),
+	)
+	defer DestroyQueue("memory_queue")
+
+	for i := 0; i < 10; i++ {
+		queue.EnQueue(i)
+	}
+	queue.Persistent()
+	for i := 0; i < 3; i++ {
+		queue.DeQueue()
+	}
+	queue.Persistent()
+
+	if _, err := os.Stat("memory_queue"); !os.IsNotExist(err) {
+		t.Fatal("The queue should not be persisted into the file")
+	}
+
+	buf := NewBuffer(
+		SetBufferFile("memory_queue"),
+		SetBufferStorage(store),
+		SetBufferRecoveryControl(true),
+		SetBufferDecoder(func(decode func(interface{}) error) (interface{}, error) {
+			var value int
+			err := decode(&value)
+			return value, err
+		}),
+	)
+	if err := buf.Recovery(); err != nil {
+		t.Fatal(err)
+	}
+	if v := linkValues(buf); len(v) != 7 || v[0] != 3 || v[6] != 9 {
+		t.Fatal("Wrong values:", v)
+	}
+}
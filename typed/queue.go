@@ -0,0 +1,129 @@
+package typed
+
+import (
+	"context"
+	"time"
+
+	"github.com/xingwangc/mtque"
+)
+
+// Queue is the type-safe version of mtque.Queue.
+type Queue[T any] struct {
+	*mtque.Queue
+}
+
+// NewQueue is the constructor of Queue, it accepts the
+// same options as mtque.NewQueue. If the file is bound to a queue
+// of values of another type, the queue is not bound to the file,
+// use OpenQueue to get the error.
+func NewQueue[T any](opts ...func(*mtque.Queue)) *Queue[T] {
+	queue := mtque.NewQueue(queueOptions[T](opts)...)
+	if bound[T](queue.ValueType, queue.GetFile()) != nil {
+		queue = mtque.NewQueue(append(queueOptions[T](opts), mtque.SetQueueFile(""))...)
+	}
+
+	return &Queue[T]{Queue: queue}
+}
+
+// OpenQueue works like NewQueue, but it returns the error of
+// mtque.OpenQueue, or an error wrapping mtque.ErrValueType if
+// the file is bound to a queue of values of another type.
+func OpenQueue[T any](opts ...func(*mtque.Queue)) (*Queue[T], error) {
+	queue, err := mtque.OpenQueue(queueOptions[T](opts)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := bound[T](queue.ValueType, queue.GetFile()); err != nil {
+		return nil, err
+	}
+
+	return &Queue[T]{Queue: queue}, nil
+}
+
+// queueOptions returns the options to construct a queue of values of T.
+func queueOptions[T any](opts []func(*mtque.Queue)) []func(*mtque.Queue) {
+	return append([]func(*mtque.Queue){
+		mtque.SetQueueDecoder(decoder[T]()),
+		mtque.SetQueueValueType(valueType[T]()),
+	}, opts...)
+}
+
+// ForceSetFile works like mtque.Queue.ForceSetFile, it returns the
+// queue bound to the file, which should be used from now on.
+func (q *Queue[T]) ForceSetFile(file string, mode mtque.RebindMode) (*Queue[T], error) {
+	queue, err := q.Queue.ForceSetFile(file, mode)
+	if queue == q.Queue {
+		return q, err
+	}
+
+	return &Queue[T]{Queue: queue}, err
+}
+
+// GetHead returns the value at the head of queue without removing it.
+func (q *Queue[T]) GetHead() (T, error) {
+	return cast[T](q.Queue.GetHead())
+}
+
+// EnQueue adds a value at the tail of queue.
+func (q *Queue[T]) EnQueue(value T) error {
+	return q.Queue.EnQueue(value)
+}
+
+// EnQueueWithTTL adds a value which expires after the ttl at the tail of queue.
+func (q *Queue[T]) EnQueueWithTTL(value T, ttl time.Duration) error {
+	return q.Queue.EnQueueWithTTL(value, ttl)
+}
+
+// TryEnQueue adds a value at the tail of queue without blocking.
+func (q *Queue[T]) TryEnQueue(value T) error {
+	return q.Queue.TryEnQueue(value)
+}
+
+// EnQueueWait adds a value at the tail of queue, it blocks until
+// the ctx is done if the queue is full.
+func (q *Queue[T]) EnQueueWait(ctx context.Context, value T) error {
+	return q.Queue.EnQueueWait(ctx, value)
+}
+
+// DeQueue removes the value at the head of queue and returns it.
+func (q *Queue[T]) DeQueue() (T, error) {
+	return cast[T](q.Queue.DeQueue())
+}
+
+// DeQueueWait removes the value at the head of queue and returns it,
+// it blocks until the ctx is done if the queue is empty.
+func (q *Queue[T]) DeQueueWait(ctx context.Context) (T, error) {
+	return cast[T](q.Queue.DeQueueWait(ctx))
+}
+
+// Reserve hides the value at the head of queue for the visibility
+// timeout and returns it with the receipt to Ack or Nack it.
+func (q *Queue[T]) Reserve(visibility time.Duration) (T, string, error) {
+	value, receipt, err := q.Queue.Reserve(visibility)
+	v, err := cast[T](value, err)
+	return v, receipt, err
+}
+
+// ReserveWait works like Reserve, it blocks until the ctx is done
+// if there is no available value.
+func (q *Queue[T]) ReserveWait(ctx context.Context, visibility time.Duration) (T, string, error) {
+	value, receipt, err := q.Queue.ReserveWait(ctx, visibility)
+	v, err := cast[T](value, err)
+	return v, receipt, err
+}
+
+// Values returns the available values in queue from head to tail,
+// an error is returned if any of them is not of type T.
+func (q *Queue[T]) Values() ([]T, error) {
+	values := q.Queue.Values()
+	typed := make([]T, 0, len(values))
+	for _, value := range values {
+		v, err := cast[T](value, nil)
+		if err != nil {
+			return nil, err
+		}
+		typed = append(typed, v)
+	}
+
+	return typed, nil
+}
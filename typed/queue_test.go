@@ -0,0 +1,152 @@
+package typed
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/xingwangc/mtque"
+)
+
+func TestQueue(t *testing.T) {
+	queue := NewQueue[TestData]()
+
+	queue.EnQueue(TestData{"AA", 1})
+	queue.EnQueue(TestData{"BB", 2})
+
+	head, err := queue.GetHead()
+	if err != nil || head.Name != "AA" {
+		t.Fatal("GetHead error:", head, err)
+	}
+
+	v, err := queue.DeQueue()
+	if err != nil || v.Name != "AA" {
+		t.Fatal("DeQueue error:", v, err)
+	}
+	v, err = queue.DeQueue()
+	if err != nil || v.Name != "BB" {
+		t.Fatal("DeQueue error:", v, err)
+	}
+
+	_, err = queue.DeQueue()
+	if err == nil {
+		t.Fatal("DeQueue from an empty queue should fail")
+	}
+}
+
+func TestQueueWait(t *testing.T) {
+	queue := NewQueue[int]()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		queue.EnQueue(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	v, err := queue.DeQueueWait(ctx)
+	if err != nil || v != 1 {
+		t.Fatal("DeQueueWait error:", v, err)
+	}
+}
+
+func TestQueueReserve(t *testing.T) {
+	queue := NewQueue[TestData]()
+	queue.EnQueue(TestData{"AA", 1})
+
+	v, receipt, err := queue.Reserve(time.Hour)
+	if err != nil || v.Name != "AA" {
+		t.Fatal("Reserve error:", v, err)
+	}
+	if err := queue.Ack(receipt); err != nil || queue.Len() != 0 {
+		t.Fatal("Ack error:", err, queue.Len())
+	}
+}
+
+func TestQueueValues(t *testing.T) {
+	queue := NewQueue[int]()
+	queue.EnQueue(1)
+	queue.EnQueue(2)
+
+	values, err := queue.Values()
+	if err != nil || len(values) != 2 || values[0] != 1 || values[1] != 2 {
+		t.Fatal("Values error:", values, err)
+	}
+
+	queue.Queue.EnQueue("three")
+	if values, err := queue.Values(); err == nil {
+		t.Fatal("Values with a value of another type should fail:", values)
+	}
+}
+
+func TestQueueBound(t *testing.T) {
+	untyped := mtque.NewQueue(mtque.SetQueueFile("./typed_queue_bound"))
+	defer mtque.DestroyQueue("./typed_queue_bound")
+	defer os.Remove("./typed_queue_bound")
+
+	if _, err := OpenQueue[int](mtque.SetQueueFile("./typed_queue_bound")); !errors.Is(err, mtque.ErrValueType) {
+		t.Fatal("Open the file bound to an untyped queue should fail:", err)
+	}
+	if queue := NewQueue[int](mtque.SetQueueFile("./typed_queue_bound")); queue.Queue == untyped || queue.GetFile() != "" {
+		t.Fatal("The queue should not be bound to the file:", queue.GetFile())
+	}
+
+	queue := NewQueue[int](mtque.SetQueueFile("./typed_queue_other"))
+	defer mtque.DestroyQueue("./typed_queue_other")
+	defer os.Remove("./typed_queue_other")
+	if again, err := OpenQueue[int](mtque.SetQueueFile("./typed_queue_other")); err != nil || again.Queue != queue.Queue {
+		t.Fatal("Open the file bound to a queue of the same type should return it:", err)
+	}
+
+	t.Run("ForceSetFile", func(t *testing.T) {
+		q := NewQueue[int]()
+		q.EnQueue(1)
+		if _, err := q.ForceSetFile("./typed_queue_bound", mtque.RebindMerge); !errors.Is(err, mtque.ErrValueType) {
+			t.Fatal("Hand over to an untyped queue should fail:", err)
+		}
+		if q.Len() != 1 || untyped.Len() != 0 {
+			t.Fatal("The values should be left:", q.Len(), untyped.Len())
+		}
+
+		bound, err := q.ForceSetFile("./typed_queue_other", mtque.RebindMerge)
+		if err != nil || bound.Queue != queue.Queue {
+			t.Fatal("Hand over to a queue of the same type error:", err)
+		}
+		if v, err := bound.DeQueue(); err != nil || v != 1 {
+			t.Fatal("Wrong value:", v, err)
+		}
+	})
+}
+
+// count is registered, and decoded as T if it is not a T.
+type count int
+
+func TestQueueRegisteredType(t *testing.T) {
+	mtque.RegisterType("typed.count", count(0))
+	os.Remove("./typed_queue_registered")
+
+	untyped := mtque.NewQueue(mtque.SetQueueFile("./typed_queue_registered"))
+	untyped.EnQueue(count(1))
+	untyped.EnQueue(count(2))
+	if err := untyped.Persistent(); err != nil {
+		t.Fatal(err)
+	}
+	mtque.DestroyQueue("./typed_queue_registered")
+	defer os.Remove("./typed_queue_registered")
+
+	queue, err := OpenQueue[int](
+		mtque.SetQueueFile("./typed_queue_registered"),
+		mtque.SetQueueRecoveryControl(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mtque.DestroyQueue("./typed_queue_registered")
+
+	values, err := queue.Values()
+	if err != nil || len(values) != 2 || values[0] != 1 || values[1] != 2 {
+		t.Fatal("The values of registered type should be rebuilt as int:", values, err)
+	}
+}
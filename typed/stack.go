@@ -0,0 +1,97 @@
+package typed
+
+import (
+	"context"
+	"time"
+
+	"github.com/xingwangc/mtque"
+)
+
+// Stack is the type-safe version of mtque.Stack.
+type Stack[T any] struct {
+	*mtque.Stack
+}
+
+// NewStack is the constructor of Stack, it accepts the
+// same options as mtque.NewStack. If the file is bound to a stack
+// of values of another type, the stack is not bound to the file,
+// use OpenStack to get the error.
+func NewStack[T any](opts ...func(*mtque.Stack)) *Stack[T] {
+	stack := mtque.NewStack(stackOptions[T](opts)...)
+	if bound[T](stack.ValueType, stack.GetFile()) != nil {
+		stack = mtque.NewStack(append(stackOptions[T](opts), mtque.SetStackFile(""))...)
+	}
+
+	return &Stack[T]{Stack: stack}
+}
+
+// OpenStack works like NewStack, but it returns the error of
+// mtque.OpenStack, or an error wrapping mtque.ErrValueType if
+// the file is bound to a stack of values of another type.
+func OpenStack[T any](opts ...func(*mtque.Stack)) (*Stack[T], error) {
+	stack, err := mtque.OpenStack(stackOptions[T](opts)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := bound[T](stack.ValueType, stack.GetFile()); err != nil {
+		return nil, err
+	}
+
+	return &Stack[T]{Stack: stack}, nil
+}
+
+// stackOptions returns the options to construct a stack of values of T.
+func stackOptions[T any](opts []func(*mtque.Stack)) []func(*mtque.Stack) {
+	return append([]func(*mtque.Stack){
+		mtque.SetStackDecoder(decoder[T]()),
+		mtque.SetStackValueType(valueType[T]()),
+	}, opts...)
+}
+
+// ForceSetFile works like mtque.Stack.ForceSetFile, it returns the
+// stack bound to the file, which should be used from now on.
+func (s *Stack[T]) ForceSetFile(file string, mode mtque.RebindMode) (*Stack[T], error) {
+	stack, err := s.Stack.ForceSetFile(file, mode)
+	if stack == s.Stack {
+		return s, err
+	}
+
+	return &Stack[T]{Stack: stack}, err
+}
+
+// GetTail returns the value at the tail of stack without removing it.
+func (s *Stack[T]) GetTail() (T, error) {
+	return cast[T](s.Stack.GetTail())
+}
+
+// Push pushes a value at the tail of stack.
+func (s *Stack[T]) Push(value T) error {
+	return s.Stack.Push(value)
+}
+
+// PushWithTTL pushes a value which expires after the ttl at the tail of stack.
+func (s *Stack[T]) PushWithTTL(value T, ttl time.Duration) error {
+	return s.Stack.PushWithTTL(value, ttl)
+}
+
+// TryPush pushes a value at the tail of stack without blocking.
+func (s *Stack[T]) TryPush(value T) error {
+	return s.Stack.TryPush(value)
+}
+
+// PushWait pushes a value at the tail of stack, it blocks until
+// the ctx is done if the stack is full.
+func (s *Stack[T]) PushWait(ctx context.Context, value T) error {
+	return s.Stack.PushWait(ctx, value)
+}
+
+// Pop removes the value at the tail of stack and returns it.
+func (s *Stack[T]) Pop() (T, error) {
+	return cast[T](s.Stack.Pop())
+}
+
+// PopWait removes the value at the tail of stack and returns it,
+// it blocks until the ctx is done if the stack is empty.
+func (s *Stack[T]) PopWait(ctx context.Context) (T, error) {
+	return cast[T](s.Stack.PopWait(ctx))
+}
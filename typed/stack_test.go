@@ -0,0 +1,55 @@
+package typed
+
+import (
+	"testing"
+
+	"github.com/xingwangc/mtque"
+)
+
+func TestStack(t *testing.T) {
+	stack := NewStack[string]()
+
+	stack.Push("a")
+	stack.Push("b")
+
+	tail, err := stack.GetTail()
+	if err != nil || tail != "b" {
+		t.Fatal("GetTail error:", tail, err)
+	}
+
+	v, err := stack.Pop()
+	if err != nil || v != "b" {
+		t.Fatal("Pop error:", v, err)
+	}
+	v, err = stack.Pop()
+	if err != nil || v != "a" {
+		t.Fatal("Pop error:", v, err)
+	}
+}
+
+func TestStackRecovery(t *testing.T) {
+	buf := NewBuffer[int](
+		mtque.SetBufferFile("./typed_stack"),
+		mtque.SetBufferPersistenceControl(true))
+
+	buf.AddDataAtTail(1)
+	buf.AddDataAtTail(2)
+
+	err := buf.Persistent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stack := NewStack[int](
+		mtque.SetStackFile("./typed_stack"),
+		mtque.SetStackRecoveryControl(true))
+
+	v, err := stack.Pop()
+	if err != nil || v != 2 {
+		t.Fatal("Pop error:", v, err)
+	}
+	v, err = stack.Pop()
+	if err != nil || v != 1 {
+		t.Fatal("Pop error:", v, err)
+	}
+}
@@ -0,0 +1,141 @@
+// Package typed provides the type-safe containers built on mtque.
+// Values are put in and taken out as T without type assertions, and
+// the persisted values are rebuilt as T at recovering.
+package typed
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/xingwangc/mtque"
+)
+
+// valueType returns the type T.
+func valueType[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// bound returns the error if the container bound to the file in the
+// Manager, which is returned instead of the one constructed, does not
+// hold the values of T, so the decoder of T is not installed into it.
+func bound[T any](typ reflect.Type, file string) error {
+	if typ == valueType[T]() {
+		return nil
+	}
+
+	return fmt.Errorf("%w: the file [%s] is bound to an instance of values of %v, not %v",
+		mtque.ErrValueType, file, typ, valueType[T]())
+}
+
+// decoder returns a DecodeFunc which rebuilds the persisted values as T.
+func decoder[T any]() mtque.DecodeFunc {
+	return func(decode func(ptr interface{}) error) (interface{}, error) {
+		var value T
+		err := decode(&value)
+
+		return value, err
+	}
+}
+
+// cast converts a value got from the underlying container to T.
+func cast[T any](value interface{}, err error) (T, error) {
+	var zero T
+	if err != nil {
+		return zero, err
+	}
+	if value == nil {
+		return zero, nil
+	}
+
+	v, ok := value.(T)
+	if !ok {
+		return zero, fmt.Errorf("value of type %T is not a %s", value, valueType[T]())
+	}
+
+	return v, nil
+}
+
+// DataLink is the type-safe version of mtque.DataLink.
+type DataLink[T any] struct {
+	*mtque.DataLink
+}
+
+// NewDataLink is the constructor of DataLink.
+func NewDataLink[T any]() *DataLink[T] {
+	return &DataLink[T]{DataLink: mtque.NewDataLink()}
+}
+
+// AddValueAtHead adds a value at the head of link.
+func (dl *DataLink[T]) AddValueAtHead(value T) {
+	dl.AddNodeAtHead(mtque.NewDataNode(value))
+}
+
+// AddValueAtTail adds a value at the tail of link.
+func (dl *DataLink[T]) AddValueAtTail(value T) {
+	dl.AddNodeAtTail(mtque.NewDataNode(value))
+}
+
+// GetHeadValue returns the value at the head of link.
+func (dl *DataLink[T]) GetHeadValue() (T, error) {
+	return cast[T](dl.DataLink.GetHeadValue())
+}
+
+// GetTailValue returns the value at the tail of link.
+func (dl *DataLink[T]) GetTailValue() (T, error) {
+	return cast[T](dl.DataLink.GetTailValue())
+}
+
+// Values returns all the values in the link from head to tail.
+func (dl *DataLink[T]) Values() ([]T, error) {
+	values := []T{}
+	for node := dl.Head; node != nil; node = node.Next {
+		value, err := cast[T](node.Value, nil)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// Buffer is the type-safe version of mtque.Buffer.
+type Buffer[T any] struct {
+	*mtque.Buffer
+}
+
+// NewBuffer is the constructor of Buffer, it accepts the
+// same options as mtque.NewBuffer.
+func NewBuffer[T any](opts ...func(*mtque.Buffer)) *Buffer[T] {
+	opts = append([]func(*mtque.Buffer){
+		mtque.SetBufferDecoder(decoder[T]()),
+		mtque.SetBufferValueType(valueType[T]()),
+	}, opts...)
+
+	return &Buffer[T]{Buffer: mtque.NewBuffer(opts...)}
+}
+
+// Link returns the datas of buffer as a type-safe DataLink.
+func (b *Buffer[T]) Link() *DataLink[T] {
+	return &DataLink[T]{DataLink: b.Datas}
+}
+
+// AddDataAtHead adds a value at the head of buffer.
+func (b *Buffer[T]) AddDataAtHead(value T) {
+	b.Buffer.AddDataAtHead(value)
+}
+
+// AddDataAtTail adds a value at the tail of buffer.
+func (b *Buffer[T]) AddDataAtTail(value T) {
+	b.Buffer.AddDataAtTail(value)
+}
+
+// GetHeadValue returns the value at the head of buffer.
+func (b *Buffer[T]) GetHeadValue() (T, error) {
+	return cast[T](b.Buffer.GetHeadValue())
+}
+
+// GetTailValue returns the value at the tail of buffer.
+func (b *Buffer[T]) GetTailValue() (T, error) {
+	return cast[T](b.Buffer.GetTailValue())
+}
@@ -0,0 +1,78 @@
+package typed
+
+import (
+	"testing"
+
+	"github.com/xingwangc/mtque"
+)
+
+type TestData struct {
+	Name string
+	Age  int
+}
+
+func TestDataLink(t *testing.T) {
+	link := NewDataLink[int]()
+	link.AddValueAtTail(2)
+	link.AddValueAtHead(1)
+	link.AddValueAtTail(3)
+
+	head, err := link.GetHeadValue()
+	if err != nil || head != 1 {
+		t.Fatal("GetHeadValue error:", head, err)
+	}
+	tail, err := link.GetTailValue()
+	if err != nil || tail != 3 {
+		t.Fatal("GetTailValue error:", tail, err)
+	}
+
+	values, err := link.Values()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values[0] != 1 || values[1] != 2 || values[2] != 3 {
+		t.Fatal("Wrong values:", values)
+	}
+}
+
+func TestBufferRecovery(t *testing.T) {
+	buf := NewBuffer[TestData](
+		mtque.SetBufferFile("./typed_buffer"),
+		mtque.SetBufferPersistenceControl(true))
+
+	buf.AddDataAtTail(TestData{"AA", 1})
+	buf.AddDataAtTail(TestData{"BB", 2})
+
+	err := buf.Persistent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := NewBuffer[TestData](
+		mtque.SetBufferFile("./typed_buffer"),
+		mtque.SetBufferRecoveryControl(true))
+
+	err = recovered.Recovery()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := recovered.GetHeadValue()
+	if err != nil || head != (TestData{"AA", 1}) {
+		t.Fatal("Wrong head value:", head, err)
+	}
+	tail, err := recovered.GetTailValue()
+	if err != nil || tail != (TestData{"BB", 2}) {
+		t.Fatal("Wrong tail value:", tail, err)
+	}
+}
+
+func TestCastMismatch(t *testing.T) {
+	buf := NewBuffer[int]()
+	buf.Buffer.AddDataAtHead("string")
+
+	_, err := buf.GetHeadValue()
+	if err == nil {
+		t.Fatal("Get a string value as int should fail")
+	}
+}
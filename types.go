@@ -2,8 +2,12 @@ package mtque
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
 	"sync"
@@ -12,44 +16,325 @@ import (
 	"github.com/satori/go.uuid"
 )
 
-const BUFFER_INFO_SIZE = 202
+// BUFFER_INFO_SIZE is the space reserved for the buffer info at the
+// beginning of the file, the datas are persisted after it. The files of
+// legacy format reserve less, their datas start at their FileStartSeek.
+const BUFFER_INFO_SIZE = 512
+const DATA_HEAD_SIZE = 8
 const DEFAULT_PERIOD_PERSISTENCE_TIME = time.Minute * 5
 
-// DataNode should be encoded as |len|value....|
+// The flags of the attributes of DataNode encoded in the meta of record.
+const (
+	metaPriority = 1 << iota
+	metaDueAt
+	metaExpireAt
+	metaReserved
+	metaDeliveries
+	metaType
+	// metaHead marks the record of node linked at the head of datas,
+	// instead of the tail, at recovering.
+	metaHead
+	// metaUpdate and metaDelete mark the delta records, see encodeDelta.
+	metaUpdate
+	metaDelete
+)
+
+// DataNode should be encoded as |len|meta|value....|crc|
+// The meta is an uvarint of flags, followed by the varint of
+// every attribute marked in the flags. The records of legacy
+// format are encoded as |len|value....|, without meta and crc.
+// Between the records of nodes, the delta records changing the
+// persisted ones are encoded as |len|flag|target|meta|crc|.
 type DataNode struct {
 	Value    interface{}
 	ValueLen int64
 	Next     *DataNode
 	Previous *DataNode
+
+	//Priority is used by the PriorityQueue, greater first.
+	Priority int64
+	//DueAt is used by the DelayQueue, the node is invisible before it.
+	DueAt time.Time
+	//ExpireAt is the time the node expires, zero means never.
+	ExpireAt time.Time
+	//Receipt identifies the reservation of node, the node is invisible
+	//until InvisibleUntil if it is reserved.
+	Receipt        string
+	InvisibleUntil time.Time
+	//Deliveries is the number of times the node is reserved.
+	Deliveries int64
+
+	// typeName is the name of the registered type of value
+	// decoded from the meta.
+	typeName string
+	// pos is the position of the record of node in the storage, 0 means
+	// the node is not persisted, and end is the position after it.
+	pos int64
+	end int64
+	// head is set if the node is added before the persisted nodes, it
+	// is persisted as a record linked at the head of datas.
+	head bool
 }
 
 func NewDataNode(value interface{}) *DataNode {
 	return &DataNode{Value: value}
 }
 
+func (d *DataNode) encodeMeta() []byte {
+	var flags uint64
+	var attrs []byte
+
+	if d.Priority != 0 {
+		flags |= metaPriority
+		attrs = binary.AppendVarint(attrs, d.Priority)
+	}
+	if !d.DueAt.IsZero() {
+		flags |= metaDueAt
+		attrs = binary.AppendVarint(attrs, d.DueAt.UnixNano())
+	}
+	if !d.ExpireAt.IsZero() {
+		flags |= metaExpireAt
+		attrs = binary.AppendVarint(attrs, d.ExpireAt.UnixNano())
+	}
+	if d.Receipt != "" {
+		flags |= metaReserved
+		attrs = binary.AppendVarint(attrs, d.InvisibleUntil.UnixNano())
+		attrs = binary.AppendUvarint(attrs, uint64(len(d.Receipt)))
+		attrs = append(attrs, d.Receipt...)
+	}
+	if d.Deliveries != 0 {
+		flags |= metaDeliveries
+		attrs = binary.AppendVarint(attrs, d.Deliveries)
+	}
+	if name, ok := registeredName(d.Value); ok {
+		flags |= metaType
+		attrs = binary.AppendUvarint(attrs, uint64(len(name)))
+		attrs = append(attrs, name...)
+	}
+
+	return append(binary.AppendUvarint(nil, flags), attrs...)
+}
+
+// decodeMeta restores the attributes of node from the meta at the
+// beginning of data, and returns the size of the meta.
+func (d *DataNode) decodeMeta(data []byte) (int, error) {
+	flags, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid meta of data")
+	}
+	if flags&(metaUpdate|metaDelete) != 0 {
+		return 0, fmt.Errorf("unexpected delta record")
+	}
+
+	intAttr := func(flag uint64, name string, value *int64) error {
+		if flags&flag == 0 {
+			return nil
+		}
+
+		v, m := binary.Varint(data[n:])
+		if m <= 0 {
+			return fmt.Errorf("invalid %s in meta of data", name)
+		}
+		*value = v
+		n += m
+
+		return nil
+	}
+	timeAttr := func(flag uint64, name string, value *time.Time) error {
+		var nano int64
+		err := intAttr(flag, name, &nano)
+		if err == nil && flags&flag != 0 {
+			*value = time.Unix(0, nano)
+		}
+
+		return err
+	}
+
+	if err := intAttr(metaPriority, "priority", &d.Priority); err != nil {
+		return 0, err
+	}
+	if err := timeAttr(metaDueAt, "due time", &d.DueAt); err != nil {
+		return 0, err
+	}
+	if err := timeAttr(metaExpireAt, "expire time", &d.ExpireAt); err != nil {
+		return 0, err
+	}
+	if err := timeAttr(metaReserved, "reservation", &d.InvisibleUntil); err != nil {
+		return 0, err
+	}
+	stringAttr := func(flag uint64, name string, value *string) error {
+		if flags&flag == 0 {
+			return nil
+		}
+
+		size, m := binary.Uvarint(data[n:])
+		if m <= 0 || uint64(len(data[n+m:])) < size {
+			return fmt.Errorf("invalid %s in meta of data", name)
+		}
+		*value = string(data[n+m : n+m+int(size)])
+		n += m + int(size)
+
+		return nil
+	}
+
+	if err := stringAttr(metaReserved, "receipt", &d.Receipt); err != nil {
+		return 0, err
+	}
+	if err := intAttr(metaDeliveries, "deliveries", &d.Deliveries); err != nil {
+		return 0, err
+	}
+	if err := stringAttr(metaType, "type", &d.typeName); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// setMeta copies the attributes encoded in the meta from the node src.
+func (d *DataNode) setMeta(src *DataNode) {
+	d.Priority = src.Priority
+	d.DueAt = src.DueAt
+	d.ExpireAt = src.ExpireAt
+	d.Receipt = src.Receipt
+	d.InvisibleUntil = src.InvisibleUntil
+	d.Deliveries = src.Deliveries
+}
+
+// encode returns the meta and the encoding of the value of node.
+func (d *DataNode) encode(codec Codec) ([]byte, error) {
+	value, err := codec.Marshal(d.Value)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return append(d.encodeMeta(), value...), nil
+}
+
+// Bytes encodes the node into a record with the GobCodec.
 func (d *DataNode) Bytes() ([]byte, error) {
-	binBuf := new(bytes.Buffer)
-	err := gob.NewEncoder(binBuf).Encode(d.Value)
+	data, err := d.record(GobCodec)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return encodeRecord(data)
+}
+
+// record encodes the node into the data of record with the codec,
+// which is stored by the Storage.
+func (d *DataNode) record(codec Codec) ([]byte, error) {
+	data, err := d.encode(codec)
+	if err != nil {
+		return []byte{}, err
+	}
+	d.ValueLen = int64(len(data))
+
+	return data, nil
+}
+
+// headRecord encodes the node into the data of record like record, which
+// is linked at the head of datas at recovering.
+func (d *DataNode) headRecord(codec Codec) ([]byte, error) {
+	data, err := d.record(codec)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	d.ValueLen = int64(binBuf.Len())
+	flags, n := binary.Uvarint(data)
+	return append(binary.AppendUvarint(nil, flags|metaHead), data[n:]...), nil
+}
+
+// encodeDelta encodes the data of a delta record, which changes the node
+// of the record at the target position persisted before it. The delta
+// record |flag|target|meta| with metaUpdate sets the attributes of node to
+// the meta, and |flag|target| with metaDelete deletes the node.
+func encodeDelta(flag uint64, target int64, meta []byte) []byte {
+	data := binary.AppendUvarint(nil, flag)
+	data = binary.AppendVarint(data, target)
+
+	return append(data, meta...)
+}
+
+// decodeDelta decodes the flags of the record, and the target position
+// and the rest of a delta record, see encodeDelta.
+func decodeDelta(data []byte) (uint64, int64, []byte, error) {
+	flags, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, 0, nil, fmt.Errorf("invalid meta of data")
+	}
+	if flags&(metaUpdate|metaDelete) == 0 {
+		return flags, 0, nil, nil
+	}
+
+	target, m := binary.Varint(data[n:])
+	if m <= 0 {
+		return 0, 0, nil, fmt.Errorf("invalid target of delta record")
+	}
+
+	return flags, target, data[n+m:], nil
+}
 
+// encodeRecord encodes the data as the record |len|data|crc|,
+// the crc is the CRC32 of data.
+func encodeRecord(data []byte) ([]byte, error) {
 	headgob := new(bytes.Buffer)
-	err = gob.NewEncoder(headgob).Encode(d.ValueLen)
+	err := gob.NewEncoder(headgob).Encode(int64(len(data)))
 	if err != nil {
 		return []byte{}, err
 	}
 
 	// size after gob is not fixed 8, it depends on the value.
-	head := make([]byte, 8)
-	if headgob.Len() > 8 {
+	head := make([]byte, DATA_HEAD_SIZE)
+	if headgob.Len() > DATA_HEAD_SIZE {
 		return []byte{}, fmt.Errorf("data size is exceed the range of int64")
 	}
 	copy(head, headgob.Bytes())
 
-	return append(head, binBuf.Bytes()...), nil
+	return appendChecksum(append(head, data...), data), nil
+}
+
+// readRecord reads the data of the record at start which should end
+// before end, and returns the data and the position after the record.
+// If the length of record is valid, the position after the record is
+// returned even if the data is corrupt, so that the record can be skipped.
+// The record has no crc if checksum is false, which is the legacy format.
+func readRecord(file io.ReaderAt, start, end int64, checksum bool) ([]byte, int64, error) {
+	var size int64
+
+	indexbyte := make([]byte, DATA_HEAD_SIZE)
+	_, err := file.ReadAt(indexbyte, start)
+	if err != nil {
+		return nil, start, err
+	}
+
+	sizebuf := bytes.NewBuffer(indexbyte)
+	err = gob.NewDecoder(sizebuf).Decode(&size)
+	if err != nil {
+		return nil, start, err
+	}
+
+	if checksum {
+		size += CHECKSUM_SIZE
+	}
+	if size < 0 || start+DATA_HEAD_SIZE > end || start+DATA_HEAD_SIZE+size > end {
+		return nil, start, fmt.Errorf("data seek is exceed the end, file maybe destroyed!")
+	}
+
+	databyte := make([]byte, size)
+	_, err = file.ReadAt(databyte, start+DATA_HEAD_SIZE)
+	if err != nil {
+		return nil, start, err
+	}
+	next := start + DATA_HEAD_SIZE + size
+
+	if checksum {
+		databyte, err = verifyChecksum(databyte)
+		if err != nil {
+			return nil, next, err
+		}
+	}
+
+	return databyte, next, nil
 }
 
 type DataLink struct {
@@ -103,9 +388,14 @@ func (dl *DataLink) DeleteNodeAtHead() *DataNode {
 	}
 	dl.Head = dl.Head.Next
 	node.Next = nil
+	if dl.Head == nil {
+		dl.Tail = nil
+	}
 
+	// the datas are persisted from head to LastPersistence, so
+	// there is no persisted one after deleting LastPersistence.
 	if dl.LastPersistence == node {
-		dl.LastPersistence = dl.Head
+		dl.LastPersistence = nil
 	}
 
 	return node
@@ -130,6 +420,9 @@ func (dl *DataLink) DeleteNodeAtTail() *DataNode {
 	}
 	dl.Tail = dl.Tail.Previous
 	node.Previous = nil
+	if dl.Tail == nil {
+		dl.Head = nil
+	}
 
 	if dl.LastPersistence == node {
 		dl.LastPersistence = dl.Tail
@@ -138,6 +431,28 @@ func (dl *DataLink) DeleteNodeAtTail() *DataNode {
 	return node
 }
 
+// DeleteNode removes the node from anywhere of the link.
+// The node should be in the link.
+func (dl *DataLink) DeleteNode(node *DataNode) {
+	if node == dl.Head {
+		dl.DeleteNodeAtHead()
+		return
+	}
+	if node == dl.Tail {
+		dl.DeleteNodeAtTail()
+		return
+	}
+
+	if dl.LastPersistence == node {
+		dl.LastPersistence = node.Previous
+	}
+
+	node.Previous.Next = node.Next
+	node.Next.Previous = node.Previous
+	node.Next = nil
+	node.Previous = nil
+}
+
 type BufferInfo struct {
 	Id     string
 	Length int64
@@ -150,6 +465,26 @@ type BufferInfo struct {
 
 	FileStartSeek int64 //start position in file of the persistence
 	FileEndSeek   int64 //last position in file for the persistence
+
+	//SegmentSize is the size of the segment files storing the records,
+	//0 means the records are stored in the file after the buffer info.
+	SegmentSize int64
+
+	//CheckpointLSN is the LSN of the last operation in the write-ahead
+	//log which is included in the file.
+	CheckpointLSN int64
+
+	//CodecName is the name of the Codec encoding the values, it is
+	//empty in the files of legacy format, which are encoded with gob.
+	CodecName string
+
+	//Checksum is set if the records and the buffer info in file end
+	//with their CRC32, it is not set in the files of legacy format.
+	Checksum bool
+
+	//Deltas is set if the records include the delta records or the
+	//records linked at head, which are folded by rewriting the file.
+	Deltas bool
 }
 
 func SetBufferInfoPersistenceControl(ctl bool) func(*BufferInfo) {
@@ -175,6 +510,7 @@ func NewBufferInfo(opts ...func(*BufferInfo)) *BufferInfo {
 
 	info.Id = uuid.Must(uuid.NewV4()).String()
 	info.PersistencePeriod = 5 * time.Minute
+	info.Checksum = true
 
 	for _, opt := range opts {
 		opt(info)
@@ -183,15 +519,34 @@ func NewBufferInfo(opts ...func(*BufferInfo)) *BufferInfo {
 	return info
 }
 
-func (b *BufferInfo) Bytes() ([]byte, error) {
-	binBuf := new(bytes.Buffer)
-	err := gob.NewEncoder(binBuf).Encode(*b)
-	if err != nil {
-		return []byte{}, err
-	}
+// OverflowPolicy decides what to do when adding a value into a buffer
+// which has reached its capacity.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the producer until there is free space.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowFail refuses the new value with ErrFull.
+	OverflowFail
+	// OverflowDropNewest silently discards the new value.
+	OverflowDropNewest
+	// OverflowDropOldest discards the oldest values to make room for the new one,
+	// the reserved values are kept, and ErrFull is returned if all are reserved.
+	OverflowDropOldest
+)
 
-	return binBuf.Bytes(), nil
-}
+// DecodeFunc rebuilds a value from a persisted record at recovering.
+// The decode argument fills the value pointed by ptr with the content
+// of record, and the value to put into the buffer should be returned.
+type DecodeFunc func(decode func(ptr interface{}) error) (interface{}, error)
+
+// ErrFull is returned when a value can not be added because the buffer
+// has reached its capacity.
+var ErrFull = errors.New("buffer is full")
+
+// errUnregistered is returned when recovering the datas without a way to
+// decode them, which is not a corruption of the file.
+var errUnregistered = errors.New("should register data type to recover datas")
 
 type Buffer struct {
 	BufferInfo
@@ -203,8 +558,96 @@ type Buffer struct {
 
 	//User should register the data origin type to recovery data
 	Register interface{}
-
-	persRunning bool
+	//Decoder rebuilds the persisted values if it is set, it takes
+	//precedence over the Register.
+	Decoder DecodeFunc
+	//ValueType is the type of the values in buffer if it is set, e.g.
+	//by the containers of package typed. The values of the registered
+	//types which are not assignable to it are rebuilt by the Decoder.
+	ValueType reflect.Type
+	//Codec encodes the values in file, it is GobCodec if not set.
+	Codec Codec
+	//Storage persists the buffer, it is the File if not set.
+	Storage Storage
+
+	//LockTimeout is how long to wait for the lock of File held by
+	//another process, lock is the lock of File held by the buffer.
+	LockTimeout time.Duration
+	lock        *os.File
+
+	// owner is the Manager which the buffer is constructed by.
+	owner *Manager
+
+	//TTL is the default time to live of the values, 0 means forever.
+	TTL time.Duration
+	//ExpiredHandler is called with the values evicted for expiring.
+	ExpiredHandler func(value interface{})
+
+	//Capacity is the max number of values in buffer, 0 means unlimited.
+	Capacity int64
+	//Overflow is the policy applied when adding into a full buffer.
+	Overflow OverflowPolicy
+
+	//CompactionThreshold is the ratio of the dead space in file to
+	//trigger the compaction, 0 means never.
+	CompactionThreshold float64
+
+	//Corruption is the policy applied to the corrupt records at recovering.
+	Corruption CorruptionPolicy
+	report     RecoveryReport
+
+	//WAL enables logging every change of datas into the write-ahead log,
+	//and WALSync decides when the log is synced to the disk. WALMaxSize
+	//is the size of log which forces a persistence to empty it.
+	WAL        bool
+	WALSync    SyncPolicy
+	WALMaxSize int64
+
+	// closed is set by closing the buffer, then all the
+	// operations on it fail with ErrClosed.
+	closed bool
+	// flushed is closed when the flush at closing the buffer is done.
+	flushed chan struct{}
+
+	// rewrite is set when the datas are changed in the way that
+	// can not be persisted incrementally, so the next persistence
+	// should rewrite the whole file.
+	rewrite bool
+
+	// legacy is set when the file is in the legacy format, whose
+	// records have no meta.
+	legacy bool
+
+	// reserved indexes the reserved nodes by their receipts.
+	reserved map[string]*DataNode
+
+	// updated are the persisted nodes whose attributes are changed, and
+	// deleted are the positions of the records of the nodes deleted in
+	// the middle of the persisted ones. They are persisted incrementally
+	// as the delta records, see incrementPersistent.
+	updated map[*DataNode]struct{}
+	deleted []int64
+	// live is the size of the records of the nodes in datas, the rest
+	// of the space between FileStartSeek and FileEndSeek is dead.
+	live int64
+
+	// reaper evicts the expired datas at reapAt.
+	reaper *time.Timer
+	reapAt time.Time
+
+	// changed is closed and renewed every time the datas of buffer
+	// are changed, to wake up the goroutines waiting on the buffer.
+	changed chan struct{}
+
+	// wal is the opened write-ahead log of walSize bytes, lsn is the
+	// LSN of the last logged operation, and walErr keeps the first error
+	// of logging. walCheckpoint empties the log grown over WALMaxSize.
+	wal           *os.File
+	walSize       int64
+	walSyncer     *time.Timer
+	walCheckpoint *time.Timer
+	lsn           int64
+	walErr        error
 }
 
 func SetBufferFile(file string) func(*Buffer) {
@@ -237,11 +680,58 @@ func SetBufferRegister(datatype interface{}) func(*Buffer) {
 	}
 }
 
+func SetBufferDecoder(decoder DecodeFunc) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.Decoder = decoder
+	}
+}
+
+func SetBufferValueType(typ reflect.Type) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.ValueType = typ
+	}
+}
+
+func SetBufferTTL(ttl time.Duration) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.TTL = ttl
+	}
+}
+
+func SetBufferExpiredHandler(handler func(value interface{})) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.ExpiredHandler = handler
+	}
+}
+
+func SetBufferCapacity(capacity int64) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.Capacity = capacity
+	}
+}
+
+func SetBufferOverflowPolicy(policy OverflowPolicy) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.Overflow = policy
+	}
+}
+
+func SetBufferWAL(policy SyncPolicy) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.WAL = true
+		buf.WALSync = policy
+	}
+}
+
+func SetBufferWALMaxSize(size int64) func(*Buffer) {
+	return func(buf *Buffer) {
+		buf.WALMaxSize = size
+	}
+}
+
 func NewBuffer(opts ...func(*Buffer)) *Buffer {
 	buffer := new(Buffer)
-	buffer.BufferInfo = *NewBufferInfo()
-	buffer.Mutex = sync.RWMutex{}
-	buffer.Datas = NewDataLink()
+	buffer.init()
 
 	for _, opt := range opts {
 		opt(buffer)
@@ -250,12 +740,32 @@ func NewBuffer(opts ...func(*Buffer)) *Buffer {
 	return buffer
 }
 
+// init sets up the default values of a zero buffer. It is used by the
+// constructors of the types embedding a Buffer, so that the buffer do not
+// need to be copied into them.
+func (b *Buffer) init() {
+	b.BufferInfo = *NewBufferInfo()
+	b.Datas = NewDataLink()
+	b.CompactionThreshold = DEFAULT_COMPACTION_THRESHOLD
+}
+
 func (b *Buffer) Clear() {
 	b.Mutex.Lock()
 	defer b.Mutex.Unlock()
 
+	b.clear()
+}
+
+// clear removes all the datas of buffer.
+// The Mutex should be held by the caller.
+func (b *Buffer) clear() {
+	b.logClear()
 	b.Datas = NewDataLink()
+	b.reserved = nil
 	b.Length = 0
+	b.rewrite = true
+
+	b.broadcast()
 }
 
 func (b *Buffer) Len() int64 {
@@ -272,14 +782,124 @@ func (b *Buffer) ID() string {
 	return b.Id
 }
 
+// waitChan returns a channel which will be closed at the next time the
+// datas of buffer are changed. The Mutex should be held by the caller.
+func (b *Buffer) waitChan() <-chan struct{} {
+	if b.changed == nil {
+		b.changed = make(chan struct{})
+	}
+
+	return b.changed
+}
+
+// broadcast wakes up all the goroutines waiting on the channel returned by
+// waitChan. The Mutex should be held by the caller.
+func (b *Buffer) broadcast() {
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+}
+
+// waitFor blocks until the wait channel is closed, the time of until is
+// reached, or the ctx is done. A zero until means there is no deadline.
+func waitFor(ctx context.Context, wait <-chan struct{}, until time.Time) error {
+	var deadline <-chan time.Time
+	if !until.IsZero() {
+		timer := time.NewTimer(time.Until(until))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-wait:
+	case <-deadline:
+	}
+
+	return nil
+}
+
+// full returns whether the buffer has reached its capacity.
+// The Mutex should be held by the caller.
+func (b *Buffer) full() bool {
+	return b.Capacity > 0 && b.Length >= b.Capacity
+}
+
+// makeRoom applies the overflow policy before adding a value into
+// the buffer. It returns whether the value should be added or not.
+// The Mutex should be held by the caller.
+func (b *Buffer) makeRoom() (bool, error) {
+	if !b.full() {
+		return true, nil
+	}
+
+	switch b.Overflow {
+	case OverflowDropNewest:
+		return false, nil
+	case OverflowDropOldest:
+		if reservedCount(b.Datas) >= b.Capacity {
+			return false, ErrFull
+		}
+		b.dropOldest(b.Capacity - 1)
+		return true, nil
+	default:
+		return false, ErrFull
+	}
+}
+
+// reservedCount returns the number of the reserved nodes in datas.
+func reservedCount(datas *DataLink) int64 {
+	var count int64
+	for node := datas.Head; node != nil; node = node.Next {
+		if node.Receipt != "" {
+			count++
+		}
+	}
+
+	return count
+}
+
+// dropOldest deletes the oldest values which are not reserved, until
+// there are at most n values in buffer.
+// The Mutex should be held by the caller.
+func (b *Buffer) dropOldest(n int64) {
+	for node := b.Datas.Head; node != nil && b.Length > n; {
+		next := node.Next
+		if node.Receipt == "" {
+			b.deleteNode(node)
+			b.Length--
+		}
+		node = next
+	}
+}
+
 func (b *Buffer) AddDataAtHead(value interface{}) {
-	node := NewDataNode(value)
+	b.addNodeAtHead(NewDataNode(value))
+}
+
+// addNodeAtHead adds the node at the head of datas. The node added before
+// the persisted nodes is persisted as a record linked at the head, the
+// nodes added so are always the first ones of datas.
+// The Mutex should be held by the caller.
+func (b *Buffer) addNodeAtHead(node *DataNode) {
 	b.Datas.AddNodeAtHead(node)
+	b.logAdd(node)
+	if next := node.Next; next != nil && (next.pos != 0 || next.head) {
+		node.head = true
+	}
 }
 
 func (b *Buffer) AddDataAtTail(value interface{}) {
-	node := NewDataNode(value)
+	b.addNodeAtTail(NewDataNode(value))
+}
+
+// addNodeAtTail adds the node at the tail of datas.
+// The Mutex should be held by the caller.
+func (b *Buffer) addNodeAtTail(node *DataNode) {
 	b.Datas.AddNodeAtTail(node)
+	b.logAdd(node)
 }
 
 func (b *Buffer) GetHeadValue() (interface{}, error) {
@@ -287,9 +907,34 @@ func (b *Buffer) GetHeadValue() (interface{}, error) {
 }
 
 func (b *Buffer) DeleteNodeAtHead() {
-	node := b.Datas.DeleteNodeAtHead()
-	if node != nil && node.ValueLen > 0 {
-		b.decrementPersistentAtHead(node)
+	if b.Datas.Head != nil {
+		b.deleteNode(b.Datas.Head)
+	}
+}
+
+// deleteNode removes the node from anywhere of the datas, and its
+// record from the persisted ones, see unpersist.
+// The Mutex should be held by the caller.
+func (b *Buffer) deleteNode(node *DataNode) {
+	if node.Receipt != "" {
+		delete(b.reserved, node.Receipt)
+	}
+	b.logDelete(node)
+
+	b.Datas.DeleteNode(node)
+	b.unpersist(node)
+}
+
+// touchNode should be called after changing the attributes of a node,
+// so that the next persistence will update the persisted one.
+// The Mutex should be held by the caller.
+func (b *Buffer) touchNode(node *DataNode) {
+	b.logUpdate(node)
+	if node.pos != 0 {
+		if b.updated == nil {
+			b.updated = make(map[*DataNode]struct{})
+		}
+		b.updated[node] = struct{}{}
 	}
 }
 
@@ -298,9 +943,8 @@ func (b *Buffer) GetTailValue() (interface{}, error) {
 }
 
 func (b *Buffer) DeleteNodeAtTail() {
-	node := b.Datas.DeleteNodeAtTail()
-	if node != nil && node.ValueLen > 0 {
-		b.decrementPersistentAtTail(node)
+	if b.Datas.Tail != nil {
+		b.deleteNode(b.Datas.Tail)
 	}
 }
 
@@ -310,10 +954,8 @@ func (b *Buffer) SetRegister(datatype interface{}) {
 
 //IncrementPersistent will Persistent datas from last persistence at
 //the end of the file.
+//The Mutex should be held by the caller.
 func (b *Buffer) incrementPersistent() error {
-	b.Mutex.Lock()
-	defer b.Mutex.Unlock()
-
 	if !b.PersistenceControl {
 		return fmt.Errorf("presistence is not enabled")
 	}
@@ -321,217 +963,534 @@ func (b *Buffer) incrementPersistent() error {
 		return fmt.Errorf("the file to persistent datas is not specified")
 	}
 
-	file, err := os.OpenFile(b.File, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+	store := b.storage()
+	defer store.Close()
+
+	if b.rewrite || b.compactable(store) || b.fragmented() {
+		return b.rewritePersistent()
 	}
-	defer file.Close()
 
 	if b.FileStartSeek == 0 {
 		b.FileStartSeek = BUFFER_INFO_SIZE
 		b.FileEndSeek = BUFFER_INFO_SIZE
 	}
 
-	_, err = file.Seek(b.FileEndSeek, 0)
-	if err != nil {
-		return err
+	// the changes of the persisted nodes are appended as the delta
+	// records, which are applied in order at recovering.
+	for node := range b.updated {
+		err := b.appendRecord(store, encodeDelta(metaUpdate, node.pos, node.encodeMeta()))
+		if err != nil {
+			return err
+		}
+		delete(b.updated, node)
+	}
+	for len(b.deleted) > 0 {
+		err := b.appendRecord(store, encodeDelta(metaDelete, b.deleted[0], nil))
+		if err != nil {
+			return err
+		}
+		b.deleted = b.deleted[1:]
 	}
 
-	if b.Datas.LastPersistence == nil {
-		b.Datas.LastPersistence = b.Datas.Head
+	// the nodes not persisted are the ones after the persisted ones, and
+	// the ones added at head, which are linked at the head in the reverse
+	// order of the records at recovering.
+	node := b.Datas.Tail
+	for node != nil && node.pos == 0 && !node.head {
+		node = node.Previous
+	}
+	if node == nil {
+		node = b.Datas.Head
 	} else {
-		b.Datas.LastPersistence = b.Datas.LastPersistence.Next
+		node = node.Next
 	}
 
-	for node := b.Datas.LastPersistence; node != nil; node = node.Next {
-		content, err := node.Bytes()
+	for ; node != nil; node = node.Next {
+		err := b.appendNode(store, node, node.record)
 		if err != nil {
 			return err
 		}
+		b.Datas.LastPersistence = node
+	}
+
+	node = b.Datas.Head
+	for node != nil && node.head {
+		node = node.Next
+	}
+	if node == nil {
+		node = b.Datas.Tail
+	} else {
+		node = node.Previous
+	}
 
-		_, err = file.Write(content)
+	for ; node != nil; node = node.Previous {
+		err := b.appendNode(store, node, node.headRecord)
 		if err != nil {
 			return err
 		}
+		node.head = false
+		b.Deltas = true
+	}
 
-		b.FileEndSeek += int64(len(content))
+	// with the write-ahead log, the records are synced before the header
+	// marks them checkpointed, and the header before emptying the log.
+	if b.WAL {
+		err := store.Sync()
+		if err != nil {
+			return err
+		}
+		b.CheckpointLSN = b.lsn
 	}
 
+	b.CodecName = b.codec().Name()
 	info, err := b.Bytes()
 	if err != nil {
 		return err
 	}
 
-	_, err = file.WriteAt(info, 0)
+	err = store.WriteHeader(info)
 	if err != nil {
 		return err
 	}
 
-	file.Seek(b.FileEndSeek, 0)
+	err = store.Delete(b.FileStartSeek, b.FileEndSeek)
+	if err != nil || !b.WAL {
+		return err
+	}
+
+	err = store.Sync()
+	if err != nil {
+		return err
+	}
+
+	return b.truncateWAL()
+}
+
+// appendRecord appends the delta record at FileEndSeek of the storage.
+// The Mutex should be held by the caller.
+func (b *Buffer) appendRecord(store Storage, data []byte) error {
+	end, err := store.Append(data, b.FileEndSeek)
+	if err != nil {
+		return err
+	}
+	b.FileEndSeek = end
+	b.Deltas = true
 
 	return nil
 }
 
-//DecrementPersistentAtHead will delete datas which already be persistented
-//in the file when deleting data from the header of buffer.
-//It is trigged by deleting data from the header of buffer, and should satisfied
-//the condition that buffer.head is before buffer.LastPersistence
-func (b *Buffer) decrementPersistentAtHead(node *DataNode) error {
-	b.Mutex.Lock()
-	defer b.Mutex.Unlock()
+// appendNode appends the record of node encoded by record at FileEndSeek
+// of the storage.
+// The Mutex should be held by the caller.
+func (b *Buffer) appendNode(store Storage, node *DataNode, record func(Codec) ([]byte, error)) error {
+	data, err := record(b.codec())
+	if err != nil {
+		return err
+	}
 
-	if node == nil {
-		return fmt.Errorf("there is no node to remove from persistence")
+	end, err := store.Append(data, b.FileEndSeek)
+	if err != nil {
+		return err
 	}
-	if node.ValueLen <= 0 {
-		return fmt.Errorf("the node is not persistent before")
+
+	node.pos, node.end = b.FileEndSeek, end
+	b.FileEndSeek = end
+	b.live += node.end - node.pos
+
+	return nil
+}
+
+//RewritePersistent will persistent all the datas into a new place of the
+//storage, and then replace the old ones with them. For the file, it is a
+//new file replacing the old one, and with segments, the datas are persisted
+//into the segments after the ones in use.
+//The Mutex should be held by the caller.
+func (b *Buffer) rewritePersistent() error {
+	store := b.storage()
+	defer store.Close()
+
+	rewriter, err := store.Rewrite(b.FileEndSeek)
+	if err != nil {
+		return err
 	}
+	defer rewriter.Abort()
+
+	// the positions of the records are set to the nodes after commit.
+	start := rewriter.Start()
+	end := start
+	ends := make([]int64, 0, b.Length)
+	for node := b.Datas.Head; node != nil; node = node.Next {
+		record, err := node.record(b.codec())
+		if err != nil {
+			return err
+		}
 
-	if b.FileStartSeek < BUFFER_INFO_SIZE {
-		return fmt.Errorf("the node was persistented by covering the buffer info")
+		end, err = rewriter.Append(record, end)
+		if err != nil {
+			return err
+		}
+		ends = append(ends, end)
 	}
 
-	if b.FileStartSeek+int64(node.ValueLen) >= b.FileEndSeek {
-		b.FileStartSeek = BUFFER_INFO_SIZE
-		b.FileEndSeek = BUFFER_INFO_SIZE
-	} else {
-		b.FileStartSeek += int64(node.ValueLen)
+	// the buffer info is set after commit too, the delta records
+	// are all folded into the records of nodes.
+	info := b.BufferInfo
+	info.FileStartSeek, info.FileEndSeek = start, end
+	info.CheckpointLSN = b.lsn
+	info.CodecName = b.codec().Name()
+	info.Deltas = false
+	header, err := info.Bytes()
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	err = rewriter.WriteHeader(header)
+	if err != nil {
+		return err
+	}
 
-//DecrementPersistentAtTail will delete datas which already be persistented
-//in the file when deleting data from the tail of buffer.
-//It is trigged by deleting data from the tail of buffer, and should satisfied
-//the condition that buffer.tail is after buffer.LastPersistence
-func (b *Buffer) decrementPersistentAtTail(node *DataNode) error {
-	b.Mutex.Lock()
-	defer b.Mutex.Unlock()
+	err = rewriter.Commit()
+	if err != nil {
+		return err
+	}
+	b.BufferInfo = info
 
-	if node == nil {
-		return fmt.Errorf("there is no node to remove from persistence")
+	pos := start
+	for node, i := b.Datas.Head, 0; node != nil; node, i = node.Next, i+1 {
+		node.pos, node.end = pos, ends[i]
+		node.head = false
+		pos = ends[i]
+	}
+	b.Datas.LastPersistence = b.Datas.Tail
+	b.rewrite = false
+	b.updated = nil
+	b.deleted = nil
+	b.live = end - start
+
+	err = store.Delete(start, end)
+	if err != nil {
+		return err
 	}
-	if node.ValueLen <= 0 {
-		return fmt.Errorf("the node is not persistent before")
+
+	if b.WAL {
+		return b.truncateWAL()
+	}
+
+	return nil
+}
+
+// unpersist drops the record of the deleted node from the persisted ones.
+// The records at both ends of the ones between FileStartSeek and
+// FileEndSeek are dropped by moving the seeks, and the others by the
+// delta records persisted at the next persistence.
+// The Mutex should be held by the caller.
+func (b *Buffer) unpersist(node *DataNode) {
+	delete(b.updated, node)
+	if node.pos == 0 {
+		return
 	}
 
-	if b.FileEndSeek < BUFFER_INFO_SIZE+int64(node.ValueLen) {
-		return fmt.Errorf("the node was persistented by covering the buffer info")
+	switch {
+	case node.pos == b.FileStartSeek:
+		b.FileStartSeek = node.end
+	case node.end == b.FileEndSeek:
+		b.FileEndSeek = node.pos
+	default:
+		b.deleted = append(b.deleted, node.pos)
 	}
+	b.live -= node.end - node.pos
+	node.pos, node.end = 0, 0
 
-	if b.FileStartSeek <= b.FileEndSeek-int64(node.ValueLen) {
+	if b.FileStartSeek >= b.FileEndSeek {
 		b.FileStartSeek = BUFFER_INFO_SIZE
 		b.FileEndSeek = BUFFER_INFO_SIZE
-	} else {
-		b.FileEndSeek -= int64(node.ValueLen)
+		b.deleted = nil
+		b.live = 0
 	}
-
-	return nil
 }
 
 func (b *Buffer) Persistent() error {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
 	return b.incrementPersistent()
 }
 
-func (b *Buffer) recoveryInfo(file *os.File) error {
-	if file == nil {
-		return fmt.Errorf("should provide a file hanler")
+func (b *Buffer) recoveryInfo(store Storage) error {
+	info, legacy, err := readBufferInfo(store)
+	if err != nil {
+		return err
 	}
 
-	err := gob.NewDecoder(file).Decode(b)
+	codec, err := b.lookupCodec(info.CodecName)
 	if err != nil {
 		return err
 	}
 
+	b.BufferInfo = info
+	b.Codec = codec
+	b.legacy = legacy
 	b.RecoveryControl = true
 	b.Datas = NewDataLink()
+	b.reserved = nil
+	b.rewrite = false
+	b.updated = nil
+	b.deleted = nil
+	b.live = 0
 
 	return nil
 }
 
-func (b *Buffer) recoveryData(file *os.File, fileseek int64) (*DataNode, int64, error) {
-	var size int64
-
-	indexbyte := make([]byte, 8)
-	start := fileseek
-	_, err := file.ReadAt(indexbyte, start)
+// recoveryRecord reads the record at pos from the storage, and links the
+// node of it into the datas, or applies the delta record on the node of
+// its target, which is looked up in the nodes. The target is ignored if
+// its record is dropped before, e.g. by moving FileStartSeek after it.
+// It returns the position of the next record.
+// The Mutex should be held by the caller.
+func (b *Buffer) recoveryRecord(store Storage, pos int64, nodes map[int64]*DataNode) (int64, error) {
+	var flags uint64
+	var target int64
+	var meta []byte
+
+	data, next, err := store.Read(pos, b.FileEndSeek)
+	if err == nil && !b.legacy {
+		flags, target, meta, err = decodeDelta(data)
+	}
 	if err != nil {
-		return nil, start, err
+		return next, err
 	}
 
-	sizebuf := bytes.NewBuffer(indexbyte)
-	err = gob.NewDecoder(sizebuf).Decode(&size)
+	if flags&(metaUpdate|metaDelete) != 0 {
+		node := nodes[target]
+		if node == nil {
+			return next, nil
+		}
+
+		if flags&metaDelete != 0 {
+			b.Datas.DeleteNode(node)
+			delete(nodes, target)
+			b.Length--
+			b.live -= node.end - node.pos
+			return next, nil
+		}
+
+		update := NewDataNode(nil)
+		if _, err := update.decodeMeta(meta); err != nil {
+			return next, err
+		}
+		node.setMeta(update)
+
+		return next, nil
+	}
+
+	node, err := b.decodeNode(data)
 	if err != nil {
-		return nil, start, err
+		return next, err
 	}
+	node.ValueLen = int64(len(data))
+	node.pos, node.end = pos, next
 
-	if start+8 > b.FileEndSeek || start+8+size > b.FileEndSeek {
-		return nil, start, fmt.Errorf("data seek is exceed the end, file maybe destroyed!")
+	if flags&metaHead != 0 {
+		b.Datas.AddNodeAtHead(node)
+	} else {
+		b.Datas.AddNodeAtTail(node)
 	}
+	nodes[pos] = node
+	b.Length++
+	b.live += next - pos
 
-	start += 8
-	databyte := make([]byte, size)
-	_, err = file.ReadAt(databyte, start)
+	return next, nil
+}
+
+// recoveryData reads the node of the record at pos from the storage,
+// and returns it with the position of the next record.
+func (b *Buffer) recoveryData(store Storage, pos int64) (*DataNode, int64, error) {
+	databyte, next, err := store.Read(pos, b.FileEndSeek)
 	if err != nil {
-		return nil, start, err
+		return nil, next, err
 	}
 
-	databuf := bytes.NewBuffer(databyte)
-	value := reflect.New(reflect.TypeOf(b.Register))
-	err = gob.NewDecoder(databuf).Decode(value.Interface())
+	datanode, err := b.decodeNode(databyte)
 	if err != nil {
-		return nil, start, err
+		return nil, next, err
 	}
+	datanode.ValueLen = int64(len(databyte))
+	datanode.pos, datanode.end = pos, next
 
-	datanode := NewDataNode(value.Interface())
-	datanode.ValueLen = size
-	start += size
+	return datanode, next, nil
+}
+
+// decodeNode rebuilds a node from its meta and the encoding of value,
+// the records of legacy format have only the encoding of value.
+func (b *Buffer) decodeNode(data []byte) (*DataNode, error) {
+	var n int
+	var err error
 
-	return datanode, start, nil
+	datanode := NewDataNode(nil)
+	if !b.legacy {
+		n, err = datanode.decodeMeta(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	datanode.Value, err = b.decodeValue(datanode.typeName, data[n:])
+	if err != nil {
+		return nil, err
+	}
+	datanode.typeName = ""
+
+	return datanode, nil
 }
 
-func (b *Buffer) recoveryDataLink(file *os.File) error {
-	if file == nil {
-		return fmt.Errorf("should provide a file hanler")
+// decodeValue rebuilds a value from its encoding as the registered type
+// of the name, or with the Decoder of buffer, or as the type of Register
+// if there is no Decoder. The value is rebuilt with the same type as it is
+// added, not a pointer to it.
+func (b *Buffer) decodeValue(name string, data []byte) (interface{}, error) {
+	decode := func(ptr interface{}) error {
+		return b.codec().Unmarshal(data, ptr)
+	}
+	decodeAs := func(typ reflect.Type) (interface{}, error) {
+		value := reflect.New(typ)
+		err := decode(value.Interface())
+		if err != nil {
+			return nil, err
+		}
+
+		return value.Elem().Interface(), nil
+	}
+
+	if name != "" {
+		typ, ok := registeredType(name)
+		if ok && (b.ValueType == nil || typ.AssignableTo(b.ValueType)) {
+			return decodeAs(typ)
+		}
+		if !ok && b.Register == nil && b.Decoder == nil {
+			return nil, fmt.Errorf("%w: unknown type %q of data, it should be registered by RegisterType", errUnregistered, name)
+		}
 	}
 
+	if b.Decoder != nil {
+		return b.Decoder(decode)
+	}
 	if b.Register == nil {
-		return fmt.Errorf("should register data type to recover datas")
+		return nil, errUnregistered
+	}
+
+	return decodeAs(reflect.TypeOf(b.Register))
+}
+
+func (b *Buffer) recoveryDataLink(store Storage) error {
+	if store == nil {
+		return fmt.Errorf("should provide a storage")
+	}
+
+	if b.Register == nil && b.Decoder == nil && !typesRegistered() {
+		return errUnregistered
 	}
 
-	var currentnode *DataNode
+	// the nodes are indexed by the positions of their records,
+	// which are the targets of the delta records.
+	nodes := make(map[int64]*DataNode)
+	b.Length = 0
+	b.live = 0
 	fileseek := b.BufferInfo.FileStartSeek
 	for fileseek < b.BufferInfo.FileEndSeek {
-		datanode, seek, err := b.recoveryData(file, fileseek)
-		if err != nil {
+		seek, err := b.recoveryRecord(store, fileseek, nodes)
+		if err != nil && (b.Corruption == CorruptionStrict || errors.Is(err, errUnregistered)) {
+			b.Datas = NewDataLink()
+			b.Length = 0
 			return err
 		}
-
-		if b.Datas.Head == nil {
-			b.Datas.Head = datanode
+		if err != nil && b.Corruption == CorruptionSkipBad && seek > fileseek {
+			b.report.drop(b.File, fileseek, seek-fileseek, err)
+			b.rewrite = true
+			fileseek = seek
+			continue
 		}
-		b.Datas.Tail = datanode
-		b.Datas.LastPersistence = datanode
-
-		if currentnode == nil {
-			currentnode = datanode
-		} else {
-			currentnode.Next = datanode
-			datanode.Previous = currentnode
-			currentnode = datanode
+		if err != nil {
+			b.report.drop(b.File, fileseek, b.FileEndSeek-fileseek, err)
+			b.rewrite = true
+			break
 		}
 
 		fileseek = seek
 	}
+	b.Datas.LastPersistence = b.Datas.Tail
+	b.reindex()
+
+	// the legacy file is never written in place, it is replaced by
+	// a new file in the current format at the next persistence.
+	if b.legacy || !b.Checksum {
+		b.legacy = false
+		b.Checksum = true
+		b.rewrite = true
+	}
 
 	return nil
 }
 
+// reindex rebuilds the index of the reserved nodes.
+// The Mutex should be held by the caller.
+func (b *Buffer) reindex() {
+	b.reserved = nil
+	for node := b.Datas.Head; node != nil; node = node.Next {
+		if node.Receipt != "" {
+			if b.reserved == nil {
+				b.reserved = make(map[string]*DataNode)
+			}
+			b.reserved[node.Receipt] = node
+		}
+	}
+}
+
 func (b *Buffer) Recovery() error {
 	b.Mutex.Lock()
 	defer b.Mutex.Unlock()
 
+	return b.recovery()
+}
+
+// bindFile binds the buffer to the file with the lock of it taken by
+// acquireLock, recovers the buffer from it if the recovery control is
+// enabled, and enables the persistence. If failed to recover from it with
+// CorruptionStrict, or because the data type is not registered, the buffer
+// is not bound to the file, the lock is released and the error is returned.
+// Otherwise the file is rewritten from the buffer at the next persistence.
+// The Mutex should be held by the caller.
+func (b *Buffer) bindFile(file string, lock *os.File) error {
+	b.setLock(lock)
+	b.File = file
+
+	if b.RecoveryControl {
+		err := b.recovery()
+		if err != nil && !os.IsNotExist(err) {
+			if b.Corruption == CorruptionStrict || errors.Is(err, errUnregistered) {
+				b.releaseLock()
+				b.File = ""
+				return err
+			}
+			b.rewrite = true
+		}
+	}
+
+	b.PersistenceControl = true
+	if b.PersistencePeriod == 0 {
+		b.PersistencePeriod = DEFAULT_PERIOD_PERSISTENCE_TIME
+	}
+
+	return nil
+}
+
+// recovery sets up the buffer from the file, the buffer is left as it was
+// if failed.
+// The Mutex should be held by the caller.
+func (b *Buffer) recovery() error {
 	if !b.RecoveryControl {
 		return fmt.Errorf("presistence is not enabled")
 	}
@@ -539,16 +1498,46 @@ func (b *Buffer) Recovery() error {
 		return fmt.Errorf("the file which persistence datas is not specified")
 	}
 
-	file, err := os.Open(b.File)
+	state := b.state()
+	b.report = RecoveryReport{}
+	err := b.recoveryFile()
+	if err == nil && b.WAL {
+		err = b.replayWAL()
+	}
 	if err != nil {
-		return err
+		report := b.report
+		b.restore(state)
+		b.reindex()
+		b.report = report
 	}
-	defer file.Close()
+	b.report.Recovered = b.Length
+	b.scheduleReap(b.nextExpiry())
 
-	err = b.recoveryInfo(file)
+	return err
+}
+
+// recoveryFile sets up the buffer from the storage. With the write-ahead log,
+// the storage may be empty if the buffer is never persisted, then the buffer
+// is set up empty and rebuilt from the log.
+// The Mutex should be held by the caller.
+func (b *Buffer) recoveryFile() error {
+	store := b.storage()
+	err := b.recoveryInfo(store)
+	store.Close()
+	if os.IsNotExist(err) && b.WAL {
+		b.Datas = NewDataLink()
+		b.reserved = nil
+		b.Length = 0
+		b.CheckpointLSN = 0
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	return b.recoveryDataLink(file)
+	// the default storage depends on the segment size in the header.
+	store = b.storage()
+	defer store.Close()
+
+	return b.recoveryDataLink(store)
 }
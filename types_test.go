@@ -1,6 +1,9 @@
 package mtque
 
 import (
+	"math/rand"
+	"os"
+	"reflect"
 	"testing"
 )
 
@@ -74,6 +77,9 @@ func TestBufferRecovery(t *testing.T) {
 	}
 
 	for node := buf.Datas.Head; node != nil; node = node.Next {
+		if _, ok := node.Value.(TestData); !ok {
+			t.Fatalf("Wrong type of value: %T", node.Value)
+		}
 		t.Log("Value:", node.Value)
 	}
 }
@@ -94,3 +100,182 @@ func TestBufferRecovery2(t *testing.T) {
 		t.Log("Value:", node.Value)
 	}
 }
+
+func TestRecoveryRoundTrip(t *testing.T) {
+	age := 7
+	values := map[string]interface{}{
+		"Int":       42,
+		"Int64":     int64(-42),
+		"Float":     3.5,
+		"String":    "value",
+		"Bool":      true,
+		"Struct":    TestData{"AA", 1},
+		"Nested":    TestData2{"a-a", "address a", 1, map[string]string{"a": "b"}, []int{1, 2}},
+		"Slice":     []string{"a", "b"},
+		"Map":       map[string]int{"a": 1, "b": 2},
+		"Pointer":   &TestData{"BB", 2},
+		"IntPtr":    &age,
+		"StructMap": map[string]TestData{"a": {"CC", 3}},
+	}
+
+	for _, codec := range []Codec{GobCodec, JSONCodec} {
+		for name, value := range values {
+			t.Run(codec.Name()+"/"+name, func(t *testing.T) {
+				file := "./buffer_roundtrip"
+				os.Remove(file)
+				defer os.Remove(file)
+
+				buf := NewBuffer(
+					SetBufferFile(file),
+					SetBufferPersistenceControl(true),
+					SetBufferCodec(codec),
+				)
+				buf.AddDataAtTail(value)
+				buf.AddDataAtTail(value)
+				if err := buf.Persistent(); err != nil {
+					t.Fatal(err)
+				}
+
+				recovered := NewBuffer(
+					SetBufferFile(file),
+					SetBufferRecoveryControl(true),
+					SetBufferRegister(value),
+				)
+				if err := recovered.Recovery(); err != nil {
+					t.Fatal(err)
+				}
+
+				for node := recovered.Datas.Head; node != nil; node = node.Next {
+					if reflect.TypeOf(node.Value) != reflect.TypeOf(value) {
+						t.Fatalf("Wrong type: %T != %T", node.Value, value)
+					}
+					if !reflect.DeepEqual(node.Value, value) {
+						t.Fatalf("Wrong value: %#v != %#v", node.Value, value)
+					}
+				}
+				if recovered.Len() != 2 {
+					t.Fatal("Wrong length:", recovered.Len())
+				}
+			})
+		}
+	}
+}
+
+// TestPersistenceModel applies random adds and deletes at both ends and
+// in the middle of a deque, and checks the datas recovered from the file
+// against a slice holding the expected values.
+func TestPersistenceModel(t *testing.T) {
+	storages := map[string]func() []func(*Deque){
+		"File": func() []func(*Deque) {
+			return nil
+		},
+		"Segment": func() []func(*Deque) {
+			return []func(*Deque){SetDequeSegmentSize(128)}
+		},
+		"Memory": func() []func(*Deque) {
+			return []func(*Deque){SetDequeStorage(NewMemoryStorage())}
+		},
+		"NoCompaction": func() []func(*Deque) {
+			return []func(*Deque){SetDequeCompactionThreshold(0)}
+		},
+		"WAL": func() []func(*Deque) {
+			return []func(*Deque){SetDequeWAL(SyncNever)}
+		},
+	}
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			remove := func() {
+				NewSegmentStorage("./buffer_model", 128).Remove()
+				os.Remove("./buffer_model.wal")
+			}
+			remove()
+			defer remove()
+
+			opts := append([]func(*Deque){
+				SetDequeFile("./buffer_model"),
+				SetDequeDecoder(func(decode func(interface{}) error) (interface{}, error) {
+					var value int
+					err := decode(&value)
+					return value, err
+				}),
+			}, storage()...)
+			open := func(recovery bool) *Deque {
+				deque := newDeque()
+				for _, opt := range opts {
+					opt(deque)
+				}
+				deque.PersistenceControl = true
+				if recovery {
+					deque.RecoveryControl = true
+					if err := deque.Recovery(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return deque
+			}
+
+			seed := rand.Int63()
+			r := rand.New(rand.NewSource(seed))
+			deque := open(false)
+			var model []interface{}
+
+			for i := 0; i < 2000; i++ {
+				switch op := r.Intn(10); {
+				case op < 2:
+					deque.PushFront(i)
+					model = append([]interface{}{i}, model...)
+				case op < 5:
+					deque.PushBack(i)
+					model = append(model, i)
+				case op < 6 && len(model) > 0:
+					deque.PopFront()
+					model = model[1:]
+				case op < 7 && len(model) > 0:
+					if r.Intn(2) == 0 {
+						deque.PopBack()
+					} else {
+						deque.Mutex.Lock()
+						deque.DeleteNodeAtTail()
+						deque.Length--
+						deque.Mutex.Unlock()
+					}
+					model = model[:len(model)-1]
+				case op < 8 && len(model) > 0:
+					n := r.Intn(len(model))
+					deque.Mutex.Lock()
+					node := deque.Datas.Head
+					for j := 0; j < n; j++ {
+						node = node.Next
+					}
+					deque.deleteNode(node)
+					deque.Length--
+					deque.Mutex.Unlock()
+					model = append(model[:n:n], model[n+1:]...)
+				case op < 9:
+					if err := deque.Persistent(); err != nil {
+						t.Fatal(err)
+					}
+				default:
+					if !deque.WAL {
+						if err := deque.Persistent(); err != nil {
+							t.Fatal(err)
+						}
+					}
+
+					// continue with the deque recovered from the file
+					deque.Mutex.Lock()
+					deque.closeWAL()
+					deque.Mutex.Unlock()
+					deque = open(true)
+					if v := linkValues(&deque.Buffer); !reflect.DeepEqual(v, model) && len(v)+len(model) > 0 {
+						t.Fatalf("Wrong values recovered at %d with seed %d:\n%v\nexpected:\n%v", i, seed, v, model)
+					}
+					if deque.Len() != int64(len(model)) {
+						t.Fatalf("Wrong length recovered at %d with seed %d: %d", i, seed, deque.Len())
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,534 @@
+package mtque
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The operations logged in the write-ahead log. Every operation is logged
+// as a record of |op|lsn|position|data|, where the position locates the
+// node in the datas and the data depends on the operation.
+const (
+	walAdd    = iota + 1 // data is the encoding of the added node
+	walDelete            // no data
+	walUpdate            // data is the new meta of the node
+	walClear             // no data, and position is 0
+)
+
+// DEFAULT_WAL_MAX_SIZE is the default size of the write-ahead log which
+// forces a persistence to empty it, see SetQueueWALMaxSize.
+const DEFAULT_WAL_MAX_SIZE = 64 << 20
+
+// SyncPolicy decides when the write-ahead log is synced to the disk.
+type SyncPolicy struct {
+	// Interval is the max time the logged operations stay unsynced,
+	// 0 means syncing every operation and negative means never sync.
+	Interval time.Duration
+}
+
+var (
+	// SyncAlways syncs the log after every operation.
+	SyncAlways = SyncPolicy{}
+	// SyncNever leaves the syncing to the operating system.
+	SyncNever = SyncPolicy{Interval: -1}
+)
+
+// SyncEvery syncs the log at most the interval after an operation.
+func SyncEvery(interval time.Duration) SyncPolicy {
+	return SyncPolicy{Interval: interval}
+}
+
+// walFile returns the path of the write-ahead log of buffer.
+func (b *Buffer) walFile() string {
+	return b.File + ".wal"
+}
+
+// position returns the position of node in the datas. It is counted from
+// the head if it is not negative, otherwise -1 is the tail, -2 is the
+// one before the tail, and so on.
+// The Mutex should be held by the caller.
+func (b *Buffer) position(node *DataNode) int64 {
+	var i int64
+	for h, t := b.Datas.Head, b.Datas.Tail; h != nil; h, t = h.Next, t.Previous {
+		if h == node {
+			return i
+		}
+		if t == node {
+			return -i - 1
+		}
+		i++
+	}
+
+	return 0
+}
+
+// nodeAt returns the node at the position, see position.
+// The Mutex should be held by the caller.
+func (b *Buffer) nodeAt(pos int64) *DataNode {
+	if pos >= 0 {
+		node := b.Datas.Head
+		for ; node != nil && pos > 0; pos-- {
+			node = node.Next
+		}
+		return node
+	}
+
+	node := b.Datas.Tail
+	for ; node != nil && pos < -1; pos++ {
+		node = node.Previous
+	}
+	return node
+}
+
+// logAdd logs adding the node which is linked into the datas already.
+// The Mutex should be held by the caller.
+func (b *Buffer) logAdd(node *DataNode) {
+	if !b.WAL || b.File == "" {
+		return
+	}
+
+	data, err := node.encode(b.codec())
+	if err != nil {
+		b.failWAL(err)
+		return
+	}
+	b.logOp(walAdd, b.position(node), data)
+}
+
+// logDelete logs deleting the node which is not unlinked yet.
+// The Mutex should be held by the caller.
+func (b *Buffer) logDelete(node *DataNode) {
+	if b.WAL && b.File != "" {
+		b.logOp(walDelete, b.position(node), nil)
+	}
+}
+
+// logUpdate logs changing the attributes of node.
+// The Mutex should be held by the caller.
+func (b *Buffer) logUpdate(node *DataNode) {
+	if b.WAL && b.File != "" {
+		b.logOp(walUpdate, b.position(node), node.encodeMeta())
+	}
+}
+
+// logClear logs removing all the datas.
+// The Mutex should be held by the caller.
+func (b *Buffer) logClear() {
+	if b.WAL && b.File != "" {
+		b.logOp(walClear, 0, nil)
+	}
+}
+
+// logOp appends an operation into the write-ahead log, and syncs
+// the log with the sync policy.
+// The Mutex should be held by the caller.
+func (b *Buffer) logOp(op byte, pos int64, data []byte) {
+	if b.wal == nil {
+		// a log left by others is dropped if it is not replayed.
+		flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if b.lsn == 0 {
+			flag |= os.O_TRUNC
+		}
+		file, err := os.OpenFile(b.walFile(), flag, 0644)
+		if err != nil {
+			b.failWAL(err)
+			return
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			b.failWAL(err)
+			return
+		}
+		b.wal = file
+		b.walSize = info.Size()
+	}
+
+	b.lsn++
+	payload := append([]byte{op}, binary.AppendVarint(nil, b.lsn)...)
+	payload = binary.AppendVarint(payload, pos)
+	record, err := encodeRecord(append(payload, data...))
+	if err != nil {
+		b.failWAL(err)
+		return
+	}
+
+	n, err := b.wal.Write(record)
+	b.walSize += int64(n)
+	if err != nil {
+		b.failWAL(err)
+		return
+	}
+
+	// the persistence is made after the operation is done, because
+	// the logged operation may not be applied on the datas yet.
+	if b.walSize >= b.walMaxSize() && b.walCheckpoint == nil {
+		b.walCheckpoint = time.AfterFunc(0, b.checkpointWAL)
+	}
+
+	switch {
+	case b.WALSync.Interval == 0:
+		if err := b.wal.Sync(); err != nil {
+			b.failWAL(err)
+		}
+	case b.WALSync.Interval > 0 && b.walSyncer == nil:
+		b.walSyncer = time.AfterFunc(b.WALSync.Interval, b.syncWAL)
+	}
+}
+
+// walMaxSize returns the size of log which forces a persistence.
+func (b *Buffer) walMaxSize() int64 {
+	if b.WALMaxSize <= 0 {
+		return DEFAULT_WAL_MAX_SIZE
+	}
+
+	return b.WALMaxSize
+}
+
+// checkpointWAL makes a persistence to empty the write-ahead log grown
+// over WALMaxSize, whether PersistenceControl is set or not. The error
+// of it is returned by the next persistence.
+func (b *Buffer) checkpointWAL() {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	b.walCheckpoint = nil
+	if b.closed || b.File == "" || b.walSize < b.walMaxSize() {
+		return
+	}
+
+	if err := b.incrementPersistent(); err != nil {
+		b.failWAL(err)
+	}
+}
+
+// failWAL keeps the first error of logging, it is returned by the next
+// persistence, which makes a checkpoint including the lost operations.
+// The Mutex should be held by the caller.
+func (b *Buffer) failWAL(err error) {
+	if b.walErr == nil {
+		b.walErr = fmt.Errorf("write-ahead log: %v", err)
+	}
+}
+
+// syncWAL syncs the operations logged in the last interval.
+func (b *Buffer) syncWAL() {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	b.walSyncer = nil
+	if b.wal != nil {
+		if err := b.wal.Sync(); err != nil {
+			b.failWAL(err)
+		}
+	}
+}
+
+// closeWAL syncs and closes the write-ahead log.
+// The Mutex should be held by the caller.
+func (b *Buffer) closeWAL() {
+	if b.walSyncer != nil {
+		b.walSyncer.Stop()
+		b.walSyncer = nil
+	}
+	if b.walCheckpoint != nil {
+		b.walCheckpoint.Stop()
+		b.walCheckpoint = nil
+	}
+	if b.wal != nil {
+		b.wal.Sync()
+		b.wal.Close()
+		b.wal = nil
+	}
+}
+
+// truncateWAL empties the write-ahead log after a checkpoint, all the
+// logged operations are included in the file already.
+// The Mutex should be held by the caller.
+func (b *Buffer) truncateWAL() error {
+	var err error
+	if b.wal != nil {
+		err = b.wal.Truncate(0)
+		if err == nil {
+			b.walSize = 0
+		}
+	} else {
+		err = os.Truncate(b.walFile(), 0)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err, b.walErr = b.walErr, nil
+
+	return err
+}
+
+// replayWAL applies the operations logged after the checkpoint on the
+// datas recovered from the file. A torn record at the end of the log,
+// which is left by crashing in logging, is truncated with all the records
+// after it whatever the corruption policy is, because the operations
+// after a lost one can not be applied correctly.
+// The Mutex should be held by the caller.
+func (b *Buffer) replayWAL() error {
+	b.lsn = b.CheckpointLSN
+
+	file, err := os.OpenFile(b.walFile(), os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for offset < info.Size() {
+		data, next, err := readRecord(file, offset, info.Size(), true)
+		if err != nil {
+			b.report.drop(b.walFile(), offset, info.Size()-offset, err)
+			break
+		}
+
+		lsn, err := b.applyOp(data)
+		if err != nil {
+			return err
+		}
+		if lsn > b.lsn {
+			b.lsn = lsn
+		}
+		offset = next
+	}
+
+	if offset < info.Size() {
+		err = file.Truncate(offset)
+		if err != nil {
+			return err
+		}
+	}
+	b.reindex()
+
+	return nil
+}
+
+// loggedLSN returns the greatest LSN of the operations in the write-ahead
+// log, the torn record at the end of the log and the ones after it are
+// ignored like replaying it.
+// The Mutex should be held by the caller.
+func (b *Buffer) loggedLSN() (int64, error) {
+	file, err := os.Open(b.walFile())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var lsn, offset int64
+	for offset < info.Size() {
+		data, next, err := readRecord(file, offset, info.Size(), true)
+		if err != nil || len(data) == 0 {
+			break
+		}
+
+		if l, n := binary.Varint(data[1:]); n > 0 && l > lsn {
+			lsn = l
+		}
+		offset = next
+	}
+
+	return lsn, nil
+}
+
+// applyOp applies an operation logged in the record if it is not included
+// in the file, and returns the LSN of the operation.
+// The Mutex should be held by the caller.
+func (b *Buffer) applyOp(record []byte) (int64, error) {
+	if len(record) == 0 {
+		return 0, fmt.Errorf("invalid operation in write-ahead log")
+	}
+	op := record[0]
+	lsn, n := binary.Varint(record[1:])
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid lsn in write-ahead log")
+	}
+	pos, m := binary.Varint(record[1+n:])
+	if m <= 0 {
+		return 0, fmt.Errorf("invalid position in write-ahead log")
+	}
+	data := record[1+n+m:]
+
+	if lsn <= b.CheckpointLSN {
+		return lsn, nil
+	}
+	// the file does not include the operation any more.
+	b.rewrite = true
+
+	switch op {
+	case walAdd:
+		if b.Register == nil && b.Decoder == nil && !typesRegistered() {
+			return 0, errUnregistered
+		}
+		node, err := b.decodeNode(data)
+		if err != nil {
+			return 0, err
+		}
+		b.insertNode(node, pos)
+		b.Length++
+	case walDelete:
+		node := b.nodeAt(pos)
+		if node == nil {
+			return 0, fmt.Errorf("no node at position %d in write-ahead log", pos)
+		}
+		b.Datas.DeleteNode(node)
+		b.Length--
+	case walUpdate:
+		node := b.nodeAt(pos)
+		if node == nil {
+			return 0, fmt.Errorf("no node at position %d in write-ahead log", pos)
+		}
+		meta := NewDataNode(nil)
+		if _, err := meta.decodeMeta(data); err != nil {
+			return 0, err
+		}
+		node.setMeta(meta)
+	case walClear:
+		b.Datas = NewDataLink()
+		b.Length = 0
+	default:
+		return 0, fmt.Errorf("unknown operation %d in write-ahead log", op)
+	}
+
+	return lsn, nil
+}
+
+// insertNode links the node into the datas at the position, see position.
+// The Mutex should be held by the caller.
+func (b *Buffer) insertNode(node *DataNode, pos int64) {
+	var next *DataNode
+	if pos >= 0 {
+		next = b.nodeAt(pos)
+	} else if pos < -1 {
+		next = b.nodeAt(pos + 1)
+	}
+
+	switch {
+	case next == nil:
+		b.Datas.AddNodeAtTail(node)
+	case next == b.Datas.Head:
+		b.Datas.AddNodeAtHead(node)
+	default:
+		node.Previous = next.Previous
+		node.Next = next
+		next.Previous.Next = node
+		next.Previous = node
+	}
+}
+
+// SetQueueWAL makes the queue log every change into the write-ahead log
+// File+".wal", which is replayed on the file at recovering. The log is
+// emptied at every persistence, which writes a checkpoint of the queue.
+// Once the log grows over WALMaxSize, a persistence is made to empty it,
+// even if the persistence is not enabled, see SetQueueWALMaxSize.
+func SetQueueWAL(policy SyncPolicy) func(*Queue) {
+	return func(queue *Queue) {
+		queue.WAL = true
+		queue.WALSync = policy
+	}
+}
+
+// SetStackWAL makes the stack log every change into the write-ahead log
+// File+".wal", which is replayed on the file at recovering. The log is
+// emptied at every persistence, which writes a checkpoint of the stack.
+// Once the log grows over WALMaxSize, a persistence is made to empty it,
+// even if the persistence is not enabled, see SetStackWALMaxSize.
+func SetStackWAL(policy SyncPolicy) func(*Stack) {
+	return func(stack *Stack) {
+		stack.WAL = true
+		stack.WALSync = policy
+	}
+}
+
+// SetPriorityQueueWAL makes the priority queue log every change into
+// the write-ahead log File+".wal", see SetQueueWAL.
+func SetPriorityQueueWAL(policy SyncPolicy) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.WAL = true
+		queue.WALSync = policy
+	}
+}
+
+// SetDelayQueueWAL makes the delay queue log every change into
+// the write-ahead log File+".wal", see SetQueueWAL.
+func SetDelayQueueWAL(policy SyncPolicy) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.WAL = true
+		queue.WALSync = policy
+	}
+}
+
+// SetDequeWAL makes the deque log every change into
+// the write-ahead log File+".wal", see SetQueueWAL.
+func SetDequeWAL(policy SyncPolicy) func(*Deque) {
+	return func(deque *Deque) {
+		deque.WAL = true
+		deque.WALSync = policy
+	}
+}
+
+// SetQueueWALMaxSize set the size of the write-ahead log which forces
+// a persistence to empty it, so the log and the time to replay it are
+// bounded. 0 means DEFAULT_WAL_MAX_SIZE, which is the default.
+func SetQueueWALMaxSize(size int64) func(*Queue) {
+	return func(queue *Queue) {
+		queue.WALMaxSize = size
+	}
+}
+
+// SetStackWALMaxSize set the size of the write-ahead log which forces
+// a persistence to empty it, see SetQueueWALMaxSize.
+func SetStackWALMaxSize(size int64) func(*Stack) {
+	return func(stack *Stack) {
+		stack.WALMaxSize = size
+	}
+}
+
+// SetPriorityQueueWALMaxSize set the size of the write-ahead log which
+// forces a persistence to empty it, see SetQueueWALMaxSize.
+func SetPriorityQueueWALMaxSize(size int64) func(*PriorityQueue) {
+	return func(queue *PriorityQueue) {
+		queue.WALMaxSize = size
+	}
+}
+
+// SetDelayQueueWALMaxSize set the size of the write-ahead log which
+// forces a persistence to empty it, see SetQueueWALMaxSize.
+func SetDelayQueueWALMaxSize(size int64) func(*DelayQueue) {
+	return func(queue *DelayQueue) {
+		queue.WALMaxSize = size
+	}
+}
+
+// SetDequeWALMaxSize set the size of the write-ahead log which forces
+// a persistence to empty it, see SetQueueWALMaxSize.
+func SetDequeWALMaxSize(size int64) func(*Deque) {
+	return func(deque *Deque) {
+		deque.WALMaxSize = size
+	}
+}
@@ -0,0 +1,199 @@
+package mtque
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func intDecoder(decode func(interface{}) error) (interface{}, error) {
+	var value int
+	err := decode(&value)
+	return value, err
+}
+
+func TestQueueWAL(t *testing.T) {
+	os.Remove("./queue_wal")
+	os.Remove("./queue_wal.wal")
+
+	queue := NewQueue(
+		SetQueueFile("./queue_wal"),
+		SetQueuePersistenceControl(true),
+		SetQueueWAL(SyncAlways),
+	)
+	for i := 1; i <= 5; i++ {
+		queue.EnQueue(i)
+	}
+
+	t.Run("Checkpoint", func(t *testing.T) {
+		if err := queue.Persistent(); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat("./queue_wal.wal"); err != nil || info.Size() != 0 {
+			t.Fatal("The log should be emptied by the checkpoint:", info, err)
+		}
+	})
+
+	t.Run("Incremental", func(t *testing.T) {
+		before, _ := os.Stat("./queue_wal")
+		queue.DeQueue()
+		if err := queue.Persistent(); err != nil {
+			t.Fatal(err)
+		}
+		after, _ := os.Stat("./queue_wal")
+		if !os.SameFile(before, after) {
+			t.Fatal("The checkpoint should not rewrite the file")
+		}
+		if info, err := os.Stat("./queue_wal.wal"); err != nil || info.Size() != 0 {
+			t.Fatal("The log should be emptied by the checkpoint:", info, err)
+		}
+	})
+
+	queue.Reserve(time.Hour)
+	queue.EnQueue(6)
+	// crash without persistence
+	DestroyQueue("./queue_wal")
+
+	t.Run("Replay", func(t *testing.T) {
+		recovered := NewQueue(
+			SetQueueFile("./queue_wal"),
+			SetQueueRecoveryControl(true),
+			SetQueueWAL(SyncAlways),
+			SetQueueDecoder(intDecoder),
+		)
+		defer DestroyQueue("./queue_wal")
+		if err := recovered.Recovery(); err != nil {
+			t.Fatal(err)
+		}
+
+		if recovered.Len() != 5 || recovered.InFlight() != 1 {
+			t.Fatal("Replay error:", recovered.Len(), recovered.InFlight())
+		}
+		for _, want := range []int{3, 4, 5, 6} {
+			if v, err := recovered.DeQueue(); err != nil || v != want {
+				t.Fatal("Wrong value:", v, err, want)
+			}
+		}
+	})
+}
+
+func TestWALTornRecord(t *testing.T) {
+	os.Remove("./buffer_wal")
+	os.Remove("./buffer_wal.wal")
+
+	buf := NewBuffer(
+		SetBufferFile("./buffer_wal"),
+		SetBufferWAL(SyncNever),
+	)
+	buf.AddDataAtTail(1)
+	buf.AddDataAtTail(2)
+	buf.AddDataAtHead(0)
+	buf.DeleteNodeAtTail()
+	buf.closeWAL()
+
+	file, err := os.OpenFile("./buffer_wal.wal", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0x0c, 0xff, 0x01})
+	file.Close()
+
+	recovered := NewBuffer(
+		SetBufferFile("./buffer_wal"),
+		SetBufferRecoveryControl(true),
+		SetBufferWAL(SyncNever),
+		SetBufferDecoder(intDecoder),
+	)
+	if err := recovered.Recovery(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := recovered.GetHeadValue(); v != 0 {
+		t.Fatal("Wrong head value:", v)
+	}
+	if v, _ := recovered.GetTailValue(); v != 1 {
+		t.Fatal("Wrong tail value:", v)
+	}
+
+	info, _ := os.Stat("./buffer_wal.wal")
+	recovered.AddDataAtTail(3)
+	if after, _ := os.Stat("./buffer_wal.wal"); after.Size() <= info.Size() {
+		t.Fatal("The log should be appended after the truncated record")
+	}
+}
+
+func TestPriorityQueueWAL(t *testing.T) {
+	os.Remove("./priority_wal")
+	os.Remove("./priority_wal.wal")
+
+	queue := NewPriorityQueue(
+		SetPriorityQueueFile("./priority_wal"),
+		SetPriorityQueueWAL(SyncEvery(5*time.Millisecond)),
+	)
+	queue.EnQueue(1, 1)
+	queue.EnQueue(2, 3)
+	queue.EnQueue(3, 2)
+	queue.DeQueue()
+	time.Sleep(20 * time.Millisecond)
+	// crash without persistence
+	queue.Mutex.Lock()
+	queue.releaseLock()
+	queue.Mutex.Unlock()
+
+	recovered := NewPriorityQueue(
+		SetPriorityQueueFile("./priority_wal"),
+		SetPriorityQueueRecoveryControl(true),
+		SetPriorityQueueWAL(SyncNever),
+		SetPriorityQueueDecoder(intDecoder),
+	)
+	if recovered.Len() != 2 {
+		t.Fatal("Replay error:", recovered.Len())
+	}
+	if v, _ := recovered.DeQueue(); v != 3 {
+		t.Fatal("Wrong value:", v)
+	}
+}
+
+func TestWALMaxSize(t *testing.T) {
+	os.Remove("./queue_wal_size")
+	os.Remove("./queue_wal_size.wal")
+
+	queue := NewQueue(
+		SetQueueFile("./queue_wal_size"),
+		SetQueuePersistencePeriod(time.Hour),
+		SetQueueWAL(SyncNever),
+		SetQueueWALMaxSize(256),
+	)
+	defer os.Remove("./queue_wal_size.wal")
+	defer DestroyQueue("./queue_wal_size")
+
+	for i := 0; i < 100; i++ {
+		queue.EnQueue(i)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, err := os.Stat("./queue_wal_size.wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() < 256 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The log should be emptied once it grows over the max size:", info.Size())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	buf := NewBuffer(
+		SetBufferFile("./queue_wal_size"),
+		SetBufferRecoveryControl(true),
+		SetBufferDecoder(intDecoder),
+	)
+	if err := buf.Recovery(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Length < 90 {
+		t.Fatal("The logged values should be persisted into the file:", buf.Length)
+	}
+}